@@ -7,10 +7,16 @@ const (
 	StopDnsServer  EventType = "STOP_DNS_SERVER"
 	StartDOHServer EventType = "START_DOH_SERVER"
 	StopDOHServer  EventType = "STOP_DOH_SERVER"
+	StartDOTServer EventType = "START_DOT_SERVER"
+	StopDOTServer  EventType = "STOP_DOT_SERVER"
+	StartDOQServer EventType = "START_DOQ_SERVER"
+	StopDOQServer  EventType = "STOP_DOQ_SERVER"
 	UpdateConfig   EventType = "UPDATE_CONFIG"
 	UpdateSiteList EventType = "UPDATE_SITE_LIST"
 	Error          EventType = "ERROR"
 	Log            EventType = "LOG"
+	UpstreamStatus EventType = "UPSTREAM_STATUS" // payload is an UpstreamHealth
+	ServerFailed   EventType = "SERVER_FAILED"   // payload is the stop event of the server that couldn't start
 )
 
 type Event struct {
@@ -0,0 +1,12 @@
+package channels
+
+import "time"
+
+// UpstreamHealth is the payload of UpstreamStatus events, sent whenever an upstream is checked
+type UpstreamHealth struct {
+	Upstream    string
+	Up          bool
+	SuccessRate float64       // share of recent queries that got an answer, from 0 to 1
+	Latency     time.Duration // moving average
+	NextProbe   time.Time     // when an upstream that is down gets tried again
+}
@@ -2,7 +2,6 @@ package config
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -22,15 +21,56 @@ var BlockedSites *radix.Tree
 
 const AppName = "omamori"
 
+const JsonApiPath = "/resolve" // URL path of the JSON API of DOHS, taken from the ones doh_path can be
+
 type Config struct {
-	Upstream2     string `json:"upstream2"`
-	Upstream1     string `json:"upstream1"`
+	Upstreams        []UpstreamConfig `json:"upstreams"`
+	UpstreamStrategy string           `json:"upstream_strategy"`
+	ForwardRules     []ForwardRule    `json:"forward_rules"` // domains answered by other upstreams, e.g. over a VPN
+	Recursive        bool             `json:"recursive"`     // resolving from the root servers down instead of using the upstreams
+
+	// replaced by Upstreams, only read to migrate older config files
+	Upstream2 string `json:"upstream2,omitempty"`
+	Upstream1 string `json:"upstream1,omitempty"`
+
 	CertPath      string `json:"cert_path"`
 	KeyPath       string `json:"key_path"`
 	UdpServerPort int    `json:"port"`
+	DotServerPort int    `json:"dot_port"`
+	DoqServerPort int    `json:"doq_port"`
 	MapFile       string `json:"map_file"`
 	ConfigFile    string `json:"-"`
 	ConfigDir     string `json:"-"`
+
+	// DOHS listens on all interfaces unless given an address, or on loopback only in plain HTTP
+	DohAddress        string   `json:"doh_address"`
+	DohPort           int      `json:"doh_port"`
+	DohPath           string   `json:"doh_path"`            // URL path DOHS answers on, the rest gets a 404
+	DohPlainHTTP      bool     `json:"doh_plain_http"`      // cleartext HTTP/1.1 and h2c, for running behind a reverse proxy doing TLS
+	DohTrustedProxies []string `json:"doh_trusted_proxies"` // IPs or ranges whose X-Forwarded-For is believed
+
+	HealthCheckInterval    int `json:"health_check_interval"`    // seconds between probes of healthy upstreams, 0 to only probe the ones down
+	HealthFailureThreshold int `json:"health_failure_threshold"` // consecutive failures before an upstream is marked down
+
+	Bootstrap string `json:"bootstrap"` // plain DNS server resolving the hostnames of DoH upstreams
+
+	Use0x20 bool `json:"use_0x20"` // randomizes the case of names sent upstream, needs upstreams preserving it
+
+	DNSSEC          bool   `json:"dnssec"`            // validates answers, failing the ones with bad signatures
+	TrustAnchorFile string `json:"trust_anchor_file"` // DS records of the keys validation starts from
+
+	CacheType     string `json:"cache_type"`      // "lru" or "sharded"
+	CacheEntries  int    `json:"cache_entries"`   // capacity of the lru cache
+	CacheMaxBytes int    `json:"cache_max_bytes"` // memory the sharded cache may use
+
+	// popular entries are refreshed from upstream shortly before they expire
+	PrefetchTopCount  int `json:"prefetch_top_count"` // 0 disables prefetching
+	PrefetchWindow    int `json:"prefetch_window"`    // seconds of the sliding window popularity is counted over
+	PrefetchMinHits   int `json:"prefetch_min_hits"`  // hits within the window before an entry is considered
+	PrefetchThreshold int `json:"prefetch_threshold"` // percentage of the TTL left when the refresh kicks in
+
+	// expired entries are answered from for this many seconds when no upstream responds, 0 disables it
+	ServeStaleWindow int `json:"serve_stale_window"`
 }
 
 type SiteData struct {
@@ -164,21 +204,71 @@ func LoadConfig() error {
 		return err
 	}
 
-	parsedConfig := Config{}
+	// keys missing from the file keep their current value
+	parsedConfig := *Global
+	parsedConfig.Upstreams = nil // decoding would write into the slice shared with Global
+	parsedConfig.ForwardRules = nil
 	err = json.Unmarshal(data, &parsedConfig)
 	if err != nil {
 		return err
 	}
 
-	if isValidIP(parsedConfig.Upstream2) && isValidIP(parsedConfig.Upstream1) {
-		Global.Upstream2 = parsedConfig.Upstream2
-		Global.Upstream1 = parsedConfig.Upstream1
+	if parsedConfig.Upstreams == nil {
+		parsedConfig.Upstreams = legacyUpstreams(parsedConfig.Upstream1, parsedConfig.Upstream2)
+	}
+	if upstreams, err := validateUpstreams(parsedConfig.Upstreams); err == nil {
+		Global.Upstreams = upstreams
+	} else {
+		log.Println("Ignoring upstreams from the config file:", err)
+	}
+	Global.Upstream1, Global.Upstream2 = "", ""
+
+	if rules, err := validateForwardRules(parsedConfig.ForwardRules); err == nil {
+		Global.ForwardRules = rules
+		setForwardRules(rules)
+	} else {
+		log.Println("Ignoring forwarding rules from the config file:", err)
+	}
+
+	Global.Recursive = parsedConfig.Recursive
+
+	if IsValidStrategy(parsedConfig.UpstreamStrategy) {
+		Global.UpstreamStrategy = parsedConfig.UpstreamStrategy
 	}
 
 	if parsedConfig.UdpServerPort > 0 && parsedConfig.UdpServerPort < 65535 {
 		Global.UdpServerPort = parsedConfig.UdpServerPort
 	}
 
+	if parsedConfig.DotServerPort > 0 && parsedConfig.DotServerPort < 65535 {
+		Global.DotServerPort = parsedConfig.DotServerPort
+	}
+
+	if parsedConfig.DoqServerPort > 0 && parsedConfig.DoqServerPort < 65535 {
+		Global.DoqServerPort = parsedConfig.DoqServerPort
+	}
+
+	if parsedConfig.DohAddress == "" || net.ParseIP(parsedConfig.DohAddress) != nil {
+		Global.DohAddress = parsedConfig.DohAddress
+	}
+
+	if parsedConfig.DohPort > 0 && parsedConfig.DohPort < 65535 {
+		Global.DohPort = parsedConfig.DohPort
+	}
+
+	// the JSON API keeps its own path, registering it twice would panic
+	if strings.HasPrefix(parsedConfig.DohPath, "/") && parsedConfig.DohPath != JsonApiPath {
+		Global.DohPath = parsedConfig.DohPath
+	}
+
+	Global.DohPlainHTTP = parsedConfig.DohPlainHTTP
+
+	if proxies, err := validateTrustedProxies(parsedConfig.DohTrustedProxies); err == nil {
+		Global.DohTrustedProxies = proxies
+	} else {
+		log.Println("Ignoring trusted proxies from the config file:", err)
+	}
+
 	if _, err = os.Stat(parsedConfig.MapFile); err == nil {
 		Global.MapFile = parsedConfig.MapFile
 	}
@@ -191,6 +281,56 @@ func LoadConfig() error {
 		Global.CertPath = parsedConfig.CertPath
 	}
 
+	Global.DNSSEC = parsedConfig.DNSSEC
+
+	if _, err = os.Stat(parsedConfig.TrustAnchorFile); err == nil {
+		Global.TrustAnchorFile = parsedConfig.TrustAnchorFile
+	}
+
+	if parsedConfig.HealthCheckInterval >= 0 {
+		Global.HealthCheckInterval = parsedConfig.HealthCheckInterval
+	}
+
+	if parsedConfig.HealthFailureThreshold > 0 {
+		Global.HealthFailureThreshold = parsedConfig.HealthFailureThreshold
+	}
+
+	if parsedConfig.Bootstrap == "" || isValidIP(parsedConfig.Bootstrap) {
+		Global.Bootstrap = parsedConfig.Bootstrap
+	}
+
+	if parsedConfig.PrefetchTopCount >= 0 {
+		Global.PrefetchTopCount = parsedConfig.PrefetchTopCount
+	}
+
+	if parsedConfig.PrefetchWindow > 0 {
+		Global.PrefetchWindow = parsedConfig.PrefetchWindow
+	}
+
+	if parsedConfig.PrefetchMinHits > 0 {
+		Global.PrefetchMinHits = parsedConfig.PrefetchMinHits
+	}
+
+	if parsedConfig.PrefetchThreshold > 0 && parsedConfig.PrefetchThreshold < 100 {
+		Global.PrefetchThreshold = parsedConfig.PrefetchThreshold
+	}
+
+	if parsedConfig.CacheType == "lru" || parsedConfig.CacheType == "sharded" {
+		Global.CacheType = parsedConfig.CacheType
+	}
+
+	if parsedConfig.CacheEntries > 0 {
+		Global.CacheEntries = parsedConfig.CacheEntries
+	}
+
+	if parsedConfig.CacheMaxBytes > 0 {
+		Global.CacheMaxBytes = parsedConfig.CacheMaxBytes
+	}
+
+	if parsedConfig.ServeStaleWindow >= 0 {
+		Global.ServeStaleWindow = parsedConfig.ServeStaleWindow
+	}
+
 	return nil
 }
 
@@ -256,38 +396,80 @@ func NewConfig() *Config {
 		mapFile    = filepath.Join(configDir, "map.txt")
 		certPath   = filepath.Join(configDir, "cert", "server.crt")
 		keyPath    = filepath.Join(configDir, "cert", "server.key")
-		upstream1  = "1.1.1.1"
-		upstream2  = "208.67.220.220"
+		anchorPath = filepath.Join(configDir, "trust_anchors.txt")
 		port       = 53
+		dotPort    = 853 // RFC 7858 3.1
+		doqPort    = 853 // over UDP, so it doesn't clash with DoT (RFC 9250 4.1.1)
 	)
 
 	return &Config{
 		MapFile:       mapFile,
-		Upstream1:     upstream1,
-		Upstream2:     upstream2,
 		CertPath:      certPath,
 		KeyPath:       keyPath,
 		UdpServerPort: port,
+		DotServerPort: dotPort,
+		DoqServerPort: doqPort,
+		DohPort:       443,
+		DohPath:       "/dns-query", // the path in the examples of RFC 8484, most clients default to it
 		ConfigFile:    configFile,
 		ConfigDir:     configDir,
+
+		Upstreams: []UpstreamConfig{
+			{Address: "1.1.1.1", Transport: TransportUDP},
+			{Address: "208.67.220.220", Transport: TransportUDP},
+		},
+		UpstreamStrategy: StrategyFailover,
+
+		HealthCheckInterval:    30,
+		HealthFailureThreshold: 3,
+
+		Bootstrap: "1.1.1.1",
+
+		TrustAnchorFile: anchorPath,
+
+		CacheType:     "sharded",
+		CacheEntries:  1000,
+		CacheMaxBytes: 16 << 20,
+
+		PrefetchTopCount:  100,
+		PrefetchWindow:    300,
+		PrefetchMinHits:   3,
+		PrefetchThreshold: 10,
+
+		ServeStaleWindow: 24 * 60 * 60, // RFC 8767 5 suggests 1 to 3 days
 	}
 }
 
 func UpdateConfig(config *Config) error {
 
-	if !(isValidIP(config.Upstream2) && isValidIP(config.Upstream1)) {
-		return errors.New("upstream2 or upstream1 are not valid")
+	upstreams, err := validateUpstreams(config.Upstreams)
+	if err != nil {
+		return err
+	}
+
+	if !IsValidStrategy(config.UpstreamStrategy) {
+		return fmt.Errorf("unknown upstream strategy %q", config.UpstreamStrategy)
 	}
 
 	if _, err := os.Stat(config.MapFile); err != nil {
 		return err
 	}
 
-	Global.Upstream2 = config.Upstream2
-	Global.Upstream1 = config.Upstream1
+	Global.Upstreams = upstreams
+	Global.UpstreamStrategy = config.UpstreamStrategy
+	Global.Recursive = config.Recursive
+	Global.DNSSEC = config.DNSSEC
 
 	Global.MapFile = config.MapFile
 
+	// certificates are read whenever DOHS, DoT or DoQ start, new paths apply from their next start
+	if _, err := os.Stat(config.CertPath); err == nil {
+		Global.CertPath = config.CertPath
+	}
+	if _, err := os.Stat(config.KeyPath); err == nil {
+		Global.KeyPath = config.KeyPath
+	}
+
 	// update the config file
 	if err := SaveConfig(); err != nil {
 		return err
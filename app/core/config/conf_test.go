@@ -0,0 +1,37 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfigDohPath(t *testing.T) {
+	saved := *Global
+	t.Cleanup(func() {
+		*Global = saved
+		setForwardRules(saved.ForwardRules)
+	})
+	Global.ConfigFile = filepath.Join(t.TempDir(), "config.json")
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/custom-query", "/custom-query"},
+		{JsonApiPath, "/dns-query"},
+		{"dns-query", "/dns-query"},
+	}
+	for _, tt := range tests {
+		Global.DohPath = "/dns-query"
+		if err := os.WriteFile(Global.ConfigFile, []byte(`{"doh_path": "`+tt.path+`"}`), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := LoadConfig(); err != nil {
+			t.Fatal(err)
+		}
+		if Global.DohPath != tt.want {
+			t.Errorf("doh_path %q loaded as %q, want %q", tt.path, Global.DohPath, tt.want)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"omamori/app/core/internal/radix"
+	"strings"
+	"sync/atomic"
+)
+
+// ForwardRule sends the queries for a domain, and everything below it, to its own upstreams
+type ForwardRule struct {
+	// A domain suffix like corp.internal (*.corp.internal works too), or an IP
+	// range like 10.0.0.0/8 to forward the reverse lookups of its addresses
+	Domain    string           `json:"domain"`
+	Upstreams []UpstreamConfig `json:"upstreams"`
+}
+
+// reverse zones of a range are only enumerated up to this many
+const maxReverseZones = 256
+
+// forwardTable maps the zones of every rule, stored reversed like BlockedSites,
+// to the upstreams of the rule they came from
+type forwardTable struct {
+	zones     *radix.Tree
+	upstreams map[string][]UpstreamConfig
+}
+
+var forwarding atomic.Pointer[forwardTable]
+
+// ForwardUpstreams returns the upstreams of the rule with the longest suffix of the
+// name, along with the zone it matched. Found is false when no rule matches.
+func ForwardUpstreams(name string) (string, []UpstreamConfig, bool) {
+	table := forwarding.Load()
+	if table == nil {
+		return "", nil, false
+	}
+
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	zone, rule := table.zones.LongestMatch(ReverseDomain(name), '.')
+	if rule == nil {
+		return "", nil, false
+	}
+	return ReverseDomain(zone), table.upstreams[*rule], true
+}
+
+// setForwardRules replaces the rules queries are routed by, the rules must have been validated
+func setForwardRules(rules []ForwardRule) {
+	table := &forwardTable{
+		zones:     radix.NewRadixTree(),
+		upstreams: make(map[string][]UpstreamConfig, len(rules)),
+	}
+	for _, rule := range rules {
+		zones, _ := ForwardZones(rule.Domain)
+		domain := rule.Domain
+		for _, zone := range zones {
+			table.zones.Insert(ReverseDomain(zone), &domain)
+		}
+		table.upstreams[domain] = rule.Upstreams
+	}
+	forwarding.Store(table)
+}
+
+// ForwardZones turns the domain of a rule into the zones it covers, which is more
+// than one for IP ranges not ending on an octet, or nibble for IPv6, boundary
+func ForwardZones(domain string) ([]string, error) {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+
+	if strings.Contains(domain, "/") {
+		_, network, err := net.ParseCIDR(domain)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP range %q", domain)
+		}
+		return reverseZones(network)
+	}
+
+	domain = strings.TrimPrefix(strings.TrimPrefix(domain, "*"), ".")
+	domain = strings.TrimSuffix(domain, ".")
+	if !isValidHostname(domain) {
+		return nil, fmt.Errorf("invalid forwarding domain %q", domain)
+	}
+	return []string{domain}, nil
+}
+
+// reverseZones lists the in-addr.arpa (RFC 1035 3.5) or ip6.arpa (RFC 3596 2.5)
+// zones holding the PTR records of the addresses in the range
+func reverseZones(network *net.IPNet) ([]string, error) {
+	ones, _ := network.Mask.Size()
+	if ones == 0 {
+		return nil, fmt.Errorf("IP range %s is too broad to forward", network)
+	}
+
+	ip, suffix, digitBits := network.IP.To4(), "in-addr.arpa", 8
+	if ip == nil {
+		ip, suffix, digitBits = network.IP.To16(), "ip6.arpa", 4
+	}
+
+	// rounding up to a whole digit, ranges in between are split over several zones
+	digits := (ones + digitBits - 1) / digitBits
+	count := 1 << (digits*digitBits - ones)
+	if count > maxReverseZones {
+		return nil, fmt.Errorf("IP range %s spans too many reverse zones", network)
+	}
+
+	zones := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		labels := make([]string, 0, digits+1)
+		for digit := digits - 1; digit >= 0; digit-- {
+			value := addressDigit(ip, digit, digitBits)
+			if digit == digits-1 {
+				// the host bits of the last digit enumerate the zones
+				value |= i
+			}
+			if digitBits == 8 {
+				labels = append(labels, fmt.Sprintf("%d", value))
+			} else {
+				labels = append(labels, fmt.Sprintf("%x", value))
+			}
+		}
+		zones = append(zones, strings.Join(append(labels, suffix), "."))
+	}
+	return zones, nil
+}
+
+// addressDigit returns the n-th octet, or nibble, of the address
+func addressDigit(ip net.IP, n int, digitBits int) int {
+	if digitBits == 8 {
+		return int(ip[n])
+	}
+	if n%2 == 0 {
+		return int(ip[n/2] >> 4)
+	}
+	return int(ip[n/2] & 0x0F)
+}
+
+// validateForwardRules normalizes the rules, rejecting them if any is invalid
+func validateForwardRules(rules []ForwardRule) ([]ForwardRule, error) {
+	normalized := make([]ForwardRule, 0, len(rules))
+	seen := make(map[string]bool, len(rules))
+	for _, rule := range rules {
+		rule.Domain = strings.ToLower(strings.TrimSpace(rule.Domain))
+		if _, err := ForwardZones(rule.Domain); err != nil {
+			return nil, err
+		}
+		if seen[rule.Domain] {
+			return nil, fmt.Errorf("duplicate forwarding rule for %q", rule.Domain)
+		}
+		seen[rule.Domain] = true
+
+		upstreams, err := validateUpstreams(rule.Upstreams)
+		if err != nil {
+			return nil, fmt.Errorf("forwarding rule for %q: %w", rule.Domain, err)
+		}
+		rule.Upstreams = upstreams
+		normalized = append(normalized, rule)
+	}
+	return normalized, nil
+}
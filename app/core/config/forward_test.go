@@ -0,0 +1,74 @@
+package config
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestReverseZones(t *testing.T) {
+	tests := []struct {
+		cidr string
+		want []string
+	}{
+		{"10.0.0.0/8", []string{"10.in-addr.arpa"}},
+		{"192.0.2.0/24", []string{"2.0.192.in-addr.arpa"}},
+		{"192.0.2.1/32", []string{"1.2.0.192.in-addr.arpa"}},
+		{"192.168.0.0/23", []string{"0.168.192.in-addr.arpa", "1.168.192.in-addr.arpa"}},
+		{"172.16.0.0/12", []string{
+			"16.172.in-addr.arpa", "17.172.in-addr.arpa", "18.172.in-addr.arpa", "19.172.in-addr.arpa",
+			"20.172.in-addr.arpa", "21.172.in-addr.arpa", "22.172.in-addr.arpa", "23.172.in-addr.arpa",
+			"24.172.in-addr.arpa", "25.172.in-addr.arpa", "26.172.in-addr.arpa", "27.172.in-addr.arpa",
+			"28.172.in-addr.arpa", "29.172.in-addr.arpa", "30.172.in-addr.arpa", "31.172.in-addr.arpa",
+		}},
+		{"2001:db8::/32", []string{"8.b.d.0.1.0.0.2.ip6.arpa"}},
+		{"2001:db8::/31", []string{"8.b.d.0.1.0.0.2.ip6.arpa", "9.b.d.0.1.0.0.2.ip6.arpa"}},
+		{"2001:db8:abc0::/46", []string{
+			"0.c.b.a.8.b.d.0.1.0.0.2.ip6.arpa", "1.c.b.a.8.b.d.0.1.0.0.2.ip6.arpa",
+			"2.c.b.a.8.b.d.0.1.0.0.2.ip6.arpa", "3.c.b.a.8.b.d.0.1.0.0.2.ip6.arpa",
+		}},
+		{"fd00::/8", []string{"d.f.ip6.arpa"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cidr, func(t *testing.T) {
+			_, network, err := net.ParseCIDR(tt.cidr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			zones, err := reverseZones(network)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(zones, tt.want) {
+				t.Errorf("reverseZones = %v, want %v", zones, tt.want)
+			}
+		})
+	}
+}
+
+func TestForwardZones(t *testing.T) {
+	tests := []struct {
+		domain  string
+		want    []string
+		wantErr bool
+	}{
+		{"corp.internal", []string{"corp.internal"}, false},
+		{"*.Corp.Internal.", []string{"corp.internal"}, false},
+		{"10.1.0.0/16", []string{"1.10.in-addr.arpa"}, false},
+		{"0.0.0.0/0", nil, true},
+		{"::/0", nil, true},
+		{"10.0.0.0/33", nil, true},
+		{"not a domain", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.domain, func(t *testing.T) {
+			zones, err := ForwardZones(tt.domain)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ForwardZones error %v, want one: %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(zones, tt.want) {
+				t.Errorf("ForwardZones = %v, want %v", zones, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// TrustedProxyNetworks returns the proxies DOHS believes X-Forwarded-For from, single
+// addresses turned into ranges of their own
+func TrustedProxyNetworks() []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(Global.DohTrustedProxies))
+	for _, proxy := range Global.DohTrustedProxies {
+		if network, err := parseNetwork(proxy); err == nil {
+			networks = append(networks, network)
+		}
+	}
+	return networks
+}
+
+func parseNetwork(value string) (*net.IPNet, error) {
+	if strings.Contains(value, "/") {
+		_, network, err := net.ParseCIDR(value)
+		return network, err
+	}
+
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP %q", value)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// validateTrustedProxies checks every proxy is an IP or a range, rejecting the list otherwise
+func validateTrustedProxies(proxies []string) ([]string, error) {
+	normalized := make([]string, 0, len(proxies))
+	for _, proxy := range proxies {
+		proxy = strings.TrimSpace(proxy)
+		if _, err := parseNetwork(proxy); err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", proxy)
+		}
+		normalized = append(normalized, proxy)
+	}
+	return normalized, nil
+}
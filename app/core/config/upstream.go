@@ -0,0 +1,144 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// Transports upstreams can be reached over
+const (
+	TransportUDP   = "udp" // retried over TCP when the answer is truncated
+	TransportTCP   = "tcp"
+	TransportTLS   = "tls"   // DNS over TLS (RFC 7858)
+	TransportHTTPS = "https" // DNS over HTTPS (RFC 8484)
+)
+
+// Strategies for picking which upstream a query goes to
+const (
+	StrategyFailover      = "failover"       // in the configured order, moving on when one fails
+	StrategyRoundRobin    = "round_robin"    // spreading queries over all of them in turn
+	StrategyLowestLatency = "lowest_latency" // the one answering fastest on average
+	StrategyRace          = "race"           // all at once, the first valid answer wins
+)
+
+var (
+	Transports = []string{TransportUDP, TransportTCP, TransportTLS, TransportHTTPS}
+	Strategies = []string{StrategyFailover, StrategyRoundRobin, StrategyLowestLatency, StrategyRace}
+)
+
+type UpstreamConfig struct {
+	// An IP, or a hostname for tls and https. Also takes a full tls://host:853#name
+	// or https://host/dns-query URL, in which case the port comes from the URL.
+	Address   string `json:"address"`
+	Transport string `json:"transport"`
+	Port      int    `json:"port"`    // 0 for the transport's default port
+	Timeout   int    `json:"timeout"` // in milliseconds, 0 for the transport's default
+}
+
+// Normalize fills in the transport from the address when left out
+func (u UpstreamConfig) Normalize() UpstreamConfig {
+	u.Address = strings.TrimSpace(u.Address)
+	if u.Transport == "" {
+		switch {
+		case strings.HasPrefix(u.Address, "https://"):
+			u.Transport = TransportHTTPS
+		case strings.HasPrefix(u.Address, "tls://"):
+			u.Transport = TransportTLS
+		default:
+			u.Transport = TransportUDP
+		}
+	}
+	return u
+}
+
+func (u UpstreamConfig) Validate() error {
+	if u.Port < 0 || u.Port > 65535 {
+		return fmt.Errorf("invalid port %d", u.Port)
+	}
+	if u.Timeout < 0 {
+		return fmt.Errorf("invalid timeout %d", u.Timeout)
+	}
+
+	switch u.Transport {
+	case TransportUDP, TransportTCP:
+		if !isValidIP(u.Address) {
+			return fmt.Errorf("%s upstream %q is not an IP address", u.Transport, u.Address)
+		}
+	case TransportTLS, TransportHTTPS:
+		if strings.Contains(u.Address, "://") {
+			// {?dns} is the URI template selecting GET for DoH
+			parsed, err := url.Parse(strings.TrimSuffix(u.Address, "{?dns}"))
+			if err != nil || parsed.Scheme != u.Transport || parsed.Hostname() == "" {
+				return fmt.Errorf("invalid %s upstream %q", u.Transport, u.Address)
+			}
+		} else if !isValidIP(u.Address) && !isValidHostname(u.Address) {
+			return fmt.Errorf("invalid %s upstream %q", u.Transport, u.Address)
+		}
+	default:
+		return fmt.Errorf("unknown transport %q", u.Transport)
+	}
+	return nil
+}
+
+func (u UpstreamConfig) String() string {
+	description := u.Address + " (" + u.Transport
+	if u.Port != 0 {
+		description += fmt.Sprintf(", port %d", u.Port)
+	}
+	if u.Timeout != 0 {
+		description += fmt.Sprintf(", %d ms", u.Timeout)
+	}
+	return description + ")"
+}
+
+func isValidHostname(host string) bool {
+	if host == "" || len(host) > 253 || net.ParseIP(host) != nil {
+		return false
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if label == "" || len(label) > 63 || strings.ContainsAny(label, " /:#?@") {
+			return false
+		}
+	}
+	return true
+}
+
+func IsValidStrategy(strategy string) bool {
+	for _, s := range Strategies {
+		if s == strategy {
+			return true
+		}
+	}
+	return false
+}
+
+// validateUpstreams normalizes the list, rejecting it if any entry is invalid
+func validateUpstreams(upstreams []UpstreamConfig) ([]UpstreamConfig, error) {
+	if len(upstreams) == 0 {
+		return nil, errors.New("at least one upstream is needed")
+	}
+
+	normalized := make([]UpstreamConfig, 0, len(upstreams))
+	for _, upstream := range upstreams {
+		upstream = upstream.Normalize()
+		if err := upstream.Validate(); err != nil {
+			return nil, err
+		}
+		normalized = append(normalized, upstream)
+	}
+	return normalized, nil
+}
+
+// legacyUpstreams converts the upstream1 and upstream2 keys of older config files
+func legacyUpstreams(addresses ...string) []UpstreamConfig {
+	var upstreams []UpstreamConfig
+	for _, address := range addresses {
+		if address != "" {
+			upstreams = append(upstreams, UpstreamConfig{Address: address}.Normalize())
+		}
+	}
+	return upstreams
+}
@@ -0,0 +1,42 @@
+package dns
+
+import (
+	"log"
+	"omamori/app/core/config"
+	"omamori/app/core/internal/cache"
+	"time"
+)
+
+type cacheSettings struct {
+	cacheType string
+	entries   int
+	maxBytes  int
+}
+
+// settings the current cache was built with, the default one until configured
+var currentCache = cacheSettings{cache.CacheTypeLRU, 1000, 0}
+
+// ConfigureCache applies the cache settings from the current config. Changing the type or
+// size of the cache replaces it, so that only happens before the server starts.
+func ConfigureCache() {
+	settings := cacheSettings{config.Global.CacheType, config.Global.CacheEntries, config.Global.CacheMaxBytes}
+	if settings != currentCache {
+		newCache, err := cache.NewCache(settings.cacheType, settings.entries, settings.maxBytes)
+		if err != nil {
+			log.Println("Failed to configure cache:", err)
+		} else {
+			cache.DnsCache.Close()
+			cache.DnsCache = newCache
+			currentCache = settings
+		}
+	}
+
+	cache.DnsCache.ConfigurePrefetch(
+		prefetch,
+		time.Duration(config.Global.PrefetchWindow)*time.Second,
+		config.Global.PrefetchTopCount,
+		config.Global.PrefetchMinHits,
+		config.Global.PrefetchThreshold,
+	)
+	cache.DnsCache.SetStaleWindow(time.Duration(config.Global.ServeStaleWindow) * time.Second)
+}
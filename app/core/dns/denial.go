@@ -0,0 +1,370 @@
+package dns
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"omamori/app/core/internal/cache"
+	"strings"
+)
+
+// Authenticated denial of existence with NSEC (RFC 4035 5.4) and NSEC3 (RFC 5155 8)
+
+// NSEC3 records with more iterations are treated as insecure (RFC 9276 3.2)
+const maxNSEC3Iterations = 150
+
+const nsec3FlagOptOut = 1
+
+var base32Hex = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+var errNoDenialProof = errors.New("no proof the name or type doesn't exist")
+
+// typeBitmap holds the types present at a name, from the windowed bitmap of NSEC and NSEC3 (RFC 4034 4.1.2)
+type typeBitmap []byte
+
+func (bitmap typeBitmap) has(recordType uint16) bool {
+	window, bit := byte(recordType>>8), recordType&0xFF
+	for offset := 0; offset+2 <= len(bitmap); {
+		length := int(bitmap[offset+1])
+		blocks := bitmap[offset+2 : min(offset+2+length, len(bitmap))]
+		if bitmap[offset] == window {
+			return int(bit/8) < len(blocks) && blocks[bit/8]&(0x80>>(bit%8)) != 0
+		}
+		offset += 2 + length
+	}
+	return false
+}
+
+type nsecRecord struct {
+	owner string
+	next  string
+	types typeBitmap
+}
+
+type nsec3Record struct {
+	zone       string // the owner is the base32hex hash followed by the zone
+	hash       []byte
+	next       []byte
+	algorithm  uint8
+	flags      uint8
+	iterations uint16
+	salt       []byte
+	types      typeBitmap
+}
+
+func parseNSEC(owner string, data []byte) (*nsecRecord, error) {
+	next, offset, err := decodeDomainName(data, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &nsecRecord{owner: strings.ToLower(owner), next: strings.ToLower(next), types: data[offset:]}, nil
+}
+
+func parseNSEC3(owner string, data []byte) (*nsec3Record, error) {
+	labels := splitDomainName(strings.ToLower(owner))
+	if len(labels) == 0 {
+		return nil, errors.New("invalid NSEC3 owner")
+	}
+	hash, err := base32Hex.DecodeString(strings.ToUpper(labels[0]))
+	if err != nil {
+		return nil, errors.New("invalid NSEC3 owner")
+	}
+
+	if len(data) < 5 {
+		return nil, errors.New("invalid NSEC3 record")
+	}
+	saltEnd := 5 + int(data[4])
+	if saltEnd >= len(data) {
+		return nil, errors.New("invalid NSEC3 record")
+	}
+	hashEnd := saltEnd + 1 + int(data[saltEnd])
+	if hashEnd > len(data) {
+		return nil, errors.New("invalid NSEC3 record")
+	}
+
+	return &nsec3Record{
+		zone:       strings.Join(labels[1:], "."),
+		hash:       hash,
+		next:       data[saltEnd+1 : hashEnd],
+		algorithm:  data[0],
+		flags:      data[1],
+		iterations: binary.BigEndian.Uint16(data[2:4]),
+		salt:       data[5:saltEnd],
+		types:      data[hashEnd:],
+	}, nil
+}
+
+// denialRecords collects the NSEC and NSEC3 records of the authority section
+func denialRecords(authority []*Answer) ([]*nsecRecord, []*nsec3Record) {
+	var nsecs []*nsecRecord
+	var nsec3s []*nsec3Record
+	for _, rr := range authority {
+		switch cache.RecordType(rr.Type) {
+		case cache.RecordTypeNSEC:
+			if nsec, err := parseNSEC(rr.Name, rr.Data); err == nil {
+				nsecs = append(nsecs, nsec)
+			}
+		case cache.RecordTypeNSEC3:
+			if nsec3, err := parseNSEC3(rr.Name, rr.Data); err == nil && nsec3.algorithm == 1 {
+				nsec3s = append(nsec3s, nsec3)
+			}
+		}
+	}
+	return nsecs, nsec3s
+}
+
+// -- NSEC -- //
+
+// canonicalCompare orders names label by label from the right, case insensitively (RFC 4034 6.1)
+func canonicalCompare(a string, b string) int {
+	labelsA := splitDomainName(strings.ToLower(a))
+	labelsB := splitDomainName(strings.ToLower(b))
+	for i := 1; i <= min(len(labelsA), len(labelsB)); i++ {
+		labelA, labelB := cache.UnescapeLabel(labelsA[len(labelsA)-i]), cache.UnescapeLabel(labelsB[len(labelsB)-i])
+		if c := strings.Compare(labelA, labelB); c != 0 {
+			return c
+		}
+	}
+	return len(labelsA) - len(labelsB)
+}
+
+// covers reports whether the name falls strictly between the owner and the next name
+func (n *nsecRecord) covers(name string) bool {
+	if canonicalCompare(n.next, n.owner) <= 0 {
+		// the last NSEC of the zone points back to the apex
+		return canonicalCompare(name, n.owner) > 0
+	}
+	return canonicalCompare(name, n.owner) > 0 && canonicalCompare(name, n.next) < 0
+}
+
+// closestEncloser derives the closest existing ancestor of a name from the NSEC covering it
+func (n *nsecRecord) closestEncloser(name string) string {
+	ancestor := commonAncestor(name, n.owner)
+	if next := commonAncestor(name, n.next); len(next) > len(ancestor) {
+		ancestor = next
+	}
+	return ancestor
+}
+
+func commonAncestor(a string, b string) string {
+	labelsA := splitDomainName(strings.ToLower(a))
+	labelsB := splitDomainName(strings.ToLower(b))
+	common := 0
+	for common < min(len(labelsA), len(labelsB)) && labelsA[len(labelsA)-1-common] == labelsB[len(labelsB)-1-common] {
+		common++
+	}
+	return strings.Join(labelsA[len(labelsA)-common:], ".")
+}
+
+// provesNoType reports whether the bitmap shows neither the type nor a CNAME at the name.
+// At a zone cut the NSEC comes from the parent, which only has a say over the DS there,
+// the child zone may well have the type (RFC 6840 4.1)
+func provesNoType(types typeBitmap, qtype uint16) bool {
+	if qtype != uint16(cache.RecordTypeDS) && parentSide(types) {
+		return false
+	}
+	return !types.has(qtype) && !types.has(uint16(cache.RecordTypeCNAME))
+}
+
+// parentSide reports whether the bitmap is that of a delegation, NS without SOA
+func parentSide(types typeBitmap) bool {
+	return types.has(uint16(cache.RecordTypeNS)) && !types.has(uint16(cache.RecordTypeSOA))
+}
+
+// hidesDescendants reports whether names below the owner are out of the zone's hands, as they are
+// delegated away or redirected by a DNAME, so its denial records prove nothing about them (RFC 6840 4.1, 4.3)
+func hidesDescendants(types typeBitmap) bool {
+	return parentSide(types) || types.has(uint16(cache.RecordTypeDNAME))
+}
+
+// nsecDenial checks the NSEC records prove the name doesn't exist, or has no records of the
+// type when nxdomain is false, wildcards included
+func nsecDenial(nsecs []*nsecRecord, name string, qtype uint16, nxdomain bool) error {
+	name = strings.ToLower(name)
+
+	if !nxdomain {
+		for _, n := range nsecs {
+			if n.owner == name {
+				if provesNoType(n.types, qtype) {
+					return nil
+				}
+				return errors.New("NSEC shows the type exists")
+			}
+		}
+	}
+
+	// the name doesn't exist, and neither does a wildcard that could have matched it,
+	// or for NODATA the matching wildcard doesn't have the type
+	for _, n := range nsecs {
+		if !n.covers(name) || (isSubdomain(name, n.owner) && hidesDescendants(n.types)) {
+			continue
+		}
+		wildcard := "*." + n.closestEncloser(name)
+		if n.closestEncloser(name) == "" {
+			wildcard = "*"
+		}
+		for _, w := range nsecs {
+			if nxdomain && w.covers(wildcard) {
+				return nil
+			}
+			if !nxdomain && w.owner == wildcard && provesNoType(w.types, qtype) {
+				return nil
+			}
+		}
+	}
+	return errNoDenialProof
+}
+
+// nsecNoDS checks the NSEC proves the name is an unsigned delegation, returning false
+// when the name turns out not to be a delegation at all
+func nsecNoDS(nsecs []*nsecRecord, name string) (bool, error) {
+	name = strings.ToLower(name)
+	for _, n := range nsecs {
+		if n.owner == name {
+			if n.types.has(uint16(cache.RecordTypeDS)) {
+				return false, errors.New("NSEC shows a DS exists")
+			}
+			return n.types.has(uint16(cache.RecordTypeNS)) && !n.types.has(uint16(cache.RecordTypeSOA)), nil
+		}
+	}
+	if nsecDenial(nsecs, name, uint16(cache.RecordTypeDS), true) == nil {
+		return false, nil // there is no such name, so no zone cut either
+	}
+	return false, errNoDenialProof
+}
+
+// -- NSEC3 -- //
+
+// nsec3Hash hashes the name with SHA-1 as many times as told to (RFC 5155 5)
+func nsec3Hash(name string, iterations uint16, salt []byte) []byte {
+	hash := sha1.Sum(append(canonicalName(name), salt...))
+	for i := 0; i < int(iterations); i++ {
+		hash = sha1.Sum(append(hash[:], salt...))
+	}
+	return hash[:]
+}
+
+func (n *nsec3Record) matches(name string) bool {
+	return bytes.Equal(nsec3Hash(name, n.iterations, n.salt), n.hash)
+}
+
+func (n *nsec3Record) covers(name string) bool {
+	hash := nsec3Hash(name, n.iterations, n.salt)
+	if bytes.Compare(n.next, n.hash) <= 0 {
+		return bytes.Compare(hash, n.hash) > 0 || bytes.Compare(hash, n.next) < 0
+	}
+	return bytes.Compare(hash, n.hash) > 0 && bytes.Compare(hash, n.next) < 0
+}
+
+// insecureNSEC3 reports whether the records use parameters we don't verify, in which
+// case the answer is treated as insecure rather than bogus
+func insecureNSEC3(nsec3s []*nsec3Record) bool {
+	for _, n := range nsec3s {
+		if n.iterations > maxNSEC3Iterations {
+			return true
+		}
+	}
+	return false
+}
+
+// nsec3ClosestEncloser finds the closest ancestor of the name that exists, with an NSEC3 covering
+// the next closer name, one label longer (RFC 5155 8.3). It returns the encloser and that NSEC3.
+func nsec3ClosestEncloser(nsec3s []*nsec3Record, name string) (string, *nsec3Record, bool) {
+	labels := splitDomainName(strings.ToLower(name))
+	for i := 1; i <= len(labels); i++ {
+		encloser := strings.Join(labels[i:], ".")
+		nextCloser := strings.Join(labels[i-1:], ".")
+
+		var matched *nsec3Record
+		for _, n := range nsec3s {
+			if isSubdomain(encloser, n.zone) && n.matches(encloser) {
+				matched = n
+				break
+			}
+		}
+		if matched == nil {
+			continue
+		}
+		if hidesDescendants(matched.types) {
+			// a delegation or DNAME can't be the closest encloser of a name below it (RFC 5155 8.3)
+			return "", nil, false
+		}
+		for _, n := range nsec3s {
+			if n.covers(nextCloser) {
+				return encloser, n, true
+			}
+		}
+		return "", nil, false
+	}
+	return "", nil, false
+}
+
+// nsec3Denial checks the NSEC3 records prove the name doesn't exist, or has no records of the type
+func nsec3Denial(nsec3s []*nsec3Record, name string, qtype uint16, nxdomain bool) error {
+	if !nxdomain {
+		for _, n := range nsec3s {
+			if n.matches(name) {
+				if provesNoType(n.types, qtype) {
+					return nil
+				}
+				return errors.New("NSEC3 shows the type exists")
+			}
+		}
+	}
+
+	encloser, nextCloser, found := nsec3ClosestEncloser(nsec3s, name)
+	if !found {
+		return errNoDenialProof
+	}
+	if !nxdomain && qtype == uint16(cache.RecordTypeDS) && nextCloser.flags&nsec3FlagOptOut != 0 {
+		// an unsigned delegation skipped by opt-out (RFC 5155 8.6)
+		return nil
+	}
+
+	wildcard := "*." + encloser
+	if encloser == "" {
+		wildcard = "*"
+	}
+	for _, n := range nsec3s {
+		if nxdomain && n.covers(wildcard) {
+			return nil
+		}
+		if !nxdomain && n.matches(wildcard) && provesNoType(n.types, qtype) {
+			return nil
+		}
+	}
+	return errNoDenialProof
+}
+
+// nsec3NoDS checks the NSEC3 records prove the name is an unsigned delegation, returning false
+// when the name turns out not to be a delegation at all
+func nsec3NoDS(nsec3s []*nsec3Record, name string) (bool, error) {
+	for _, n := range nsec3s {
+		if n.matches(name) {
+			if n.types.has(uint16(cache.RecordTypeDS)) {
+				return false, errors.New("NSEC3 shows a DS exists")
+			}
+			return n.types.has(uint16(cache.RecordTypeNS)) && !n.types.has(uint16(cache.RecordTypeSOA)), nil
+		}
+	}
+
+	// no exact match, only an opt-out span can hide an unsigned delegation (RFC 5155 8.6)
+	if _, nextCloser, found := nsec3ClosestEncloser(nsec3s, name); found {
+		return nextCloser.flags&nsec3FlagOptOut != 0, nil
+	}
+	return false, errNoDenialProof
+}
+
+// provesDenial checks the authority section proves the negative answer for the name
+func provesDenial(authority []*Answer, name string, qtype uint16, nxdomain bool) error {
+	nsecs, nsec3s := denialRecords(authority)
+	if len(nsecs) > 0 {
+		return nsecDenial(nsecs, name, qtype, nxdomain)
+	}
+	if len(nsec3s) > 0 {
+		return nsec3Denial(nsec3s, name, qtype, nxdomain)
+	}
+	return errNoDenialProof
+}
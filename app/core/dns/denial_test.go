@@ -0,0 +1,346 @@
+package dns
+
+import (
+	"bytes"
+	"omamori/app/core/internal/cache"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// The zone every denial test is about:
+//
+//	example        SOA NS DNSKEY
+//	a.example      A
+//	dname.example  DNAME
+//	sub.example    NS, an unsigned delegation
+//	w.example      TXT
+//	*.w.example    A
+var denialZone = []struct {
+	name  string
+	types []cache.RecordType
+}{
+	{"example", []cache.RecordType{cache.RecordTypeSOA, cache.RecordTypeNS, cache.RecordTypeDNSKEY}},
+	{"a.example", []cache.RecordType{cache.RecordTypeA}},
+	{"dname.example", []cache.RecordType{cache.RecordTypeDNAME}},
+	{"sub.example", []cache.RecordType{cache.RecordTypeNS}},
+	{"w.example", []cache.RecordType{cache.RecordTypeTXT}},
+	{"*.w.example", []cache.RecordType{cache.RecordTypeA}},
+}
+
+var (
+	testNSEC3Salt       = []byte{0xab, 0xcd}
+	testNSEC3Iterations = uint16(1)
+)
+
+// nsecChain returns the signed NSEC records of the zone by owner, in canonical order
+func nsecChain(t *testing.T, key *testKey) map[string][]*Answer {
+	records := make(map[string][]*Answer)
+	for i, entry := range denialZone {
+		next := denialZone[(i+1)%len(denialZone)].name
+		types := append(entry.types[:len(entry.types):len(entry.types)], cache.RecordTypeRRSIG, cache.RecordTypeNSEC)
+		records[entry.name] = key.sign(t, testNSEC(entry.name, next, types...))
+	}
+	return records
+}
+
+type testNSEC3Chain struct {
+	records []*Answer // signed, each followed by its RRSIG
+	parsed  []*nsec3Record
+}
+
+// newNSEC3Chain hashes the names of the zone into a chain of NSEC3 records. With opt-out the
+// unsigned delegation is left out, and the span over it is flagged as possibly hiding some
+func newNSEC3Chain(t *testing.T, key *testKey, optOut bool) *testNSEC3Chain {
+	type hashed struct {
+		hash  []byte
+		types []cache.RecordType
+	}
+	var names []hashed
+	for _, entry := range denialZone {
+		if optOut && entry.name == "sub.example" {
+			continue
+		}
+		// the NSEC3 records live at the hashed names, so their own type isn't listed
+		types := append(entry.types[:len(entry.types):len(entry.types)], cache.RecordTypeRRSIG)
+		if entry.name == key.zone {
+			types = append(types, 51) // NSEC3PARAM
+		}
+		if entry.name == "sub.example" {
+			types = entry.types // nothing at an unsigned delegation is signed
+		}
+		names = append(names, hashed{nsec3Hash(entry.name, testNSEC3Iterations, testNSEC3Salt), types})
+	}
+	sort.Slice(names, func(i, j int) bool { return bytes.Compare(names[i].hash, names[j].hash) < 0 })
+
+	var flags byte
+	if optOut {
+		flags = nsec3FlagOptOut
+	}
+	chain := &testNSEC3Chain{}
+	for i, name := range names {
+		next := names[(i+1)%len(names)].hash
+		rdata := []byte{1, flags, byte(testNSEC3Iterations >> 8), byte(testNSEC3Iterations), byte(len(testNSEC3Salt))}
+		rdata = append(rdata, testNSEC3Salt...)
+		rdata = append(rdata, byte(len(next)))
+		rdata = append(rdata, next...)
+		rdata = append(rdata, testBitmap(name.types...)...)
+
+		owner := strings.ToLower(base32Hex.EncodeToString(name.hash)) + "." + key.zone
+		rr := &Answer{Name: owner, Type: uint16(cache.RecordTypeNSEC3), Class: 1, TTL: testTTL, Data: rdata, Length: uint16(len(rdata))}
+		parsed, err := parseNSEC3(owner, rdata)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain.records = append(chain.records, key.sign(t, rr)...)
+		chain.parsed = append(chain.parsed, parsed)
+	}
+	return chain
+}
+
+// match returns the signed NSEC3 for the name, which has to be in the zone
+func (chain *testNSEC3Chain) match(t *testing.T, name string) []*Answer {
+	t.Helper()
+	for i, n := range chain.parsed {
+		if n.matches(name) {
+			return chain.records[2*i : 2*i+2]
+		}
+	}
+	t.Fatalf("no NSEC3 matches %s", name)
+	return nil
+}
+
+// cover returns the signed NSEC3 whose span the hash of the name falls in
+func (chain *testNSEC3Chain) cover(t *testing.T, name string) []*Answer {
+	t.Helper()
+	for i, n := range chain.parsed {
+		if n.covers(name) {
+			return chain.records[2*i : 2*i+2]
+		}
+	}
+	t.Fatalf("no NSEC3 covers %s", name)
+	return nil
+}
+
+// withoutDuplicates keeps the first of records repeated in the section, as a proof may need the same one twice
+func withoutDuplicates(section []*Answer) []*Answer {
+	seen := make(map[string]bool)
+	var kept []*Answer
+	for _, rr := range section {
+		key := rr.String()
+		if !seen[key] {
+			seen[key] = true
+			kept = append(kept, rr)
+		}
+	}
+	return kept
+}
+
+// expandWildcard renames the signed RRset of the wildcard to the name it answers
+func expandWildcard(signed []*Answer, name string) []*Answer {
+	expanded := make([]*Answer, 0, len(signed))
+	for _, rr := range signed {
+		copied := *rr
+		copied.Name = name
+		expanded = append(expanded, &copied)
+	}
+	return expanded
+}
+
+type denialCase struct {
+	name      string
+	qname     string
+	qtype     cache.RecordType
+	rcode     uint16
+	answer    []*Answer
+	authority [][]*Answer
+	want      security
+}
+
+func runDenialCases(t *testing.T, tree *signedTree, key *testKey, tests []denialCase) {
+	t.Helper()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var authority []*Answer
+			if len(tt.answer) == 0 {
+				authority = key.sign(t, testSOA(t, key.zone)) // negative answers come with the SOA
+			}
+			for _, records := range tt.authority {
+				authority = append(authority, records...)
+			}
+			resp := &Query{Header: &Header{FLAGS: 1<<10 | tt.rcode}, Answer: tt.answer, Authority: withoutDuplicates(authority)}
+
+			question := &Question{Name: tt.qname, Type: uint16(tt.qtype), Class: 1}
+			got, err := tree.validator().validate(question, resp)
+			if got != tt.want {
+				t.Errorf("security %d, want %d (error %v)", got, tt.want, err)
+			}
+		})
+	}
+}
+
+func TestNSECDenial(t *testing.T) {
+	for _, alg := range testAlgorithms {
+		t.Run(alg.name, func(t *testing.T) {
+			tree, key := newSignedZone(t, "example", alg.algorithm)
+			nsec := nsecChain(t, key)
+			wildcard := key.sign(t, testA("*.w.example", 1))
+
+			runDenialCases(t, tree, key, []denialCase{
+				{
+					name: "NXDOMAIN", qname: "b.example", qtype: cache.RecordTypeA, rcode: 3,
+					authority: [][]*Answer{nsec["a.example"], nsec["example"]}, // the name, then *.example
+					want:      secure,
+				},
+				{
+					name: "NXDOMAIN without the wildcard proof", qname: "b.example", qtype: cache.RecordTypeA, rcode: 3,
+					authority: [][]*Answer{nsec["a.example"]},
+					want:      bogus,
+				},
+				{
+					name: "NODATA", qname: "a.example", qtype: cache.RecordTypeAAAA,
+					authority: [][]*Answer{nsec["a.example"]},
+					want:      secure,
+				},
+				{
+					name: "NODATA for a type that exists", qname: "a.example", qtype: cache.RecordTypeA,
+					authority: [][]*Answer{nsec["a.example"]},
+					want:      bogus,
+				},
+				{
+					name: "wildcard answer", qname: "x.w.example", qtype: cache.RecordTypeA,
+					answer:    expandWildcard(wildcard, "x.w.example"),
+					authority: [][]*Answer{nsec["*.w.example"]},
+					want:      secure,
+				},
+				{
+					name: "wildcard answer without proof the name doesn't exist", qname: "x.w.example", qtype: cache.RecordTypeA,
+					answer: expandWildcard(wildcard, "x.w.example"),
+					want:   bogus,
+				},
+				{
+					name: "wildcard NODATA", qname: "x.w.example", qtype: cache.RecordTypeAAAA,
+					authority: [][]*Answer{nsec["*.w.example"]},
+					want:      secure,
+				},
+				{
+					name: "NODATA from the parent side of a zone cut", qname: "sub.example", qtype: cache.RecordTypeA,
+					authority: [][]*Answer{nsec["sub.example"]},
+					want:      bogus,
+				},
+				{
+					name: "no DS at an unsigned delegation", qname: "sub.example", qtype: cache.RecordTypeDS,
+					authority: [][]*Answer{nsec["sub.example"]},
+					want:      secure,
+				},
+				{
+					name: "NXDOMAIN below a zone cut", qname: "x.sub.example", qtype: cache.RecordTypeA, rcode: 3,
+					authority: [][]*Answer{nsec["sub.example"], nsec["example"]},
+					want:      bogus,
+				},
+				{
+					name: "NXDOMAIN below a DNAME", qname: "x.dname.example", qtype: cache.RecordTypeA, rcode: 3,
+					authority: [][]*Answer{nsec["dname.example"], nsec["example"]},
+					want:      bogus,
+				},
+			})
+		})
+	}
+}
+
+func TestNSEC3Denial(t *testing.T) {
+	for _, alg := range testAlgorithms {
+		t.Run(alg.name, func(t *testing.T) {
+			tree, key := newSignedZone(t, "example", alg.algorithm)
+			chain := newNSEC3Chain(t, key, false)
+			optOut := newNSEC3Chain(t, key, true)
+			wildcard := key.sign(t, testA("*.w.example", 1))
+
+			runDenialCases(t, tree, key, []denialCase{
+				{
+					name: "NXDOMAIN", qname: "b.example", qtype: cache.RecordTypeA, rcode: 3,
+					// closest encloser, next closer name and the wildcard at the closest encloser (RFC 5155 7.2.2)
+					authority: [][]*Answer{chain.match(t, "example"), chain.cover(t, "b.example"), chain.cover(t, "*.example")},
+					want:      secure,
+				},
+				{
+					// with this salt *.example falls in the span of the apex's own NSEC3
+					name: "NXDOMAIN without the next closer proof", qname: "b.example", qtype: cache.RecordTypeA, rcode: 3,
+					authority: [][]*Answer{chain.match(t, "example"), chain.cover(t, "*.example")},
+					want:      bogus,
+				},
+				{
+					name: "NODATA", qname: "a.example", qtype: cache.RecordTypeAAAA,
+					authority: [][]*Answer{chain.match(t, "a.example")},
+					want:      secure,
+				},
+				{
+					name: "NODATA for a type that exists", qname: "a.example", qtype: cache.RecordTypeA,
+					authority: [][]*Answer{chain.match(t, "a.example")},
+					want:      bogus,
+				},
+				{
+					name: "wildcard answer", qname: "x.w.example", qtype: cache.RecordTypeA,
+					answer:    expandWildcard(wildcard, "x.w.example"),
+					authority: [][]*Answer{chain.cover(t, "x.w.example")},
+					want:      secure,
+				},
+				{
+					name: "wildcard answer without proof the name doesn't exist", qname: "x.w.example", qtype: cache.RecordTypeA,
+					answer: expandWildcard(wildcard, "x.w.example"),
+					want:   bogus,
+				},
+				{
+					name: "wildcard NODATA", qname: "x.w.example", qtype: cache.RecordTypeAAAA,
+					authority: [][]*Answer{chain.match(t, "w.example"), chain.cover(t, "x.w.example"), chain.match(t, "*.w.example")},
+					want:      secure,
+				},
+				{
+					name: "NODATA from the parent side of a zone cut", qname: "sub.example", qtype: cache.RecordTypeA,
+					authority: [][]*Answer{chain.match(t, "sub.example")},
+					want:      bogus,
+				},
+				{
+					name: "no DS at an unsigned delegation", qname: "sub.example", qtype: cache.RecordTypeDS,
+					authority: [][]*Answer{chain.match(t, "sub.example")},
+					want:      secure,
+				},
+				{
+					name: "NXDOMAIN below a zone cut", qname: "x.sub.example", qtype: cache.RecordTypeA, rcode: 3,
+					authority: [][]*Answer{chain.match(t, "sub.example"), chain.cover(t, "x.sub.example"), chain.cover(t, "*.sub.example")},
+					want:      bogus,
+				},
+				{
+					name: "NXDOMAIN below a DNAME", qname: "x.dname.example", qtype: cache.RecordTypeA, rcode: 3,
+					authority: [][]*Answer{chain.match(t, "dname.example"), chain.cover(t, "x.dname.example"), chain.cover(t, "*.dname.example")},
+					want:      bogus,
+				},
+				{
+					name: "no DS at a delegation skipped by opt-out", qname: "sub.example", qtype: cache.RecordTypeDS,
+					authority: [][]*Answer{optOut.match(t, "example"), optOut.cover(t, "sub.example")},
+					want:      secure,
+				},
+				{
+					name: "opt-out span as NODATA for another type", qname: "sub.example", qtype: cache.RecordTypeA,
+					authority: [][]*Answer{optOut.match(t, "example"), optOut.cover(t, "sub.example"), optOut.cover(t, "*.example")},
+					want:      bogus,
+				},
+			})
+		})
+	}
+}
+
+func TestProvesNoTypeAtZoneCut(t *testing.T) {
+	delegation := typeBitmap(testBitmap(cache.RecordTypeNS, cache.RecordTypeRRSIG, cache.RecordTypeNSEC))
+	apex := typeBitmap(testBitmap(cache.RecordTypeNS, cache.RecordTypeSOA, cache.RecordTypeRRSIG, cache.RecordTypeNSEC))
+
+	if provesNoType(delegation, uint16(cache.RecordTypeA)) {
+		t.Error("the parent side of a zone cut proved the child has no A records")
+	}
+	if !provesNoType(delegation, uint16(cache.RecordTypeDS)) {
+		t.Error("the parent side of a zone cut didn't prove there is no DS")
+	}
+	if !provesNoType(apex, uint16(cache.RecordTypeA)) {
+		t.Error("the apex of a zone didn't prove it has no A records")
+	}
+}
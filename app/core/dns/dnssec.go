@@ -0,0 +1,370 @@
+package dns
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"omamori/app/core/internal/cache"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DNSSEC record formats and signature verification (RFC 4034, RFC 4035)
+
+// DNSSEC algorithm numbers (RFC 8624 3.1) of the algorithms we can verify
+const (
+	algRSASHA256       = 8
+	algRSASHA512       = 10
+	algECDSAP256SHA256 = 13
+	algECDSAP384SHA384 = 14
+	algED25519         = 15
+)
+
+// DS digest types (RFC 8624 3.3)
+const (
+	digestSHA1   = 1
+	digestSHA256 = 2
+	digestSHA384 = 4
+)
+
+const (
+	dnskeyFlagZone = 1 << 8 // the key signs the zone data (RFC 4034 2.1.1)
+	dnskeyProtocol = 3
+)
+
+type dnskey struct {
+	flags     uint16
+	protocol  uint8
+	algorithm uint8
+	publicKey []byte
+	tag       uint16
+	rdata     []byte
+}
+
+type dsRecord struct {
+	keyTag     uint16
+	algorithm  uint8
+	digestType uint8
+	digest     []byte
+}
+
+type rrsig struct {
+	typeCovered uint16
+	algorithm   uint8
+	labels      uint8
+	originalTTL uint32
+	expiration  uint32
+	inception   uint32
+	keyTag      uint16
+	signerName  string
+	signature   []byte
+	signedPart  []byte // the RDATA up to the signature, with the signer name in canonical form
+}
+
+func parseDNSKEY(data []byte) (*dnskey, error) {
+	if len(data) < 5 {
+		return nil, errors.New("invalid DNSKEY record")
+	}
+	return &dnskey{
+		flags:     binary.BigEndian.Uint16(data[0:2]),
+		protocol:  data[2],
+		algorithm: data[3],
+		publicKey: data[4:],
+		tag:       keyTag(data),
+		rdata:     data,
+	}, nil
+}
+
+func parseDS(data []byte) (*dsRecord, error) {
+	if len(data) < 5 {
+		return nil, errors.New("invalid DS record")
+	}
+	return &dsRecord{
+		keyTag:     binary.BigEndian.Uint16(data[0:2]),
+		algorithm:  data[2],
+		digestType: data[3],
+		digest:     data[4:],
+	}, nil
+}
+
+func parseRRSIG(data []byte) (*rrsig, error) {
+	if len(data) < 19 {
+		return nil, errors.New("invalid RRSIG record")
+	}
+	signer, offset, err := decodeDomainName(data, 18)
+	if err != nil {
+		return nil, err
+	}
+	if offset >= len(data) {
+		return nil, errors.New("RRSIG without a signature")
+	}
+
+	signedPart := append([]byte(nil), data[:18]...)
+	signedPart = append(signedPart, canonicalName(signer)...)
+
+	return &rrsig{
+		typeCovered: binary.BigEndian.Uint16(data[0:2]),
+		algorithm:   data[2],
+		labels:      data[3],
+		originalTTL: binary.BigEndian.Uint32(data[4:8]),
+		expiration:  binary.BigEndian.Uint32(data[8:12]),
+		inception:   binary.BigEndian.Uint32(data[12:16]),
+		keyTag:      binary.BigEndian.Uint16(data[16:18]),
+		signerName:  strings.ToLower(signer),
+		signature:   data[offset:],
+		signedPart:  signedPart,
+	}, nil
+}
+
+// keyTag computes the tag identifying a DNSKEY in DS and RRSIG records (RFC 4034 Appendix B)
+func keyTag(rdata []byte) uint16 {
+	var sum uint32
+	for i, b := range rdata {
+		if i&1 == 0 {
+			sum += uint32(b) << 8
+		} else {
+			sum += uint32(b)
+		}
+	}
+	sum += sum >> 16
+	return uint16(sum)
+}
+
+func supportedAlgorithm(algorithm uint8) bool {
+	switch algorithm {
+	case algRSASHA256, algRSASHA512, algECDSAP256SHA256, algECDSAP384SHA384, algED25519:
+		return true
+	}
+	return false
+}
+
+func supportedDigest(digestType uint8) bool {
+	return digestType == digestSHA1 || digestType == digestSHA256 || digestType == digestSHA384
+}
+
+// matches checks the DS is the digest of the key, owner name included (RFC 4034 5.1.4)
+func (ds *dsRecord) matches(owner string, key *dnskey) bool {
+	if ds.keyTag != key.tag || ds.algorithm != key.algorithm {
+		return false
+	}
+
+	data := append(canonicalName(owner), key.rdata...)
+	var digest []byte
+	switch ds.digestType {
+	case digestSHA1:
+		sum := sha1.Sum(data)
+		digest = sum[:]
+	case digestSHA256:
+		sum := sha256.Sum256(data)
+		digest = sum[:]
+	case digestSHA384:
+		sum := sha512.Sum384(data)
+		digest = sum[:]
+	default:
+		return false
+	}
+	return bytes.Equal(digest, ds.digest)
+}
+
+// verify checks the signature over the RRset with the key, along with the validity period
+func (sig *rrsig) verify(key *dnskey, rrset []*Answer, now time.Time) error {
+	if sig.keyTag != key.tag || sig.algorithm != key.algorithm || key.protocol != dnskeyProtocol || key.flags&dnskeyFlagZone == 0 {
+		return errors.New("key doesn't match the signature")
+	}
+
+	// serial number arithmetic, the fields wrap around in 2106 (RFC 4034 3.1.5)
+	timestamp := uint32(now.Unix())
+	if int32(timestamp-sig.inception) < 0 {
+		return errors.New("signature not yet valid")
+	}
+	if int32(sig.expiration-timestamp) < 0 {
+		return errors.New("signature expired")
+	}
+
+	data, err := sig.signedData(rrset)
+	if err != nil {
+		return err
+	}
+	return verifySignature(sig.algorithm, key.publicKey, data, sig.signature)
+}
+
+// signedData puts together what the signature is over, the RRSIG RDATA without the
+// signature followed by the RRset in canonical form and order (RFC 4034 3.1.8.1, 6)
+func (sig *rrsig) signedData(rrset []*Answer) ([]byte, error) {
+	labels := splitDomainName(strings.ToLower(rrset[0].Name))
+	if int(sig.labels) > len(labels) {
+		return nil, errors.New("signature label count exceeds the owner name")
+	}
+	owner := strings.Join(labels, ".")
+	if int(sig.labels) < len(labels) {
+		// answer synthesized from a wildcard, signed with the wildcard as owner (RFC 4035 5.3.2)
+		owner = "*." + strings.Join(labels[len(labels)-int(sig.labels):], ".")
+		if sig.labels == 0 {
+			owner = "*"
+		}
+	}
+
+	var header bytes.Buffer
+	header.Write(canonicalName(owner))
+	_ = binary.Write(&header, binary.BigEndian, rrset[0].Type)
+	_ = binary.Write(&header, binary.BigEndian, rrset[0].Class)
+	_ = binary.Write(&header, binary.BigEndian, sig.originalTTL)
+
+	rdatas := make([][]byte, 0, len(rrset))
+	for _, rr := range rrset {
+		rdatas = append(rdatas, canonicalRData(rr.Type, rr.Data))
+	}
+	sort.Slice(rdatas, func(i, j int) bool {
+		return bytes.Compare(rdatas[i], rdatas[j]) < 0
+	})
+
+	data := append([]byte(nil), sig.signedPart...)
+	for i, rdata := range rdatas {
+		if i > 0 && bytes.Equal(rdata, rdatas[i-1]) {
+			continue // duplicates are left out (RFC 4034 6.3)
+		}
+		data = append(data, header.Bytes()...)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(rdata)))
+		data = append(data, rdata...)
+	}
+	return data, nil
+}
+
+func verifySignature(algorithm uint8, publicKey []byte, data []byte, signature []byte) error {
+	switch algorithm {
+	case algRSASHA256, algRSASHA512:
+		key, err := rsaPublicKey(publicKey)
+		if err != nil {
+			return err
+		}
+		if algorithm == algRSASHA256 {
+			hashed := sha256.Sum256(data)
+			return rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], signature)
+		}
+		hashed := sha512.Sum512(data)
+		return rsa.VerifyPKCS1v15(key, crypto.SHA512, hashed[:], signature)
+
+	case algECDSAP256SHA256, algECDSAP384SHA384:
+		curve, hashed := elliptic.P256(), sha256Sum(data)
+		if algorithm == algECDSAP384SHA384 {
+			curve, hashed = elliptic.P384(), sha384Sum(data)
+		}
+		size := curve.Params().BitSize / 8
+		if len(publicKey) != 2*size || len(signature) != 2*size {
+			return errors.New("invalid ECDSA key or signature")
+		}
+		// the key is X | Y and the signature r | s, without any encoding (RFC 6605 4)
+		key := &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(publicKey[:size]),
+			Y:     new(big.Int).SetBytes(publicKey[size:]),
+		}
+		r, s := new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, hashed, r, s) {
+			return errors.New("ECDSA signature verification failed")
+		}
+		return nil
+
+	case algED25519:
+		if len(publicKey) != ed25519.PublicKeySize {
+			return errors.New("invalid Ed25519 key")
+		}
+		if !ed25519.Verify(publicKey, data, signature) {
+			return errors.New("Ed25519 signature verification failed")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported algorithm %d", algorithm)
+}
+
+// rsaPublicKey decodes the exponent length, exponent and modulus of an RSA key (RFC 3110 2)
+func rsaPublicKey(data []byte) (*rsa.PublicKey, error) {
+	if len(data) < 3 {
+		return nil, errors.New("invalid RSA key")
+	}
+	exponentLength, offset := int(data[0]), 1
+	if exponentLength == 0 {
+		exponentLength, offset = int(binary.BigEndian.Uint16(data[1:3])), 3
+	}
+	if exponentLength == 0 || exponentLength > 4 || offset+exponentLength >= len(data) {
+		return nil, errors.New("invalid RSA key")
+	}
+
+	exponent := 0
+	for _, b := range data[offset : offset+exponentLength] {
+		exponent = exponent<<8 | int(b)
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(data[offset+exponentLength:]),
+		E: exponent,
+	}, nil
+}
+
+func sha256Sum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+func sha384Sum(data []byte) []byte {
+	sum := sha512.Sum384(data)
+	return sum[:]
+}
+
+// canonicalName returns the name in uncompressed wire format, all lowercase (RFC 4034 6.2)
+func canonicalName(name string) []byte {
+	w := newMessageWriter()
+	if err := w.writeName(name, false); err != nil {
+		return []byte{0}
+	}
+	return lowerASCII(w.buf.Bytes())
+}
+
+// lowerASCII lowercases in place, only US-ASCII letters are case insensitive in names (RFC 4343)
+func lowerASCII(data []byte) []byte {
+	for i, c := range data {
+		if 'A' <= c && c <= 'Z' {
+			data[i] = c + 'a' - 'A'
+		}
+	}
+	return data
+}
+
+// canonicalRData lowercases the names embedded in the RDATA of the types listed in
+// RFC 4034 6.2, which no longer includes NSEC (RFC 6840 5.1)
+func canonicalRData(recordType uint16, data []byte) []byte {
+	layout, found := rdataLayouts[recordType]
+	if !found {
+		if cache.RecordType(recordType) != cache.RecordTypeRRSIG {
+			return data
+		}
+		layout = []int{18, -1} // signer name, followed by the signature
+	}
+
+	canonical := append([]byte(nil), data...)
+	offset := 0
+	for _, field := range layout {
+		if field != -1 {
+			offset += field
+			continue
+		}
+		// stored names are never compressed, lowercasing the labels in place
+		for offset < len(canonical) && canonical[offset] != 0 {
+			end := min(offset+1+int(canonical[offset]), len(canonical))
+			lowerASCII(canonical[offset+1 : end])
+			offset = end
+		}
+		offset++
+	}
+	return canonical
+}
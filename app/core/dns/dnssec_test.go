@@ -0,0 +1,249 @@
+package dns
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"omamori/app/core/internal/cache"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Signed fixtures: zone keys of every algorithm we verify, signing RRsets the way a zone signer would
+
+var testAlgorithms = []struct {
+	name      string
+	algorithm uint8
+}{
+	{"RSASHA256", algRSASHA256},
+	{"RSASHA512", algRSASHA512},
+	{"ECDSAP256SHA256", algECDSAP256SHA256},
+	{"ECDSAP384SHA384", algECDSAP384SHA384},
+	{"ED25519", algED25519},
+}
+
+const testTTL = 3600
+
+type testKey struct {
+	zone      string
+	algorithm uint8
+	private   crypto.Signer
+	dnskey    *Answer
+	key       *dnskey
+}
+
+func newTestKey(t *testing.T, zone string, algorithm uint8) *testKey {
+	t.Helper()
+
+	var private crypto.Signer
+	var public []byte
+	var err error
+	switch algorithm {
+	case algRSASHA256, algRSASHA512:
+		var key *rsa.PrivateKey
+		key, err = rsa.GenerateKey(rand.Reader, 1024)
+		if err == nil {
+			// a 3 byte exponent of 65537, then the modulus (RFC 3110 2)
+			private, public = key, append([]byte{3, 1, 0, 1}, key.N.Bytes()...)
+		}
+	case algECDSAP256SHA256, algECDSAP384SHA384:
+		curve := elliptic.P256()
+		if algorithm == algECDSAP384SHA384 {
+			curve = elliptic.P384()
+		}
+		var key *ecdsa.PrivateKey
+		key, err = ecdsa.GenerateKey(curve, rand.Reader)
+		if err == nil {
+			size := curve.Params().BitSize / 8
+			private, public = key, append(key.X.FillBytes(make([]byte, size)), key.Y.FillBytes(make([]byte, size))...)
+		}
+	case algED25519:
+		var key ed25519.PrivateKey
+		public, key, err = ed25519.GenerateKey(rand.Reader)
+		private = key
+	default:
+		t.Fatalf("no test keys for algorithm %d", algorithm)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rdata := append([]byte{1, 1, dnskeyProtocol, algorithm}, public...) // flags 257, a KSK signing the zone
+	key, err := parseDNSKEY(rdata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testKey{
+		zone:      zone,
+		algorithm: algorithm,
+		private:   private,
+		dnskey:    &Answer{Name: zone, Type: uint16(cache.RecordTypeDNSKEY), Class: 1, TTL: testTTL, Data: rdata, Length: uint16(len(rdata))},
+		key:       key,
+	}
+}
+
+// ds returns the SHA-256 DS record of the key, as published in the parent zone
+func (k *testKey) ds() *Answer {
+	digest := sha256.Sum256(append(canonicalName(k.zone), k.key.rdata...))
+	rdata := binary.BigEndian.AppendUint16(nil, k.key.tag)
+	rdata = append(rdata, k.algorithm, digestSHA256)
+	rdata = append(rdata, digest[:]...)
+	return &Answer{Name: k.zone, Type: uint16(cache.RecordTypeDS), Class: 1, TTL: testTTL, Data: rdata, Length: uint16(len(rdata))}
+}
+
+// sign returns the RRset followed by its signature, valid from an hour ago for a day
+func (k *testKey) sign(t *testing.T, rrset ...*Answer) []*Answer {
+	t.Helper()
+	now := time.Now()
+	return append(rrset, k.signAt(t, now.Add(-time.Hour), now.Add(24*time.Hour), rrset...))
+}
+
+func (k *testKey) signAt(t *testing.T, inception time.Time, expiration time.Time, rrset ...*Answer) *Answer {
+	t.Helper()
+
+	labels := len(splitDomainName(rrset[0].Name))
+	if strings.HasPrefix(rrset[0].Name, "*.") || rrset[0].Name == "*" {
+		labels-- // the wildcard label isn't counted (RFC 4034 3.1.3)
+	}
+
+	rdata := binary.BigEndian.AppendUint16(nil, rrset[0].Type)
+	rdata = append(rdata, k.algorithm, uint8(labels))
+	rdata = binary.BigEndian.AppendUint32(rdata, rrset[0].TTL)
+	rdata = binary.BigEndian.AppendUint32(rdata, uint32(expiration.Unix()))
+	rdata = binary.BigEndian.AppendUint32(rdata, uint32(inception.Unix()))
+	rdata = binary.BigEndian.AppendUint16(rdata, k.key.tag)
+	rdata = append(rdata, canonicalName(k.zone)...)
+
+	sig, err := parseRRSIG(append(append([]byte(nil), rdata...), 0)) // a placeholder signature byte
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := sig.signedData(rrset)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var signature []byte
+	switch k.algorithm {
+	case algRSASHA256:
+		hashed := sha256.Sum256(data)
+		signature, err = k.private.Sign(rand.Reader, hashed[:], crypto.SHA256)
+	case algRSASHA512:
+		hashed := sha512.Sum512(data)
+		signature, err = k.private.Sign(rand.Reader, hashed[:], crypto.SHA512)
+	case algECDSAP256SHA256, algECDSAP384SHA384:
+		key := k.private.(*ecdsa.PrivateKey)
+		hashed := sha256Sum(data)
+		if k.algorithm == algECDSAP384SHA384 {
+			hashed = sha384Sum(data)
+		}
+		size := key.Curve.Params().BitSize / 8
+		r, s, signErr := ecdsa.Sign(rand.Reader, key, hashed)
+		signature, err = append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...), signErr
+	case algED25519:
+		signature, err = k.private.Sign(rand.Reader, data, crypto.Hash(0))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rdata = append(rdata, signature...)
+	return &Answer{Name: rrset[0].Name, Type: uint16(cache.RecordTypeRRSIG), Class: 1, TTL: rrset[0].TTL, Data: rdata, Length: uint16(len(rdata))}
+}
+
+func testA(name string, ip byte) *Answer {
+	return &Answer{Name: name, Type: uint16(cache.RecordTypeA), Class: 1, TTL: testTTL, Data: []byte{192, 0, 2, ip}, Length: 4}
+}
+
+func testSOA(t *testing.T, zone string) *Answer {
+	t.Helper()
+	soa := testAnswer(t, zone, &cache.SOARecord{MName: "ns." + zone, RName: "hostmaster." + zone, Minimum: 300})
+	soa.TTL = testTTL
+	return soa
+}
+
+func TestSignatureVerification(t *testing.T) {
+	now := time.Now()
+	for _, alg := range testAlgorithms {
+		t.Run(alg.name, func(t *testing.T) {
+			key := newTestKey(t, "example.com", alg.algorithm)
+			other := newTestKey(t, "example.com", alg.algorithm)
+
+			rrset := []*Answer{testA("www.example.com", 1), testA("www.example.com", 2)}
+			signed := key.sign(t, rrset...)
+			sig, err := parseRRSIG(signed[len(signed)-1].Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the records are sorted and lowercased before verifying (RFC 4034 6)
+			reordered := []*Answer{testA("WWW.Example.COM", 2), testA("www.example.com", 1)}
+			if err := sig.verify(key.key, reordered, now); err != nil {
+				t.Errorf("signature over the RRset in another order and case: %v", err)
+			}
+
+			tampered := []*Answer{testA("www.example.com", 1), testA("www.example.com", 66)}
+			if err := sig.verify(key.key, tampered, now); err == nil {
+				t.Error("signature verified over a changed RRset")
+			}
+			if err := sig.verify(other.key, rrset, now); err == nil {
+				t.Error("signature verified with another key")
+			}
+			if err := sig.verify(key.key, rrset, now.Add(48*time.Hour)); err == nil {
+				t.Error("expired signature verified")
+			}
+			if err := sig.verify(key.key, rrset, now.Add(-2*time.Hour)); err == nil {
+				t.Error("signature verified before its inception")
+			}
+		})
+	}
+}
+
+func TestSignatureOverWildcard(t *testing.T) {
+	key := newTestKey(t, "example.com", algED25519)
+	signed := key.sign(t, testA("*.example.com", 1))
+
+	sig, err := parseRRSIG(signed[1].Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the answer carries the name asked for, the signature is over the wildcard
+	if err := sig.verify(key.key, []*Answer{testA("www.example.com", 1)}, time.Now()); err != nil {
+		t.Errorf("wildcard expansion: %v", err)
+	}
+	if err := sig.verify(key.key, []*Answer{testA("a.b.example.com", 1)}, time.Now()); err != nil {
+		t.Errorf("wildcard expansion two labels deep: %v", err)
+	}
+	if err := sig.verify(key.key, []*Answer{testA("www.example.org", 1)}, time.Now()); err == nil {
+		t.Error("wildcard signature verified for a name outside its zone")
+	}
+}
+
+func TestDSMatchesKey(t *testing.T) {
+	key := newTestKey(t, "example.com", algECDSAP256SHA256)
+	other := newTestKey(t, "example.com", algECDSAP256SHA256)
+
+	ds, err := parseDS(key.ds().Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ds.matches("example.com", key.key) {
+		t.Error("DS doesn't match the key it was made from")
+	}
+	if !ds.matches("Example.COM", key.key) {
+		t.Error("owner name isn't compared case insensitively")
+	}
+	if ds.matches("example.org", key.key) {
+		t.Error("DS matched the key under another owner")
+	}
+	if ds.matches("example.com", other.key) {
+		t.Error("DS matched another key")
+	}
+}
@@ -0,0 +1,132 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DNS over HTTPS client (RFC 8484)
+
+const (
+	dohUpstreamTimeout = 2 * time.Second
+	dohContentType     = "application/dns-message"
+	dohURITemplate     = "{?dns}"
+)
+
+// dohUpstream sends queries as POST requests, or as GET when the URL ends
+// with the {?dns} URI template (RFC 8484 4.1)
+type dohUpstream struct {
+	address string
+	url     *url.URL
+	get     bool
+	client  *http.Client
+}
+
+func newDohUpstream(address string, bootstrap string, timeout time.Duration) (*dohUpstream, error) {
+	timeout = orDefault(timeout, dohUpstreamTimeout)
+
+	get := strings.HasSuffix(address, dohURITemplate)
+
+	u, err := url.Parse(strings.TrimSuffix(address, dohURITemplate))
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid DoH URL %q", address)
+	}
+
+	dialer, err := newBootstrapDialer(u.Hostname(), bootstrap, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	// one transport per upstream, keeping its HTTP/2 connection open for every query
+	transport := &http.Transport{
+		DialContext:         dialer.DialContext,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: timeout,
+	}
+
+	return &dohUpstream{
+		address: address,
+		url:     u,
+		get:     get,
+		client:  &http.Client{Transport: transport, Timeout: timeout},
+	}, nil
+}
+
+func (u *dohUpstream) String() string {
+	return u.address
+}
+
+// close shuts the idle connections of the transport, the ones still busy are closed
+// by the transport once they have been idle for long enough
+func (u *dohUpstream) close() {
+	u.client.CloseIdleConnections()
+}
+
+func (u *dohUpstream) exchange(query []byte, _ int, exactCase bool) ([]byte, error) {
+	// the ID is sent as 0 so responses to GET requests can be cached by HTTP caches (RFC 8484 4.1)
+	id := binary.BigEndian.Uint16(query[0:2])
+	msg := append([]byte(nil), query...)
+	binary.BigEndian.PutUint16(msg[0:2], 0)
+
+	var req *http.Request
+	var err error
+	if u.get {
+		target := *u.url
+		values := target.Query()
+		values.Set("dns", base64.RawURLEncoding.EncodeToString(msg))
+		target.RawQuery = values.Encode()
+		req, err = http.NewRequest(http.MethodGet, target.String(), nil)
+	} else {
+		req, err = http.NewRequest(http.MethodPost, u.url.String(), bytes.NewReader(msg))
+		if err == nil {
+			req.Header.Set("Content-Type", dohContentType)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", dohContentType)
+
+	httpResp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = httpResp.Body.Close()
+	}()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH upstream %s answered with HTTP %d", u.address, httpResp.StatusCode)
+	}
+	if mediaType := httpResp.Header.Get("Content-Type"); !strings.HasPrefix(mediaType, dohContentType) {
+		return nil, fmt.Errorf("DoH upstream %s answered with %q", u.address, mediaType)
+	}
+
+	resp, err := io.ReadAll(io.LimitReader(httpResp.Body, 0xFFFF+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 12 || len(resp) > 0xFFFF {
+		return nil, errors.New("invalid DoH response length")
+	}
+
+	binary.BigEndian.PutUint16(resp[0:2], id)
+	if !matchesQuery(query, resp, exactCase) {
+		discardMismatch(u.address)
+		return nil, errors.New("response does not match the query")
+	}
+	return resp, nil
+}
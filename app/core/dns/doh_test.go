@@ -0,0 +1,140 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"omamori/app/core/internal/cache"
+	"strings"
+	"testing"
+)
+
+// dohStandIn answers every well formed RFC 8484 request with a single A record
+func dohStandIn(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") != dohContentType {
+			http.Error(w, "bad accept header", http.StatusNotAcceptable)
+			return
+		}
+
+		var query []byte
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			query, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		case http.MethodPost:
+			if r.Header.Get("Content-Type") != dohContentType {
+				http.Error(w, "bad content type", http.StatusUnsupportedMediaType)
+				return
+			}
+			query, err = io.ReadAll(r.Body)
+		}
+		if err != nil || len(query) < 12 {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		if id := binary.BigEndian.Uint16(query[0:2]); id != 0 {
+			http.Error(w, "non-zero message ID", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", dohContentType)
+		w.Write(testReply(t, query, 0, testAnswer(t, "example.com", &cache.ARecord{IPAddress: "192.0.2.1"})))
+	}
+}
+
+func newTestDohUpstream(t *testing.T, handler http.Handler, get bool) *dohUpstream {
+	t.Helper()
+	srv := httptest.NewTLSServer(handler)
+	t.Cleanup(srv.Close)
+
+	u, err := url.Parse(srv.URL + "/dns-query")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &dohUpstream{address: u.String(), url: u, get: get, client: srv.Client()}
+}
+
+func TestDohExchange(t *testing.T) {
+	for _, get := range []bool{true, false} {
+		name := "POST"
+		if get {
+			name = "GET"
+		}
+		t.Run(name, func(t *testing.T) {
+			u := newTestDohUpstream(t, dohStandIn(t), get)
+
+			resp, err := u.exchange(testQuery(t, 0x1234, "example.com", 1), 0, true)
+			if err != nil {
+				t.Fatalf("exchange: %v", err)
+			}
+			msg, err := DecodeDNSQuery(resp)
+			if err != nil {
+				t.Fatalf("decoding response: %v", err)
+			}
+			if msg.Header.ID != 0x1234 {
+				t.Errorf("ID = %#04x, want the query ID restored", msg.Header.ID)
+			}
+			if len(msg.Answer) != 1 || !bytes.Equal(msg.Answer[0].Data, []byte{192, 0, 2, 1}) {
+				t.Errorf("answer = %+v, want a single 192.0.2.1", msg.Answer)
+			}
+		})
+	}
+}
+
+func TestDohExchangeErrors(t *testing.T) {
+	drainLogEvents(t)
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		want    string
+	}{
+		{
+			name: "non-200 status",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "upstream failure", http.StatusInternalServerError)
+			},
+			want: "HTTP 500",
+		},
+		{
+			name: "wrong content type",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/html")
+				w.Write(make([]byte, 64))
+			},
+			want: `"text/html"`,
+		},
+		{
+			name: "oversized body",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", dohContentType)
+				w.Write(make([]byte, 0xFFFF+100))
+			},
+			want: "invalid DoH response length",
+		},
+		{
+			name: "truncated body",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", dohContentType)
+				w.Write(make([]byte, 4))
+			},
+			want: "invalid DoH response length",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := newTestDohUpstream(t, tt.handler, false)
+
+			_, err := u.exchange(testQuery(t, 1, "example.com", 1), 0, true)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("exchange error = %v, want it to mention %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,291 @@
+package dns
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DNS over TLS client (RFC 7858)
+
+const (
+	dotUpstreamTimeout = 2 * time.Second
+	dotDefaultPort     = "853"
+	spkiPinPrefix      = "sha256/"
+)
+
+// dotUpstream keeps a single TLS connection open and pipelines every query over it,
+// replies are matched to queries by their ID as they may come back in any order (RFC 7766 6.2.1.1).
+// The address looks like tls://host:853#name, where the fragment is either the name the server
+// certificate is checked against, or sha256/<base64> pinning the server's public key (RFC 7858 4.2).
+type dotUpstream struct {
+	address   string
+	hostPort  string
+	dialer    *net.Dialer
+	tlsConfig *tls.Config
+	timeout   time.Duration
+
+	mutex   sync.Mutex
+	conn    *dotConn
+	dropped bool // no longer configured, see PruneUpstreams
+}
+
+type dotConn struct {
+	conn       net.Conn
+	writeMutex sync.Mutex
+
+	mutex   sync.Mutex
+	nextID  uint16
+	pending map[uint16]chan []byte
+	err     error         // why the connection was closed
+	closed  chan struct{} // closed along with the connection
+}
+
+func newDotUpstream(address string, bootstrap string, timeout time.Duration) (*dotUpstream, error) {
+	timeout = orDefault(timeout, dotUpstreamTimeout)
+
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "tls" || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid DoT address %q", address)
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = dotDefaultPort
+	}
+
+	dialer, err := newBootstrapDialer(u.Hostname(), bootstrap, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: u.Hostname(),
+		MinVersion: tls.VersionTLS12,
+	}
+	switch {
+	case strings.HasPrefix(u.Fragment, spkiPinPrefix):
+		pin, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(u.Fragment, spkiPinPrefix))
+		if err != nil || len(pin) != sha256.Size {
+			return nil, fmt.Errorf("invalid SPKI pin in %q", address)
+		}
+		// the pin takes the place of the usual chain validation
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifySPKIPin(rawCerts, pin)
+		}
+	case u.Fragment != "":
+		tlsConfig.ServerName = u.Fragment
+	}
+
+	return &dotUpstream{
+		address:   address,
+		hostPort:  net.JoinHostPort(u.Hostname(), port),
+		dialer:    dialer,
+		tlsConfig: tlsConfig,
+		timeout:   timeout,
+	}, nil
+}
+
+// verifySPKIPin accepts the chain only if the leaf certificate carries the pinned public key.
+// The handshake proves the server holds the leaf's private key and nothing else, so a pinned key
+// anywhere further up an unverified chain says nothing about who is on the other end
+func verifySPKIPin(rawCerts [][]byte, pin []byte) error {
+	if len(rawCerts) == 0 {
+		return errors.New("server sent no certificate")
+	}
+	leaf, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	if string(sum[:]) != string(pin) {
+		return errors.New("server public key does not match the SPKI pin")
+	}
+	return nil
+}
+
+func (u *dotUpstream) String() string {
+	return u.address
+}
+
+func (u *dotUpstream) exchange(query []byte, _ int, exactCase bool) ([]byte, error) {
+	resp, err := u.send(query)
+	if errors.Is(err, errConnClosed) {
+		// servers close idle connections whenever they like, so trying again on a fresh one
+		resp, err = u.send(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !matchesQuery(query, resp, exactCase) {
+		discardMismatch(u.address)
+		return nil, errors.New("response does not match the query")
+	}
+	return resp, nil
+}
+
+var errConnClosed = errors.New("connection closed")
+
+func (u *dotUpstream) send(query []byte) ([]byte, error) {
+	c, err := u.connection()
+	if err != nil {
+		return nil, err
+	}
+
+	// the ID on the wire only has to be unique on this connection, the one from the query is put back in the reply
+	id := binary.BigEndian.Uint16(query[0:2])
+	wireID, reply, err := c.register()
+	if err != nil {
+		return nil, err
+	}
+	defer c.unregister(wireID)
+
+	msg := append([]byte(nil), query...)
+	binary.BigEndian.PutUint16(msg[0:2], wireID)
+
+	c.writeMutex.Lock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(u.timeout))
+	err = WriteTCPMessage(c.conn, msg)
+	c.writeMutex.Unlock()
+	if err != nil {
+		c.close(err)
+		return nil, errConnClosed
+	}
+
+	timer := time.NewTimer(u.timeout)
+	defer timer.Stop()
+
+	select {
+	case resp := <-reply:
+		binary.BigEndian.PutUint16(resp[0:2], id)
+		return resp, nil
+	case <-c.closed:
+		return nil, errConnClosed
+	case <-timer.C:
+		// most likely a connection that died silently, the next query gets a new one
+		c.close(errors.New("timeout"))
+		return nil, fmt.Errorf("DoT upstream %s timed out", u.address)
+	}
+}
+
+// connection returns the open connection, dialing a new one if there is none
+func (u *dotUpstream) connection() (*dotConn, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if u.dropped {
+		return nil, errors.New("upstream is no longer configured")
+	}
+	if u.conn != nil {
+		select {
+		case <-u.conn.closed:
+		default:
+			return u.conn, nil
+		}
+	}
+
+	conn, err := tls.DialWithDialer(u.dialer, "tcp", u.hostPort, u.tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	u.conn = &dotConn{
+		conn:    conn,
+		nextID:  newQueryID(),
+		pending: make(map[uint16]chan []byte),
+		closed:  make(chan struct{}),
+	}
+	go u.conn.readLoop()
+
+	return u.conn, nil
+}
+
+// close shuts the open connection, and keeps new ones from being dialed
+func (u *dotUpstream) close() {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	u.dropped = true
+	if u.conn != nil {
+		u.conn.close(errors.New("upstream is no longer configured"))
+		u.conn = nil
+	}
+}
+
+func (c *dotConn) register() (uint16, chan []byte, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.err != nil {
+		return 0, nil, errConnClosed
+	}
+	if len(c.pending) >= 0xFFFF {
+		return 0, nil, errors.New("too many queries in flight")
+	}
+
+	for {
+		c.nextID++
+		if _, taken := c.pending[c.nextID]; !taken {
+			break
+		}
+	}
+	reply := make(chan []byte, 1)
+	c.pending[c.nextID] = reply
+	return c.nextID, reply, nil
+}
+
+func (c *dotConn) unregister(id uint16) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.pending, id)
+}
+
+// readLoop hands every reply to the query waiting for it, until the connection goes away
+func (c *dotConn) readLoop() {
+	for {
+		resp, err := ReadTCPMessage(c.conn)
+		if err != nil {
+			c.close(err)
+			return
+		}
+
+		c.mutex.Lock()
+		reply, found := c.pending[binary.BigEndian.Uint16(resp[0:2])]
+		c.mutex.Unlock()
+
+		if found {
+			select {
+			case reply <- resp:
+			default:
+				// a second reply with the same ID, the first one is already waiting
+			}
+		}
+	}
+}
+
+func (c *dotConn) close(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.closed)
+	_ = c.conn.Close()
+}
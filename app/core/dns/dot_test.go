@@ -0,0 +1,142 @@
+package dns
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"net"
+	"omamori/app/core/internal/cache"
+	"testing"
+	"time"
+)
+
+// selfSignedCert makes a throwaway certificate for 127.0.0.1
+func selfSignedCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "omamori test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func spkiPin(t *testing.T, cert tls.Certificate) string {
+	t.Helper()
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(parsed.RawSubjectPublicKeyInfo)
+	return spkiPinPrefix + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// startDotStandIn serves DoT on a loopback port with the certificate, answering every query with an A record
+func startDotStandIn(t *testing.T, cert tls.Certificate) string {
+	t.Helper()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					query, err := ReadTCPMessage(conn)
+					if err != nil {
+						return
+					}
+					answer := testAnswer(t, "example.com", &cache.ARecord{IPAddress: "192.0.2.1"})
+					if WriteTCPMessage(conn, testReply(t, query, 0, answer)) != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestDotSPKIPin(t *testing.T) {
+	pinned := selfSignedCert(t)
+	impostor := selfSignedCert(t)
+
+	// the impostor holds its own key only, and sends the pinned certificate along behind its own
+	appended := tls.Certificate{
+		Certificate: [][]byte{impostor.Certificate[0], pinned.Certificate[0]},
+		PrivateKey:  impostor.PrivateKey,
+	}
+
+	tests := []struct {
+		name   string
+		served tls.Certificate
+		wantOK bool
+	}{
+		{"pinned leaf", pinned, true},
+		{"other leaf", impostor, false},
+		{"pinned certificate appended to another leaf", appended, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := startDotStandIn(t, tt.served)
+			u, err := newDotUpstream("tls://"+addr+"#"+spkiPin(t, pinned), "", time.Second)
+			if err != nil {
+				t.Fatalf("newDotUpstream: %v", err)
+			}
+
+			_, err = u.exchange(testQuery(t, 7, "example.com", 1), 0, true)
+			if tt.wantOK && err != nil {
+				t.Errorf("exchange with the pinned key failed: %v", err)
+			}
+			if !tt.wantOK && err == nil {
+				t.Error("exchange succeeded without the pinned key on the leaf")
+			}
+		})
+	}
+}
+
+func TestVerifySPKIPinChecksLeafOnly(t *testing.T) {
+	pinned := selfSignedCert(t)
+	other := selfSignedCert(t)
+
+	pin, err := base64.StdEncoding.DecodeString(spkiPin(t, pinned)[len(spkiPinPrefix):])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := verifySPKIPin([][]byte{pinned.Certificate[0], other.Certificate[0]}, pin); err != nil {
+		t.Errorf("pinned leaf rejected: %v", err)
+	}
+	if err := verifySPKIPin([][]byte{other.Certificate[0], pinned.Certificate[0]}, pin); err == nil {
+		t.Error("pin matched a certificate behind the leaf")
+	}
+	if err := verifySPKIPin(nil, pin); err == nil {
+		t.Error("empty chain accepted")
+	}
+}
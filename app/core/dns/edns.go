@@ -0,0 +1,143 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// EDNS(0) support as per RFC 6891
+
+const (
+	TypeOPT = 41
+
+	DefaultUDPSize = 512  // max payload for clients that don't speak EDNS
+	MaxUDPSize     = 1232 // payload size advertised by us, avoids IP fragmentation (DNS flag day 2020)
+
+	EdnsFlagDO = 1 << 15 // DNSSEC OK bit (RFC 3225)
+
+	RCodeBadVers = 16 // extended RCODE, requester's EDNS version not supported
+)
+
+type EDNSOptionCode uint16
+
+const (
+	EDNSOptionNSID          EDNSOptionCode = 3
+	EDNSOptionClientSubnet  EDNSOptionCode = 8
+	EDNSOptionCookie        EDNSOptionCode = 10
+	EDNSOptionTCPKeepalive  EDNSOptionCode = 11
+	EDNSOptionPadding       EDNSOptionCode = 12
+	EDNSOptionExtendedError EDNSOptionCode = 15
+)
+
+type EDNSOption struct {
+	Code EDNSOptionCode
+	Data []byte
+}
+
+// OPT is the pseudo-record carried in the additional section
+/*
+
+	NAME: root (0), TYPE: 41, CLASS: requester's UDP payload size,
+	TTL:  | EXTENDED-RCODE (8 bits) | VERSION (8 bits) | DO | Z (15 bits) |
+	RDATA: list of {OPTION-CODE, OPTION-LENGTH, OPTION-DATA}
+
+*/
+type OPT struct {
+	UDPSize  uint16
+	ExtRCODE uint8 // upper 8 bits of the 12 bit RCODE
+	Version  uint8
+	Flags    uint16
+	Options  []*EDNSOption
+}
+
+func (o *OPT) DO() bool {
+	return o.Flags&EdnsFlagDO != 0
+}
+
+func (o *OPT) encode() ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	rdata := new(bytes.Buffer)
+	for _, option := range o.Options {
+		if len(option.Data) > 0xFFFF {
+			return nil, errors.New("EDNS option too long")
+		}
+		_ = binary.Write(rdata, binary.BigEndian, uint16(option.Code))
+		_ = binary.Write(rdata, binary.BigEndian, uint16(len(option.Data)))
+		rdata.Write(option.Data)
+	}
+
+	buf.WriteByte(0) // root domain
+	_ = binary.Write(buf, binary.BigEndian, uint16(TypeOPT))
+	_ = binary.Write(buf, binary.BigEndian, o.UDPSize)
+	_ = binary.Write(buf, binary.BigEndian, uint32(o.ExtRCODE)<<24|uint32(o.Version)<<16|uint32(o.Flags))
+	_ = binary.Write(buf, binary.BigEndian, uint16(rdata.Len()))
+	buf.Write(rdata.Bytes())
+
+	return buf.Bytes(), nil
+}
+
+func decodeOPT(udpSize uint16, ttl uint32, rdata []byte) (*OPT, error) {
+	opt := &OPT{
+		UDPSize:  udpSize,
+		ExtRCODE: uint8(ttl >> 24),
+		Version:  uint8(ttl >> 16),
+		Flags:    uint16(ttl),
+	}
+
+	for offset := 0; offset < len(rdata); {
+		if offset+4 > len(rdata) {
+			return nil, errors.New("malformed EDNS option")
+		}
+		code := binary.BigEndian.Uint16(rdata[offset : offset+2])
+		length := int(binary.BigEndian.Uint16(rdata[offset+2 : offset+4]))
+		offset += 4
+
+		if offset+length > len(rdata) {
+			return nil, errors.New("malformed EDNS option")
+		}
+		opt.Options = append(opt.Options, &EDNSOption{
+			Code: EDNSOptionCode(code),
+			Data: append([]byte(nil), rdata[offset:offset+length]...),
+		})
+		offset += length
+	}
+
+	return opt, nil
+}
+
+// UDPSize returns the largest response the requester can take over UDP
+func (dq *Query) UDPSize() int {
+	if dq.Edns == nil {
+		return DefaultUDPSize
+	}
+	size := int(dq.Edns.UDPSize)
+	if size < DefaultUDPSize {
+		// values lower than 512 must be treated as 512
+		return DefaultUDPSize
+	}
+	if size > MaxUDPSize {
+		return MaxUDPSize
+	}
+	return size
+}
+
+// RCode returns the full 12 bit response code, including the extended bits from OPT
+func (dq *Query) RCode() uint16 {
+	rcode := dq.Header.FLAGS & 0x000F
+	if dq.Edns != nil {
+		rcode |= uint16(dq.Edns.ExtRCODE) << 4
+	}
+	return rcode
+}
+
+func (dq *Query) setRCode(rcode uint16) {
+	dq.Header.FLAGS = (dq.Header.FLAGS & 0xFFF0) | rcode&0x000F
+	if dq.Edns != nil {
+		dq.Edns.ExtRCODE = uint8(rcode >> 4)
+	} else if rcode > 0x000F {
+		// extended codes can't be expressed without EDNS
+		dq.Header.FLAGS = (dq.Header.FLAGS & 0xFFF0) | 2
+	}
+}
@@ -0,0 +1,113 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// testEdnsQuery is an A query for example.com with an OPT record of the given class and TTL fields
+func testEdnsQuery(udpSize uint16, ttl uint32, rdata []byte) []byte {
+	msg := []byte{0xab, 0xcd, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 1}
+	msg = append(msg, "\x07example\x03com\x00\x00\x01\x00\x01"...)
+	msg = append(msg, 0, 0, TypeOPT)
+	msg = binary.BigEndian.AppendUint16(msg, udpSize)
+	msg = binary.BigEndian.AppendUint32(msg, ttl)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(rdata)))
+	return append(msg, rdata...)
+}
+
+func TestDecodeOPT(t *testing.T) {
+	cookie := []byte{0, byte(EDNSOptionCookie), 0, 8, 1, 2, 3, 4, 5, 6, 7, 8}
+	query, err := DecodeDNSQuery(testEdnsQuery(4096, 1<<24|EdnsFlagDO, cookie))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opt := query.Edns
+	if opt == nil {
+		t.Fatal("OPT record not decoded")
+	}
+	if opt.UDPSize != 4096 || opt.ExtRCODE != 1 || opt.Version != 0 || !opt.DO() {
+		t.Errorf("decoded %+v", opt)
+	}
+	if len(opt.Options) != 1 || opt.Options[0].Code != EDNSOptionCookie || !bytes.Equal(opt.Options[0].Data, cookie[4:]) {
+		t.Errorf("options %+v", opt.Options)
+	}
+
+	// the size advertised is kept between 512 and what we can take ourselves
+	for advertised, want := range map[uint16]int{0: DefaultUDPSize, 1000: 1000, 4096: MaxUDPSize} {
+		query, _ := DecodeDNSQuery(testEdnsQuery(advertised, 0, nil))
+		if got := query.UDPSize(); got != want {
+			t.Errorf("UDPSize with %d advertised = %d, want %d", advertised, got, want)
+		}
+	}
+}
+
+func TestDecodeOPTMalformed(t *testing.T) {
+	tests := map[string][]byte{
+		"option header cut short": {0, 10, 0},
+		"option data cut short":   {0, 10, 0, 8, 1, 2},
+	}
+	for name, rdata := range tests {
+		if _, err := DecodeDNSQuery(testEdnsQuery(1232, 0, rdata)); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+
+	twice := testEdnsQuery(1232, 0, nil)
+	twice[11] = 2
+	twice = append(twice, twice[len(testEdnsQuery(0, 0, nil))-11:]...)
+	if _, err := DecodeDNSQuery(twice); err == nil {
+		t.Error("two OPT records: no error")
+	}
+}
+
+func TestOPTEncodeRoundTrip(t *testing.T) {
+	opt := &OPT{UDPSize: 1232, ExtRCODE: 1, Flags: EdnsFlagDO, Options: []*EDNSOption{{Code: EDNSOptionPadding, Data: make([]byte, 4)}}}
+	data, err := opt.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[0] != 0 || binary.BigEndian.Uint16(data[1:3]) != TypeOPT {
+		t.Fatalf("OPT not owned by the root: % x", data[:3])
+	}
+
+	decoded, err := decodeOPT(binary.BigEndian.Uint16(data[3:5]), binary.BigEndian.Uint32(data[5:9]), data[11:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.UDPSize != opt.UDPSize || decoded.ExtRCODE != 1 || !decoded.DO() || len(decoded.Options) != 1 ||
+		decoded.Options[0].Code != EDNSOptionPadding || len(decoded.Options[0].Data) != 4 {
+		t.Errorf("decoded %+v", decoded)
+	}
+}
+
+func TestLookupBadVersion(t *testing.T) {
+	query, err := DecodeDNSQuery(testEdnsQuery(1232, 1<<16|EdnsFlagDO, nil)) // EDNS version 1
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := DecodeDNSQuery(Lookup(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.RCode() != RCodeBadVers {
+		t.Errorf("RCODE %d, want BADVERS", resp.RCode())
+	}
+	// the upper bits are in the OPT record, the header only has the lower 4 (RFC 6891 6.1.3)
+	if resp.Header.FLAGS&0x000F != 0 || resp.Edns == nil || resp.Edns.ExtRCODE != 1 {
+		t.Errorf("header RCODE %d, OPT %+v", resp.Header.FLAGS&0x000F, resp.Edns)
+	}
+	if resp.Edns.Version != 0 || !resp.Edns.DO() {
+		t.Errorf("responded with version %d and DO %v, want version 0 and DO copied", resp.Edns.Version, resp.Edns.DO())
+	}
+}
+
+func TestSetRCodeWithoutEDNS(t *testing.T) {
+	query := &Query{Header: &Header{FLAGS: 1 << 15}}
+	query.setRCode(RCodeBadVers)
+	if query.RCode() != 2 {
+		t.Errorf("RCODE %d without OPT, want SERVFAIL", query.RCode())
+	}
+}
@@ -0,0 +1,191 @@
+package dns
+
+import (
+	"context"
+	"log"
+	"omamori/app/core/channels"
+	"omamori/app/core/config"
+	"sync"
+	"time"
+)
+
+// Health checking and circuit breaking: after enough consecutive failures an upstream is marked down
+// and skipped, until a background probe gets an answer from it again. Probes of a down upstream
+// back off exponentially, so a dead upstream costs next to nothing.
+
+const (
+	successRateWeight = 0.1 // weight of the latest query in the success rate
+	minProbeBackoff   = 5 * time.Second
+	maxProbeBackoff   = 5 * time.Minute
+	healthTick        = 1 * time.Second
+)
+
+type upstreamHealth struct {
+	successRate         float64
+	consecutiveFailures int
+	down                bool
+	backoff             time.Duration
+	nextProbe           time.Time // for a down upstream, the next retry, otherwise the next routine check
+	probing             bool
+}
+
+var (
+	health      = make(map[string]*upstreamHealth)
+	healthMutex sync.Mutex
+)
+
+// healthOf returns the health of the upstream, healthMutex must be held
+func healthOf(u upstream) *upstreamHealth {
+	h, found := health[u.String()]
+	if !found {
+		h = &upstreamHealth{successRate: 1}
+		health[u.String()] = h
+	}
+	return h
+}
+
+// recordResult updates the latency and health of the upstream after a query
+func recordResult(u upstream, rtt time.Duration, ok bool) {
+	recordLatency(u, rtt, ok)
+
+	healthMutex.Lock()
+	h := healthOf(u)
+
+	sample := 0.0
+	if ok {
+		sample = 1
+	}
+	h.successRate = successRateWeight*sample + (1-successRateWeight)*h.successRate
+
+	wasDown := h.down
+	if ok {
+		h.consecutiveFailures = 0
+		h.down = false
+		h.backoff = 0
+	} else {
+		h.consecutiveFailures++
+		if !h.down && h.consecutiveFailures >= config.Global.HealthFailureThreshold {
+			h.down = true
+			h.backoff = minProbeBackoff
+			h.nextProbe = time.Now().Add(h.backoff)
+		}
+	}
+	changed := wasDown != h.down
+	healthMutex.Unlock()
+
+	if changed {
+		if ok {
+			log.Printf("Upstream %s is back up\n", u)
+		} else {
+			log.Printf("Upstream %s is down, skipping it until it answers a probe\n", u)
+		}
+		reportHealth(u)
+	}
+}
+
+// availableUpstreams leaves out the upstreams that are down, unless all of them are
+func availableUpstreams(upstreams []upstream) []upstream {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+
+	var available []upstream
+	for _, u := range upstreams {
+		if !healthOf(u).down {
+			available = append(available, u)
+		}
+	}
+	if len(available) == 0 {
+		// nothing to lose by trying
+		return upstreams
+	}
+	return available
+}
+
+func reportHealth(u upstream) {
+	healthMutex.Lock()
+	h := healthOf(u)
+	status := channels.UpstreamHealth{
+		Upstream:    u.String(),
+		Up:          !h.down,
+		SuccessRate: h.successRate,
+	}
+	if h.down {
+		status.NextProbe = h.nextProbe
+	}
+	healthMutex.Unlock()
+
+	latencyMutex.Lock()
+	status.Latency = upstreamLatency[u.String()]
+	latencyMutex.Unlock()
+
+	channels.LogEventChannel <- channels.Event{
+		Type:    channels.UpstreamStatus,
+		Payload: status,
+	}
+}
+
+// StartHealthChecker probes the upstreams in the background until the context is cancelled,
+// the healthy ones every health check interval and the ones that are down as their backoff runs out
+func StartHealthChecker(ctx context.Context) {
+	ticker := time.NewTicker(healthTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			checkUpstreams()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func checkUpstreams() {
+	now := time.Now()
+	interval := time.Duration(config.Global.HealthCheckInterval) * time.Second
+
+	// the upstreams of forwarding rules are checked along with the default ones
+	probed := make(map[upstream]bool)
+	for _, cfg := range configuredUpstreams() {
+		u, err := upstreamFor(cfg, config.Global.Bootstrap)
+		if err != nil || probed[u] {
+			continue
+		}
+		probed[u] = true
+
+		healthMutex.Lock()
+		h := healthOf(u)
+		due := !h.probing && now.After(h.nextProbe) && (h.down || interval > 0)
+		if due {
+			h.probing = true
+		}
+		healthMutex.Unlock()
+
+		if due {
+			go probe(u, interval)
+		}
+	}
+}
+
+// probe asks the upstream for the root NS records, any answer counts as it being up
+func probe(u upstream, interval time.Duration) {
+	question := &Question{Name: "", Type: uint16(2), Class: 1} // . NS
+	_, err := queryUpstream(u, question, 1<<8, &OPT{UDPSize: MaxUDPSize})
+
+	healthMutex.Lock()
+	h := healthOf(u)
+	h.probing = false
+	if h.down {
+		// still down, waiting twice as long before trying again
+		h.backoff = min(2*h.backoff, maxProbeBackoff)
+		h.nextProbe = time.Now().Add(h.backoff)
+	} else {
+		h.nextProbe = time.Now().Add(interval)
+	}
+	healthMutex.Unlock()
+
+	if err != nil {
+		log.Printf("Health check of %s failed: %s\n", u, err)
+	}
+	reportHealth(u)
+}
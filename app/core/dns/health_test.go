@@ -0,0 +1,135 @@
+package dns
+
+import (
+	"errors"
+	"omamori/app/core/config"
+	"testing"
+	"time"
+)
+
+// failingUpstream fails every exchange right away
+type failingUpstream string
+
+func (u failingUpstream) String() string {
+	return string(u)
+}
+
+func (u failingUpstream) exchange([]byte, int, bool) ([]byte, error) {
+	return nil, errors.New("unreachable")
+}
+
+func healthSnapshot(u upstream) upstreamHealth {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	return *healthOf(u)
+}
+
+func forgetHealth(t *testing.T, upstreams ...upstream) {
+	t.Cleanup(func() {
+		healthMutex.Lock()
+		defer healthMutex.Unlock()
+		for _, u := range upstreams {
+			delete(health, u.String())
+		}
+	})
+}
+
+func TestHealthFailureThreshold(t *testing.T) {
+	drainLogEvents(t)
+	saved := config.Global.HealthFailureThreshold
+	config.Global.HealthFailureThreshold = 3
+	t.Cleanup(func() { config.Global.HealthFailureThreshold = saved })
+
+	u := failingUpstream("threshold.test")
+	forgetHealth(t, u)
+
+	for i := 1; i < 3; i++ {
+		recordResult(u, time.Millisecond, false)
+		if h := healthSnapshot(u); h.down || h.consecutiveFailures != i {
+			t.Fatalf("after %d failures: down %v with %d failures counted", i, h.down, h.consecutiveFailures)
+		}
+	}
+
+	// a success in between starts the count over
+	recordResult(u, time.Millisecond, true)
+	for i := 0; i < 2; i++ {
+		recordResult(u, time.Millisecond, false)
+	}
+	if healthSnapshot(u).down {
+		t.Fatal("down without the failures being consecutive")
+	}
+
+	recordResult(u, time.Millisecond, false)
+	h := healthSnapshot(u)
+	if !h.down || h.backoff != minProbeBackoff {
+		t.Fatalf("after reaching the threshold: down %v with a backoff of %s", h.down, h.backoff)
+	}
+	if wait := time.Until(h.nextProbe); wait <= 0 || wait > minProbeBackoff {
+		t.Errorf("first probe in %s, want within %s", wait, minProbeBackoff)
+	}
+
+	recordResult(u, time.Millisecond, true)
+	if h := healthSnapshot(u); h.down || h.backoff != 0 || h.consecutiveFailures != 0 {
+		t.Errorf("after a success: down %v, backoff %s, %d failures", h.down, h.backoff, h.consecutiveFailures)
+	}
+}
+
+func TestProbeBackoff(t *testing.T) {
+	drainLogEvents(t)
+
+	tests := []struct {
+		name    string
+		backoff time.Duration
+		want    time.Duration
+	}{
+		{"doubled", minProbeBackoff, 2 * minProbeBackoff},
+		{"doubled again", 2 * minProbeBackoff, 4 * minProbeBackoff},
+		{"capped", maxProbeBackoff - time.Second, maxProbeBackoff},
+		{"stays at the cap", maxProbeBackoff, maxProbeBackoff},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := failingUpstream("backoff.test")
+			forgetHealth(t, u)
+
+			healthMutex.Lock()
+			h := healthOf(u)
+			h.down, h.backoff, h.probing = true, tt.backoff, true
+			healthMutex.Unlock()
+
+			probe(u, time.Minute)
+
+			got := healthSnapshot(u)
+			if got.probing {
+				t.Error("still marked as probing")
+			}
+			if got.backoff != tt.want {
+				t.Errorf("backoff %s, want %s", got.backoff, tt.want)
+			}
+			if wait := time.Until(got.nextProbe); wait <= tt.want-time.Second || wait > tt.want {
+				t.Errorf("next probe in %s, want %s", wait, tt.want)
+			}
+		})
+	}
+}
+
+func TestAvailableUpstreams(t *testing.T) {
+	up, down := failingUpstream("up.test"), failingUpstream("down.test")
+	other := failingUpstream("other-down.test")
+	forgetHealth(t, up, down, other)
+
+	healthMutex.Lock()
+	healthOf(down).down = true
+	healthOf(other).down = true
+	healthMutex.Unlock()
+
+	if got := availableUpstreams([]upstream{down, up, other}); len(got) != 1 || got[0] != up {
+		t.Errorf("available %v, want only %s", got, up)
+	}
+
+	// with all of them down, every one is tried anyway
+	all := []upstream{down, other}
+	if got := availableUpstreams(all); len(got) != len(all) || got[0] != down || got[1] != other {
+		t.Errorf("available %v with all down, want %v", got, all)
+	}
+}
@@ -0,0 +1,97 @@
+package dns
+
+import (
+	"omamori/app/core/channels"
+	"omamori/app/core/config"
+	"omamori/app/core/internal/cache"
+	"omamori/app/core/internal/radix"
+	"testing"
+)
+
+// testQuery encodes a recursive query for the name and type
+func testQuery(t *testing.T, id uint16, name string, qtype uint16) []byte {
+	t.Helper()
+	msg, err := (&Query{
+		Header:    &Header{ID: id, FLAGS: 1 << 8},
+		Questions: []*Question{{Name: name, Type: qtype, Class: 1}},
+	}).Encode()
+	if err != nil {
+		t.Fatalf("encoding query for %s: %v", name, err)
+	}
+	return msg
+}
+
+// testAnswer builds a record of the typed data, with a TTL of an hour
+func testAnswer(t *testing.T, name string, rdata cache.RData) *Answer {
+	t.Helper()
+	data, err := rdata.Marshal()
+	if err != nil {
+		t.Fatalf("marshalling %s record for %s: %v", rdata.Type(), name, err)
+	}
+	return &Answer{Name: name, Type: uint16(rdata.Type()), Class: 1, TTL: 3600, Data: data, Length: uint16(len(data))}
+}
+
+// testReply answers the query with the records, echoing its ID and question
+func testReply(t *testing.T, query []byte, rcode uint16, answers ...*Answer) []byte {
+	t.Helper()
+	q, err := DecodeDNSQuery(query)
+	if err != nil {
+		t.Fatalf("decoding query: %v", err)
+	}
+	q.Header.FLAGS |= 1<<15 | 1<<7 | rcode
+	q.Answer = answers
+	q.Edns = nil
+	msg, err := q.Encode()
+	if err != nil {
+		t.Fatalf("encoding reply: %v", err)
+	}
+	return msg
+}
+
+// drainLogEvents keeps the UI log channel from filling up while the test runs
+func drainLogEvents(t *testing.T) {
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	go func() {
+		for {
+			select {
+			case <-channels.LogEventChannel:
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// setupLookup gives Lookup an empty block list, putting the config back once the test is done.
+// The cache stays, as answers are cached in the background, tests stick to names of their own
+func setupLookup(t *testing.T) {
+	t.Helper()
+	savedConfig, savedSites := *config.Global, config.BlockedSites
+	t.Cleanup(func() {
+		*config.Global, config.BlockedSites = savedConfig, savedSites
+	})
+
+	config.BlockedSites = radix.NewRadixTree()
+	config.Global.DNSSEC = false
+	config.Global.Use0x20 = false
+	drainLogEvents(t)
+}
+
+// lookup runs the query through Lookup and decodes the response
+func lookup(t *testing.T, name string, qtype uint16) *Query {
+	t.Helper()
+	query, err := DecodeDNSQuery(testQuery(t, 1, name, qtype))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := Lookup(query)
+	if resp == nil {
+		t.Fatalf("no response for %s", name)
+	}
+	msg, err := DecodeDNSQuery(resp)
+	if err != nil {
+		t.Fatalf("decoding response for %s: %v", name, err)
+	}
+	return msg
+}
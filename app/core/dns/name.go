@@ -0,0 +1,252 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"omamori/app/core/internal/cache"
+	"strings"
+)
+
+const (
+	maxNameLength    = 255 // in wire format, including the length bytes (RFC 1035 2.3.4)
+	maxLabelLength   = 63
+	maxPointerOffset = 0x3FFF // pointers only have 14 bits for the offset
+)
+
+// decodeDomainName reads the possibly compressed name at offset and returns it in dotted form,
+// with dots inside labels escaped, along with the offset right after the name (RFC 1035 4.1.4)
+func decodeDomainName(data []byte, offset int) (string, int, error) {
+	var labels []string
+	nameLength := 1 // terminating zero byte
+
+	next := -1 // offset after the name, known once the first pointer is followed
+	lowest := offset
+
+	for {
+		if offset >= len(data) {
+			return "", 0, errors.New("truncated domain name")
+		}
+		length := int(data[offset])
+
+		switch {
+		case length == 0:
+			if next == -1 {
+				next = offset + 1
+			}
+			return strings.Join(labels, "."), next, nil
+
+		case length&0xC0 == 0xC0:
+			if offset+2 > len(data) {
+				return "", 0, errors.New("truncated compression pointer")
+			}
+			pointer := int(binary.BigEndian.Uint16(data[offset:offset+2]) & maxPointerOffset)
+			// pointers must go strictly backwards, which also rules out loops
+			if pointer >= lowest {
+				return "", 0, errors.New("invalid compression pointer")
+			}
+			if next == -1 {
+				next = offset + 2
+			}
+			lowest = pointer
+			offset = pointer
+
+		case length&0xC0 != 0:
+			// 0x40 and 0x80 label types are reserved or obsolete
+			return "", 0, errors.New("unsupported label type")
+
+		default:
+			offset++
+			if offset+length > len(data) {
+				return "", 0, errors.New("truncated domain name")
+			}
+			nameLength += length + 1
+			if nameLength > maxNameLength {
+				return "", 0, errors.New("domain name too long")
+			}
+			labels = append(labels, cache.EscapeLabel(data[offset:offset+length]))
+			offset += length
+		}
+	}
+}
+
+// splitDomainName splits the name into labels, dots escaped as \. stay part of their label
+func splitDomainName(name string) []string {
+	return cache.SplitName(name)
+}
+
+// messageWriter builds a DNS message, remembering where each name was written
+// so later occurrences can be replaced with a compression pointer
+type messageWriter struct {
+	buf   bytes.Buffer
+	names map[string]int // name suffix -> offset in the message
+}
+
+func newMessageWriter() *messageWriter {
+	return &messageWriter{names: make(map[string]int)}
+}
+
+func (w *messageWriter) writeUint16(v uint16) {
+	_ = binary.Write(&w.buf, binary.BigEndian, v)
+}
+
+func (w *messageWriter) writeUint32(v uint32) {
+	_ = binary.Write(&w.buf, binary.BigEndian, v)
+}
+
+// ValidateName checks the dotted name can be written to a message, labels of 1 to 63
+// bytes adding up to at most 255 in wire format
+func ValidateName(name string) error {
+	length := 1
+	for _, label := range splitDomainName(name) {
+		label = cache.UnescapeLabel(label)
+		if len(label) == 0 {
+			return errors.New("empty label")
+		}
+		if len(label) > maxLabelLength {
+			return errors.New("label too long")
+		}
+		length += len(label) + 1
+	}
+	if length > maxNameLength {
+		return errors.New("domain name too long")
+	}
+	return nil
+}
+
+// writeName writes the name, compressing its longest suffix already present in the message if allowed
+func (w *messageWriter) writeName(name string, compress bool) error {
+	if err := ValidateName(name); err != nil {
+		return err
+	}
+	labels := splitDomainName(name)
+
+	for i := range labels {
+		// compression is case-sensitive on purpose, keeping the exact bytes that were sent
+		suffix := strings.Join(labels[i:], ".")
+		if compress {
+			if pointer, found := w.names[suffix]; found {
+				w.writeUint16(0xC000 | uint16(pointer))
+				return nil
+			}
+		}
+		if w.buf.Len() <= maxPointerOffset {
+			if _, found := w.names[suffix]; !found {
+				w.names[suffix] = w.buf.Len()
+			}
+		}
+		label := cache.UnescapeLabel(labels[i])
+		w.buf.WriteByte(uint8(len(label)))
+		w.buf.WriteString(label)
+	}
+	w.buf.WriteByte(0)
+	return nil
+}
+
+// Layout of the RDATA for types embedding domain names, -1 stands for a name and
+// any other value for that many bytes of fixed data. Whatever follows is copied as is.
+var rdataLayouts = map[uint16][]int{
+	2:  {-1},        // NS
+	3:  {-1},        // MD
+	4:  {-1},        // MF
+	5:  {-1},        // CNAME
+	6:  {-1, -1},    // SOA, followed by the five 32 bit counters
+	7:  {-1},        // MB
+	8:  {-1},        // MG
+	9:  {-1},        // MR
+	12: {-1},        // PTR
+	14: {-1, -1},    // MINFO
+	15: {2, -1},     // MX
+	17: {-1, -1},    // RP
+	18: {2, -1},     // AFSDB
+	21: {2, -1},     // RT
+	26: {2, -1, -1}, // PX
+	33: {6, -1},     // SRV
+	36: {2, -1},     // KX
+	39: {-1},        // DNAME
+}
+
+// Only names in the RDATA of the well known types from RFC 1035 may be compressed (RFC 3597 4)
+var compressibleTypes = map[uint16]bool{
+	2: true, 3: true, 4: true, 5: true, 6: true, 7: true, 8: true, 9: true, 12: true, 14: true, 15: true,
+}
+
+// decodeRData copies the RDATA starting at offset, expanding any compressed names it embeds,
+// so the record no longer depends on the message it came from
+func decodeRData(data []byte, offset int, length int, recordType uint16) ([]byte, error) {
+	end := offset + length
+	layout, found := rdataLayouts[recordType]
+	if !found {
+		return append([]byte(nil), data[offset:end]...), nil
+	}
+
+	w := newMessageWriter()
+	for _, field := range layout {
+		if field == -1 {
+			name, next, err := decodeDomainName(data[:end], offset)
+			if err != nil {
+				return nil, err
+			}
+			if err = w.writeName(name, false); err != nil {
+				return nil, err
+			}
+			offset = next
+			continue
+		}
+		if offset+field > end {
+			return nil, errors.New("truncated record data")
+		}
+		w.buf.Write(data[offset : offset+field])
+		offset += field
+	}
+	w.buf.Write(data[offset:end])
+
+	return w.buf.Bytes(), nil
+}
+
+// writeRData writes the RDATA with its embedded names compressed where that is allowed
+func (w *messageWriter) writeRData(recordType uint16, rdata []byte) error {
+	layout, found := rdataLayouts[recordType]
+	if !found || !compressibleTypes[recordType] {
+		w.buf.Write(rdata)
+		return nil
+	}
+
+	// names in stored RDATA are never compressed, so they can be read on their own
+	var names []string
+	var fixed [][]byte
+	offset := 0
+	for _, field := range layout {
+		if field == -1 {
+			name, next, err := decodeDomainName(rdata, offset)
+			if err != nil {
+				// not what we expected, sending it the way it is
+				w.buf.Write(rdata)
+				return nil
+			}
+			names = append(names, name)
+			offset = next
+			continue
+		}
+		if offset+field > len(rdata) {
+			w.buf.Write(rdata)
+			return nil
+		}
+		fixed = append(fixed, rdata[offset:offset+field])
+		offset += field
+	}
+
+	for _, field := range layout {
+		if field == -1 {
+			if err := w.writeName(names[0], true); err != nil {
+				return err
+			}
+			names = names[1:]
+			continue
+		}
+		w.buf.Write(fixed[0])
+		fixed = fixed[1:]
+	}
+	w.buf.Write(rdata[offset:])
+	return nil
+}
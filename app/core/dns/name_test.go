@@ -0,0 +1,86 @@
+package dns
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNameEscapedDotsRoundTrip(t *testing.T) {
+	tests := []struct {
+		wire   []byte
+		dotted string
+		labels []string
+	}{
+		{[]byte("\x03www\x07example\x03com\x00"), "www.example.com", []string{"www", "example", "com"}},
+		{[]byte("\x03a.b\x07example\x00"), `a\.b.example`, []string{`a\.b`, "example"}},
+		{[]byte("\x03a\\b\x07example\x00"), `a\\b.example`, []string{`a\\b`, "example"}},
+		{[]byte("\x02a.\x00"), `a\.`, []string{`a\.`}},
+		{[]byte("\x00"), "", nil},
+	}
+
+	for _, tt := range tests {
+		name, next, err := decodeDomainName(tt.wire, 0)
+		if err != nil {
+			t.Fatalf("decoding %q: %v", tt.wire, err)
+		}
+		if name != tt.dotted || next != len(tt.wire) {
+			t.Errorf("decoding %q = %q, %d, want %q, %d", tt.wire, name, next, tt.dotted, len(tt.wire))
+		}
+		if labels := splitDomainName(name); !reflect.DeepEqual(labels, tt.labels) {
+			t.Errorf("splitDomainName(%q) = %q, want %q", name, labels, tt.labels)
+		}
+
+		w := newMessageWriter()
+		if err := w.writeName(name, false); err != nil {
+			t.Fatalf("encoding %q: %v", name, err)
+		}
+		if !bytes.Equal(w.buf.Bytes(), tt.wire) {
+			t.Errorf("encoding %q = %q, want %q", name, w.buf.Bytes(), tt.wire)
+		}
+	}
+}
+
+func TestIsSubdomainEscapedDot(t *testing.T) {
+	tests := []struct {
+		name, zone string
+		want       bool
+	}{
+		{"www.example.com", "example.com", true},
+		{"example.com", "example.com", true},
+		{`www\.example.com`, "example.com", false},
+		{`www\.example.com`, "com", true},
+		{"www.example.com", "", true},
+		{"badexample.com", "example.com", false},
+	}
+	for _, tt := range tests {
+		if got := isSubdomain(tt.name, tt.zone); got != tt.want {
+			t.Errorf("isSubdomain(%q, %q) = %v, want %v", tt.name, tt.zone, got, tt.want)
+		}
+	}
+}
+
+func TestValidateName(t *testing.T) {
+	label63, label64 := strings.Repeat("a", 63), strings.Repeat("a", 64)
+	long := strings.Repeat(label63+".", 4) // 256 bytes in wire format
+
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"www.example.com", true},
+		{label63 + ".example", true},
+		{`a\.b.example`, true},
+		{"", true},
+		{label64 + ".example", false},
+		{"www..example", false},
+		{long[:len(long)-1], false},
+		{long[:len(long)-3], true},
+	}
+	for _, tt := range tests {
+		if err := ValidateName(tt.name); (err == nil) != tt.valid {
+			t.Errorf("ValidateName(%q) = %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+}
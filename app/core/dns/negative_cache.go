@@ -0,0 +1,83 @@
+package dns
+
+import (
+	"omamori/app/core/internal/cache"
+	"time"
+)
+
+// Negative caching of NXDOMAIN and NODATA answers (RFC 2308)
+
+const maxNegativeTTL = 3 * 60 * 60 // RFC 2308 5, values of one to three hours are sensible
+
+// negativeTTL derives the TTL from the SOA in the authority section, which is the
+// minimum of its own TTL and its MINIMUM field. Without a SOA the answer can't be cached
+func negativeTTL(authority []*Answer) (*Answer, uint32, bool) {
+	for _, record := range authority {
+		if cache.RecordType(record.Type) != cache.RecordTypeSOA {
+			continue
+		}
+		rdata, err := record.RData()
+		if err != nil {
+			return nil, 0, false
+		}
+		soa := rdata.(*cache.SOARecord)
+
+		ttl := min(record.TTL, soa.Minimum, maxNegativeTTL)
+		return record, ttl, true
+	}
+	return nil, 0, false
+}
+
+// cacheNegativeAnswer stores NXDOMAIN and NODATA responses, keyed by name and type
+func cacheNegativeAnswer(question *Question, resp *Query) {
+	rcode := resp.RCode()
+	if len(resp.Answer) > 0 || (rcode != 0 && rcode != 3) {
+		// NXDOMAIN after a CNAME applies to the target rather than the name asked for, not caching those
+		return
+	}
+
+	soa, ttl, ok := negativeTTL(resp.Authority)
+	if !ok || ttl == 0 {
+		return
+	}
+
+	recordType := cache.RecordType(question.Type)
+	if rcode == 3 {
+		// name doesn't exist, whatever the type
+		recordType = cache.RecordTypeNXDomain
+	}
+
+	// SOA is kept with the negative TTL, so it counts down like any other cached record
+	soaRR := toCacheRR(soa)
+	soaRR.TTL = ttl
+
+	now := time.Now()
+	cache.DnsCache.Set(question.Name, &cache.Record{
+		Type:      recordType,
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Duration(ttl) * time.Second),
+		Negative:  true,
+		RCode:     rcode,
+		Authority: []cache.RR{soaRR},
+	})
+}
+
+// cachedNegativeAnswer fills in the response from a cached negative answer, if there is one
+func cachedNegativeAnswer(dnsQuery *Query, question *Question) bool {
+	record, found := cache.DnsCache.Get(question.Name, uint16(cache.RecordTypeNXDomain))
+	if !found {
+		record, found = cache.DnsCache.Get(question.Name, question.Type)
+		if !found || !record.Negative {
+			return false
+		}
+	}
+
+	dnsQuery.setRCode(record.RCode)
+	dnsQuery.Answer = nil
+	dnsQuery.Authority = nil
+	for _, rr := range record.Authority {
+		// SOA TTL counts down along with the cached entry (RFC 2308 5)
+		dnsQuery.Authority = append(dnsQuery.Authority, fromCacheRR(rr, record.RemainingTTL(rr.TTL)))
+	}
+	return true
+}
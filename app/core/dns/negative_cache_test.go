@@ -0,0 +1,110 @@
+package dns
+
+import (
+	"omamori/app/core/internal/cache"
+	"testing"
+)
+
+func soaAnswer(t *testing.T, zone string, ttl uint32, minimum uint32) *Answer {
+	t.Helper()
+	soa, err := newAnswer(&Question{Name: zone, Type: uint16(cache.RecordTypeSOA), Class: 1}, ttl,
+		&cache.SOARecord{MName: "ns." + zone, RName: "hostmaster." + zone, Minimum: minimum})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return soa
+}
+
+func TestNegativeTTL(t *testing.T) {
+	ns, err := newAnswer(&Question{Name: "example.com", Type: uint16(cache.RecordTypeNS), Class: 1}, 60,
+		&cache.NSRecord{NameServer: "ns.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		authority []*Answer
+		want      uint32
+		ok        bool
+	}{
+		{"MINIMUM below the SOA TTL", []*Answer{soaAnswer(t, "example.com", 3600, 300)}, 300, true},
+		{"SOA TTL below MINIMUM", []*Answer{soaAnswer(t, "example.com", 120, 900)}, 120, true},
+		{"capped at three hours", []*Answer{soaAnswer(t, "example.com", 86400, 86400)}, maxNegativeTTL, true},
+		{"SOA after other records", []*Answer{ns, soaAnswer(t, "example.com", 600, 600)}, 600, true},
+		{"no SOA", []*Answer{ns}, 0, false},
+		{"empty authority", nil, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			soa, ttl, ok := negativeTTL(tt.authority)
+			if ok != tt.ok || ttl != tt.want {
+				t.Errorf("negativeTTL = %d, %v, want %d, %v", ttl, ok, tt.want, tt.ok)
+			}
+			if ok && cache.RecordType(soa.Type) != cache.RecordTypeSOA {
+				t.Errorf("returned a %d record, want the SOA", soa.Type)
+			}
+		})
+	}
+}
+
+func TestNegativeAnswerCached(t *testing.T) {
+	nxdomain := &Question{Name: "missing.negative.test", Type: uint16(cache.RecordTypeA), Class: 1}
+	cacheNegativeAnswer(nxdomain, &Query{Header: &Header{FLAGS: 1<<15 | 3}, Authority: []*Answer{soaAnswer(t, "negative.test", 3600, 300)}})
+
+	nodata := &Question{Name: "nodata.negative.test", Type: uint16(cache.RecordTypeAAAA), Class: 1}
+	cacheNegativeAnswer(nodata, &Query{Header: &Header{FLAGS: 1 << 15}, Authority: []*Answer{soaAnswer(t, "negative.test", 3600, 300)}})
+
+	tests := []struct {
+		name  string
+		qname string
+		qtype cache.RecordType
+		found bool
+		rcode uint16
+	}{
+		{"NXDOMAIN for the type asked", "missing.negative.test", cache.RecordTypeA, true, 3},
+		{"NXDOMAIN for any other type", "missing.negative.test", cache.RecordTypeMX, true, 3},
+		{"NODATA for the type asked", "nodata.negative.test", cache.RecordTypeAAAA, true, 0},
+		{"NODATA doesn't hold for other types", "nodata.negative.test", cache.RecordTypeA, false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			question := &Question{Name: tt.qname, Type: uint16(tt.qtype), Class: 1}
+			resp := &Query{Header: &Header{FLAGS: 1 << 15}, Questions: []*Question{question}}
+			if found := cachedNegativeAnswer(resp, question); found != tt.found {
+				t.Fatalf("found %v, want %v", found, tt.found)
+			}
+			if !tt.found {
+				return
+			}
+			if resp.RCode() != tt.rcode || len(resp.Answer) != 0 || len(resp.Authority) != 1 {
+				t.Fatalf("RCODE %d with %d answers and %d authority records", resp.RCode(), len(resp.Answer), len(resp.Authority))
+			}
+			// the SOA is sent with the TTL left on the cached entry, at most the 300 of MINIMUM
+			if ttl := resp.Authority[0].TTL; ttl > 300 || ttl < 298 {
+				t.Errorf("SOA TTL %d, want it counting down from 300", ttl)
+			}
+		})
+	}
+}
+
+func TestNegativeAnswerNotCached(t *testing.T) {
+	soa := []*Answer{soaAnswer(t, "negative.test", 3600, 300)}
+	tests := []struct {
+		name string
+		resp *Query
+	}{
+		{"SERVFAIL", &Query{Header: &Header{FLAGS: 1<<15 | 2}, Authority: soa}},
+		{"without a SOA", &Query{Header: &Header{FLAGS: 1<<15 | 3}}},
+		{"zero TTL", &Query{Header: &Header{FLAGS: 1<<15 | 3}, Authority: []*Answer{soaAnswer(t, "negative.test", 0, 300)}}},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			question := &Question{Name: "uncached" + string(rune('a'+i)) + ".negative.test", Type: uint16(cache.RecordTypeA), Class: 1}
+			cacheNegativeAnswer(question, tt.resp)
+			if cachedNegativeAnswer(&Query{Header: &Header{}}, question) {
+				t.Error("cached")
+			}
+		})
+	}
+}
@@ -4,11 +4,21 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
-	"strings"
 )
 
 // -- STRUCT START -- //
 
+// Bits of Header.FLAGS, AD and CD being the ones DNSSEC took from Z (RFC 4035 3.2)
+const (
+	FlagQR = 1 << 15 // a response
+	FlagAA = 1 << 10 // authoritative answer
+	FlagTC = 1 << 9  // truncated
+	FlagRD = 1 << 8  // recursion desired
+	FlagRA = 1 << 7  // recursion available
+	FlagAD = 1 << 5  // authentic data, set on answers that validated (RFC 4035 3.2.3)
+	FlagCD = 1 << 4  // checking disabled, the client validates on its own (RFC 4035 3.2.2)
+)
+
 type Header struct {
 	ID uint16 // Packet Identifier
 	// Flags is a 16-bit field that includes QR, OPCODE, AA, TC, RD, RA, Z, and RCODE
@@ -32,25 +42,53 @@ type Question struct {
 	Class uint16
 }
 
+// Answer is a resource record, the same layout is used by the answer, authority and additional sections
 type Answer struct {
-	Name   []byte // changed to []byte to preserve original name bytes
+	Name   string // decompressed owner name, in the same dotted form as Question.Name
 	Type   uint16
 	Class  uint16
 	TTL    uint32
 	Length uint16
-	Data   []byte
+	Data   []byte // embedded domain names are always stored uncompressed
 }
 
+// Query is a complete DNS message, used for queries and responses alike.
+// Section counts in the Header are derived from the slices on Encode
 type Query struct {
-	Header *Header
-	// As per RFC question section contains a list of questions,
-	// Here for simplicity, will only consider 1
-	Questions *Question
-	Answer    []*Answer
-
-	// TODO: for future
-	//Authority []*SOA
-	// AdditionalRecord []*ARN
+	Header     *Header
+	Questions  []*Question
+	Answer     []*Answer
+	Authority  []*Answer // e.g. SOA for negative answers, NS for referrals
+	Additional []*Answer // e.g. glue records, without the OPT record
+
+	Edns *OPT // EDNS(0) pseudo-record from the additional section, nil if absent
+}
+
+// Question returns the first question, in practice queries never carry more than one
+func (dq *Query) Question() *Question {
+	if len(dq.Questions) == 0 {
+		return nil
+	}
+	return dq.Questions[0]
+}
+
+// MaxAge tells how long the response may be cached for, the smallest TTL of the answer or
+// the negative TTL of NXDOMAIN and NODATA. Ok is false for responses that shouldn't be cached
+func (dq *Query) MaxAge() (uint32, bool) {
+	rcode := dq.RCode()
+	if rcode != 0 && rcode != 3 {
+		return 0, false
+	}
+	if len(dq.Answer) == 0 {
+		_, ttl, ok := negativeTTL(dq.Authority)
+		return ttl, ok
+	}
+
+	ttl := dq.Answer[0].TTL
+	for _, rr := range dq.Answer[1:] {
+		ttl = min(ttl, rr.TTL)
+	}
+	return ttl, true
 }
 
 // -- STRUCT END -- //
@@ -69,95 +107,144 @@ func (h *Header) encode() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-func (q *Question) encode() ([]byte, error) {
-	buf := new(bytes.Buffer)
-
-	labels := strings.Split(q.Name, ".")
-
-	for _, label := range labels {
-		if len(label) > 63 {
-			return nil, errors.New("label too long")
-		}
-		buf.WriteByte(uint8(len(label)))
-		buf.WriteString(label)
+func (q *Question) encode(w *messageWriter) error {
+	if err := w.writeName(q.Name, true); err != nil {
+		return err
 	}
-
-	buf.WriteByte(0)
-
-	fields := []any{q.Type, q.Class}
-	for _, field := range fields {
-		if err := binary.Write(buf, binary.BigEndian, field); err != nil {
-			return nil, err
-		}
-	}
-	return buf.Bytes(), nil
+	w.writeUint16(q.Type)
+	w.writeUint16(q.Class)
+	return nil
 }
 
-func (a *Answer) encode() ([]byte, error) {
-	buf := new(bytes.Buffer)
+func (a *Answer) encode(w *messageWriter) error {
+	if err := w.writeName(a.Name, true); err != nil {
+		return err
+	}
 
-	buf.Write(a.Name)
+	w.writeUint16(a.Type)
+	w.writeUint16(a.Class)
+	w.writeUint32(a.TTL)
 
-	_ = binary.Write(buf, binary.BigEndian, a.Type)
-	_ = binary.Write(buf, binary.BigEndian, a.Class)
-	_ = binary.Write(buf, binary.BigEndian, a.TTL)
-	_ = binary.Write(buf, binary.BigEndian, a.Length)
-	_ = binary.Write(buf, binary.BigEndian, a.Data)
+	// RDLENGTH is only known after the names in RDATA have been compressed
+	lengthOffset := w.buf.Len()
+	w.writeUint16(0)
+	if err := w.writeRData(a.Type, a.Data); err != nil {
+		return err
+	}
+	length := w.buf.Len() - lengthOffset - 2
+	if length > 0xFFFF {
+		return errors.New("record data too long")
+	}
+	binary.BigEndian.PutUint16(w.buf.Bytes()[lengthOffset:], uint16(length))
 
-	return buf.Bytes(), nil
+	return nil
 }
 
+// Encode builds the wire format of the message, compressing names as it goes
 func (dq *Query) Encode() ([]byte, error) {
-	buf := new(bytes.Buffer)
+	w := newMessageWriter()
+
+	// keeping the header counts in sync with the sections
+	dq.Header.QDCOUNT = uint16(len(dq.Questions))
+	dq.Header.ANCOUNT = uint16(len(dq.Answer))
+	dq.Header.NSCOUNT = uint16(len(dq.Authority))
+	dq.Header.ARCOUNT = uint16(len(dq.Additional))
+	if dq.Edns != nil {
+		dq.Header.ARCOUNT++
+	}
 
 	data, err := dq.Header.encode()
 	if err != nil {
 		return nil, err
 	}
-	buf.Write(data)
-	data, err = dq.Questions.encode()
-	if err != nil {
-		return nil, err
+	w.buf.Write(data)
+
+	for _, question := range dq.Questions {
+		if err = question.encode(w); err != nil {
+			return nil, err
+		}
 	}
-	buf.Write(data)
 
-	// encoding each answer
-	if dq.Answer != nil {
-		for _, answer := range dq.Answer {
-			data, err = answer.encode()
-			if err != nil {
+	// encoding each record of every section
+	for _, section := range [][]*Answer{dq.Answer, dq.Authority, dq.Additional} {
+		for _, record := range section {
+			if err = record.encode(w); err != nil {
 				return nil, err
 			}
-			buf.Write(data)
 		}
 	}
-	return buf.Bytes(), nil
+
+	if dq.Edns != nil {
+		data, err = dq.Edns.encode()
+		if err != nil {
+			return nil, err
+		}
+		w.buf.Write(data)
+	}
+	return w.buf.Bytes(), nil
 }
 
-func encodeDomainName(name string) ([]byte, error) {
-	// Convert domain name to DNS format
-	var buf []byte
-	labels := strings.Split(name, ".")
+// Truncate cuts a response down to the header and question section with the TC bit set,
+// if it doesn't fit in maxSize, so that the client retries over TCP (RFC 1035 4.2.1, RFC 7766 5)
+func Truncate(resp []byte, maxSize int) []byte {
+	if len(resp) <= maxSize || len(resp) < 12 {
+		return resp
+	}
 
-	for _, label := range labels {
-		if len(label) == 0 {
-			// If the label is empty, skip it
-			continue
+	offset := 12
+	qdCount := int(binary.BigEndian.Uint16(resp[4:6]))
+	for i := 0; i < qdCount; i++ {
+		end, err := skipDomainName(resp, offset)
+		if err != nil || end+4 > len(resp) {
+			offset = 12
+			qdCount = 0
+			break
 		}
-		if len(label) > 63 {
-			return nil, errors.New("label too long")
+		offset = end + 4
+	}
+
+	// OPT record has to survive truncation, so the client still knows we speak EDNS
+	var opt []byte
+	if qdCount > 0 {
+		recordOffset := offset
+		anCount := int(binary.BigEndian.Uint16(resp[6:8]))
+		nsCount := int(binary.BigEndian.Uint16(resp[8:10]))
+		arCount := int(binary.BigEndian.Uint16(resp[10:12]))
+		for i := 0; i < anCount+nsCount+arCount; i++ {
+			end, err := skipResourceRecord(resp, recordOffset)
+			if err != nil {
+				break
+			}
+			if i >= anCount+nsCount && resp[recordOffset] == 0 && binary.BigEndian.Uint16(resp[recordOffset+1:recordOffset+3]) == TypeOPT {
+				opt = resp[recordOffset:end]
+				break
+			}
+			recordOffset = end
 		}
-		buf = append(buf, byte(len(label)))
-		buf = append(buf, []byte(label)...)
 	}
-	buf = append(buf, 0) // Null byte to end the domain name
-	return buf, nil
+
+	truncated := make([]byte, offset, offset+len(opt))
+	copy(truncated, resp[:offset])
+	truncated = append(truncated, opt...)
+
+	flags := binary.BigEndian.Uint16(truncated[2:4]) | 1<<9 // Setting TC (bit 9)
+	binary.BigEndian.PutUint16(truncated[2:4], flags)
+	binary.BigEndian.PutUint16(truncated[4:6], uint16(qdCount))
+	binary.BigEndian.PutUint16(truncated[6:8], 0)
+	binary.BigEndian.PutUint16(truncated[8:10], 0)
+	binary.BigEndian.PutUint16(truncated[10:12], 0)
+	if opt != nil {
+		binary.BigEndian.PutUint16(truncated[10:12], 1)
+	}
+
+	return truncated
 }
 
 // -- ENCODE METHOD END -- //
 
 // -- DECODE METHOD START -- //
 
+// DecodeDNSQuery decodes a complete DNS message, both queries from clients and responses from upstreams
 func DecodeDNSQuery(data []byte) (*Query, error) {
 	var dq Query
 	header, err := decodeDNSHeader(data)
@@ -165,11 +252,47 @@ func DecodeDNSQuery(data []byte) (*Query, error) {
 		return nil, err
 	}
 	dq.Header = header
-	question, err := decodeDNSQuestion(data, 12)
+
+	offset := 12 // as we skipped header
+	for i := 0; i < int(header.QDCOUNT); i++ {
+		var question *Question
+		question, offset, err = decodeDNSQuestion(data, offset)
+		if err != nil {
+			return nil, err
+		}
+		dq.Questions = append(dq.Questions, question)
+	}
+
+	dq.Answer, offset, err = decodeSection(data, offset, int(header.ANCOUNT))
+	if err != nil {
+		return nil, err
+	}
+	dq.Authority, offset, err = decodeSection(data, offset, int(header.NSCOUNT))
 	if err != nil {
 		return nil, err
 	}
-	dq.Questions = question
+	additional, _, err := decodeSection(data, offset, int(header.ARCOUNT))
+	if err != nil {
+		return nil, err
+	}
+
+	// OPT is a pseudo-record, moving it out of the additional section
+	for _, record := range additional {
+		if record.Type != TypeOPT {
+			dq.Additional = append(dq.Additional, record)
+			continue
+		}
+		if dq.Edns != nil {
+			return nil, errors.New("more than one OPT record")
+		}
+		if record.Name != "" {
+			return nil, errors.New("OPT record must be owned by the root domain")
+		}
+		dq.Edns, err = decodeOPT(record.Class, record.TTL, record.Data)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	return &dq, nil
 }
@@ -188,126 +311,112 @@ func decodeDNSHeader(data []byte) (*Header, error) {
 	}, nil
 }
 
-func decodeDNSQuestion(data []byte, offset int) (*Question, error) {
+func decodeDNSQuestion(data []byte, offset int) (*Question, int, error) {
 	var q Question
-	var labels []string
-
-	for {
-		length := int(data[offset])
-		if length == 0 {
-			offset++
-			break
-		}
 
-		offset++
-		if offset+length > len(data) {
-			return nil, errors.New("malformed DNS question")
-		}
-		labels = append(labels, string(data[offset:offset+length]))
-		offset += length
+	name, offset, err := decodeDomainName(data, offset)
+	if err != nil {
+		return nil, 0, err
 	}
-	q.Name = strings.Join(labels, ".")
+	q.Name = name
+
 	if offset+4 > len(data) {
-		return &q, errors.New("malformed DNS question")
+		return &q, 0, errors.New("malformed DNS question")
 	}
 	q.Type = binary.BigEndian.Uint16(data[offset : offset+2])
 	q.Class = binary.BigEndian.Uint16(data[offset+2 : offset+4])
 	offset += 4
 
-	return &q, nil
+	return &q, offset, nil
 }
 
-func decodeDnsAnswer(data []byte) ([]*Answer, error) {
-	if len(data) < 12 {
-		return nil, errors.New("invalid DNS response")
-	}
-
-	anCount := binary.BigEndian.Uint16(data[6:8])
-
-	offset := 12 // as we skipped header
+func decodeSection(data []byte, offset int, count int) ([]*Answer, int, error) {
+	records := make([]*Answer, 0, count)
 
-	// Skip Question Section
-	for offset < len(data) {
-		length := int(data[offset])
-		if length == 0 {
-			offset++
-			break
-		}
-		// handling compression pointer in question
-		if length >= 0xC0 {
-			offset += 2
-			break
+	for i := 0; i < count; i++ {
+		record, next, err := decodeResourceRecord(data, offset)
+		if err != nil {
+			return nil, 0, err
 		}
-		offset += 1 + length
+		records = append(records, record)
+		offset = next
 	}
 
-	// Skip QTYPE (2 bytes) and QCLASS (2 bytes)
-	offset += 4
-	answers := make([]*Answer, 0, anCount)
-
-	for i := 0; i < int(anCount); i++ {
+	return records, offset, nil
+}
 
-		if offset >= len(data) {
-			return nil, errors.New("truncated DNS answer")
-		}
+func decodeResourceRecord(data []byte, offset int) (*Answer, int, error) {
+	if offset >= len(data) {
+		return nil, 0, errors.New("truncated resource record")
+	}
 
-		var nameBytes []byte // store original name bytes
-
-		if data[offset] >= 0xC0 {
-			nameBytes = make([]byte, 2)
-			copy(nameBytes, data[offset:offset+2])
-			offset += 2 // Compression pointer
-		} else {
-			nameEnd := offset
-			for nameEnd < len(data) {
-				length := int(data[nameEnd])
-				if length == 0 {
-					nameEnd++
-					break
-				}
-				if length >= 0xC0 {
-					nameEnd += 2 // Compression pointer
-					break
-				}
-				nameEnd += 1 + length
-			}
-			nameBytes = make([]byte, nameEnd-offset)
-			copy(nameBytes, data[offset:nameEnd])
-			offset = nameEnd
-		}
+	name, offset, err := decodeDomainName(data, offset)
+	if err != nil {
+		return nil, 0, err
+	}
 
-		if offset+10 > len(data) {
-			return nil, errors.New("truncated DNS answer")
-		}
+	if offset+10 > len(data) {
+		return nil, 0, errors.New("truncated resource record")
+	}
 
-		answerType := binary.BigEndian.Uint16(data[offset : offset+2])
-		answerClass := binary.BigEndian.Uint16(data[offset+2 : offset+4])
-		ttl := binary.BigEndian.Uint32(data[offset+4 : offset+8])
-		dataLen := binary.BigEndian.Uint16(data[offset+8 : offset+10])
-		offset += 10
+	recordType := binary.BigEndian.Uint16(data[offset : offset+2])
+	recordClass := binary.BigEndian.Uint16(data[offset+2 : offset+4])
+	ttl := binary.BigEndian.Uint32(data[offset+4 : offset+8])
+	dataLen := binary.BigEndian.Uint16(data[offset+8 : offset+10])
+	offset += 10
 
-		if offset+int(dataLen) > len(data) {
-			return nil, errors.New("incomplete DNS answer data")
-		}
+	if offset+int(dataLen) > len(data) {
+		return nil, 0, errors.New("incomplete resource record data")
+	}
 
-		answerData := make([]byte, dataLen)
-		copy(answerData, data[offset:offset+int(dataLen)])
+	// pointers in RDATA refer to this message, so they are resolved right away
+	recordData, err := decodeRData(data, offset, int(dataLen), recordType)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset += int(dataLen)
+
+	return &Answer{
+		Name:   name,
+		Type:   recordType,
+		Class:  recordClass,
+		TTL:    ttl,
+		Length: uint16(len(recordData)),
+		Data:   recordData,
+	}, offset, nil
+}
 
-		answer := &Answer{
-			Name:   nameBytes,
-			Type:   answerType,
-			Class:  answerClass,
-			TTL:    ttl,
-			Length: dataLen,
-			Data:   answerData,
+// skipDomainName returns the offset right after the domain name starting at offset
+func skipDomainName(data []byte, offset int) (int, error) {
+	for offset < len(data) {
+		length := int(data[offset])
+		if length == 0 {
+			return offset + 1, nil
 		}
-
-		answers = append(answers, answer)
-
-		offset += int(dataLen)
+		if length >= 0xC0 {
+			// compression pointer always ends the name
+			return offset + 2, nil
+		}
+		offset += 1 + length
 	}
+	return 0, errors.New("malformed domain name")
+}
 
-	return answers, nil
+// skipResourceRecord returns the offset right after the resource record starting at offset
+func skipResourceRecord(data []byte, offset int) (int, error) {
+	offset, err := skipDomainName(data, offset)
+	if err != nil {
+		return 0, err
+	}
+	// TYPE, CLASS, TTL and RDLENGTH
+	if offset+10 > len(data) {
+		return 0, errors.New("truncated resource record")
+	}
+	offset += 10 + int(binary.BigEndian.Uint16(data[offset+8:offset+10]))
+	if offset > len(data) {
+		return 0, errors.New("truncated resource record")
+	}
+	return offset, nil
 }
 
 // -- DECODE METHOD END -- //
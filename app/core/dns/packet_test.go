@@ -0,0 +1,134 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// testMessage builds a response to an A query for the name with the given number of answers
+func testMessage(name string, answers int) []byte {
+	msg := []byte{0x12, 0x34, 0x81, 0x80, 0, 1, 0, byte(answers), 0, 0, 0, 0}
+	for _, label := range bytes.Split([]byte(name), []byte(".")) {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0, 0, 1, 0, 1)
+	for i := 0; i < answers; i++ {
+		// a pointer to the name in the question, A, IN, TTL 300, 192.0.2.x
+		msg = append(msg, 0xC0, 12, 0, 1, 0, 1, 0, 0, 1, 44, 0, 4, 192, 0, 2, byte(i))
+	}
+	return msg
+}
+
+func TestTruncate(t *testing.T) {
+	resp := testMessage("example.com", 40)
+	question := len(testMessage("example.com", 0))
+
+	if got := Truncate(resp, len(resp)); !bytes.Equal(got, resp) {
+		t.Error("a response that fits was changed")
+	}
+
+	got := Truncate(resp, 512)
+	if len(got) != question {
+		t.Fatalf("truncated to %d bytes, want the %d of header and question", len(got), question)
+	}
+	if !bytes.Equal(got[12:], resp[12:question]) {
+		t.Error("question changed")
+	}
+	flags := binary.BigEndian.Uint16(got[2:4])
+	if flags&(1<<9) == 0 {
+		t.Error("TC not set")
+	}
+	if flags&^(1<<9) != binary.BigEndian.Uint16(resp[2:4]) {
+		t.Errorf("flags %04x, only TC should have been added to %04x", flags, binary.BigEndian.Uint16(resp[2:4]))
+	}
+	if counts := got[4:12]; !bytes.Equal(counts, []byte{0, 1, 0, 0, 0, 0, 0, 0}) {
+		t.Errorf("section counts % x, want only the question", counts)
+	}
+}
+
+func TestTruncateMalformedQuestion(t *testing.T) {
+	resp := testMessage("example.com", 40)
+	resp[12] = 63 // the first label now runs past the end of the message
+
+	got := Truncate(resp[:40], 20)
+	if len(got) != 12 || binary.BigEndian.Uint16(got[4:6]) != 0 {
+		t.Errorf("kept %d bytes and %d questions, want the bare header", len(got), binary.BigEndian.Uint16(got[4:6]))
+	}
+	if binary.BigEndian.Uint16(got[2:4])&(1<<9) == 0 {
+		t.Error("TC not set")
+	}
+}
+
+// testFullResponse is a referral-like response with a record in every section and an OPT record
+func testFullResponse() []byte {
+	msg := []byte{0x12, 0x34, 0x81, 0x80, 0, 1, 0, 1, 0, 1, 0, 2}
+	msg = append(msg, "\x03www\x07example\x03com\x00\x00\x01\x00\x01"...)
+	// answer: www.example.com A 192.0.2.1
+	msg = append(msg, 0xC0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 192, 0, 2, 1)
+	// authority: example.com NS ns.example.com
+	msg = append(msg, 0xC0, 16, 0, 2, 0, 1, 0, 0, 0x0e, 0x10, 0, 5, 2, 'n', 's', 0xC0, 16)
+	// additional: ns.example.com A 192.0.2.53, then OPT
+	msg = append(msg, 2, 'n', 's', 0xC0, 16, 0, 1, 0, 1, 0, 0, 0x0e, 0x10, 0, 4, 192, 0, 2, 53)
+	return append(msg, 0, 0, TypeOPT, 0x04, 0xd0, 0, 0, 0, 0, 0, 0)
+}
+
+func TestDecodeAllSections(t *testing.T) {
+	resp, err := DecodeDNSQuery(testFullResponse())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSections(t, resp)
+
+	// encoding keeps every section, with the counts taken from them
+	encoded, err := resp.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := DecodeDNSQuery(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSections(t, again)
+	if again.Header.ARCOUNT != 2 {
+		t.Errorf("ARCOUNT %d, want the glue and OPT", again.Header.ARCOUNT)
+	}
+}
+
+func checkSections(t *testing.T, resp *Query) {
+	t.Helper()
+	if len(resp.Questions) != 1 || resp.Question().Type != 1 {
+		t.Fatalf("questions %+v", resp.Questions)
+	}
+	sections := []struct {
+		name    string
+		records []*Answer
+		rrtype  uint16
+		ttl     uint32
+	}{
+		{"answer", resp.Answer, 1, 60},
+		{"authority", resp.Authority, 2, 3600},
+		{"additional", resp.Additional, 1, 3600},
+	}
+	for _, section := range sections {
+		if len(section.records) != 1 {
+			t.Errorf("%s: %d records, want 1", section.name, len(section.records))
+			continue
+		}
+		if rr := section.records[0]; rr.Type != section.rrtype || rr.TTL != section.ttl || int(rr.Length) != len(rr.Data) {
+			t.Errorf("%s: %+v", section.name, rr)
+		}
+	}
+	if resp.Edns == nil || resp.Edns.UDPSize != 1232 {
+		t.Errorf("OPT %+v, want it out of the additional section", resp.Edns)
+	}
+}
+
+func TestDecodeTruncatedSection(t *testing.T) {
+	full := testFullResponse()
+	// cutting into the authority section, which the header still counts
+	if _, err := DecodeDNSQuery(full[:len(full)-40]); err == nil {
+		t.Error("no error for a message shorter than its sections")
+	}
+}
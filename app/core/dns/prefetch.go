@@ -0,0 +1,28 @@
+package dns
+
+import (
+	"fmt"
+	"log"
+	"omamori/app/core/channels"
+	"omamori/app/core/internal/cache"
+)
+
+// prefetch refreshes a popular cache entry from upstream before it expires,
+// so clients keep getting answered from the cache
+func prefetch(domain string, recordType uint16) bool {
+	question := &Question{Name: domain, Type: recordType, Class: 1}
+
+	resp, upstream, err := resolveValidated(question, 1<<8, &OPT{UDPSize: MaxUDPSize})
+	if err != nil {
+		log.Printf("Failed to prefetch %s [Record %d]: %s\n", domain, recordType, err)
+		return false
+	}
+	cacheResponse(question, resp)
+
+	prefetched, hits := cache.DnsCache.PrefetchStats()
+	channels.LogEventChannel <- channels.Event{
+		Type:    channels.Log,
+		Payload: fmt.Sprintf("Prefetched %s via %s (%d prefetches, %d served a hit)\n", domain, upstream, prefetched+1, hits),
+	}
+	return true
+}
@@ -0,0 +1,79 @@
+package dns
+
+import (
+	"fmt"
+	"omamori/app/core/internal/cache"
+	"strconv"
+	"strings"
+)
+
+// RData returns the typed form of the record data
+func (a *Answer) RData() (cache.RData, error) {
+	return cache.ParseRData(cache.RecordType(a.Type), a.Data)
+}
+
+// ParseType turns a type mnemonic like AAAA, TYPE28 or plain 28 into its number
+func ParseType(name string) (uint16, bool) {
+	recordType, ok := cache.ParseRecordType(name)
+	return uint16(recordType), ok
+}
+
+// DataString formats the record data in zone file presentation format
+func (a *Answer) DataString() string {
+	rdata, err := a.RData()
+	if err != nil {
+		// malformed data for a known type is shown the generic way (RFC 3597 5)
+		rdata = &cache.UnknownRecord{RRType: cache.RecordType(a.Type), Data: a.Data}
+	}
+	return rdata.String()
+}
+
+// String formats the record the way it would appear in a zone file
+func (a *Answer) String() string {
+	return fmt.Sprintf("%s %d %s %s %s", strings.TrimSuffix(a.Name, ".")+".", a.TTL,
+		className(a.Class), cache.RecordType(a.Type), a.DataString())
+}
+
+func className(class uint16) string {
+	switch class {
+	case 1:
+		return "IN"
+	case 3:
+		return "CH"
+	case 4:
+		return "HS"
+	}
+	return "CLASS" + strconv.Itoa(int(class))
+}
+
+// newAnswer builds a record for the question out of typed record data
+func newAnswer(question *Question, ttl uint32, rdata cache.RData) (*Answer, error) {
+	data, err := rdata.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return &Answer{
+		Name:   question.Name,
+		Type:   uint16(rdata.Type()),
+		Class:  question.Class,
+		TTL:    ttl,
+		Length: uint16(len(data)),
+		Data:   data,
+	}, nil
+}
+
+func toCacheRR(a *Answer) cache.RR {
+	return cache.RR{Name: a.Name, Type: cache.RecordType(a.Type), Class: a.Class, TTL: a.TTL, Data: a.Data}
+}
+
+// fromCacheRR rebuilds the record with the given TTL, as the stored one only holds at the time of caching
+func fromCacheRR(rr cache.RR, ttl uint32) *Answer {
+	return &Answer{
+		Name:   rr.Name,
+		Type:   uint16(rr.Type),
+		Class:  rr.Class,
+		TTL:    ttl,
+		Length: uint16(len(rr.Data)),
+		Data:   rr.Data,
+	}
+}
@@ -0,0 +1,455 @@
+package dns
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"omamori/app/core/config"
+	"omamori/app/core/internal/cache"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Iterative resolution, walking down the delegations from the root servers
+// instead of forwarding to an upstream (RFC 1034 5.3.3)
+
+const (
+	authorityPort    = "53"
+	authorityTimeout = 800 * time.Millisecond
+
+	maxResolveQueries = 100 // sent for a single question, including the lookups of nameserver addresses
+	maxServersPerStep = 5   // tried for a zone before giving up on it
+	maxReferrals      = 30
+	maxCNAMEChain     = 8
+	maxNSLookupDepth  = 3  // nested resolutions of nameservers without glue
+	maxMinimiseCount  = 10 // labels added one at a time before sending the full name (RFC 9156 2.3)
+
+	infraCacheEntries = 2000
+)
+
+//go:embed root.hints
+var rootHints string
+
+// rootServers holds the addresses of the root servers, taken from the root hints file
+var rootServers = parseRootHints(rootHints)
+
+// infraCache holds the delegations and nameserver addresses picked up while resolving. Glue and the NS
+// records of a referral are not authoritative data (RFC 2181 5.4.1) and none of it is validated, so
+// it only ever guides the resolver and is kept apart from the cache answers are served from
+var infraCache cache.Cache = cache.DNSCache(infraCacheEntries)
+
+var (
+	errResolveBudget = errors.New("too many queries needed to resolve the name")
+	errNoAuthority   = errors.New("no authoritative server could answer")
+)
+
+// parseRootHints reads the A and AAAA records from a named.root style zone file
+func parseRootHints(hints string) []string {
+	var servers []string
+	for _, line := range strings.Split(hints, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 4 || strings.HasPrefix(fields[0], ";") {
+			continue
+		}
+		if (fields[2] == "A" || fields[2] == "AAAA") && net.ParseIP(fields[3]) != nil {
+			servers = append(servers, fields[3])
+		}
+	}
+	return servers
+}
+
+// recursion holds the state of resolving one question, across CNAMEs and nameserver lookups
+type recursion struct {
+	class   uint16
+	edns    *OPT
+	queries int // left to send before giving up
+}
+
+// resolveRecursive answers the question by asking the authoritative servers themselves,
+// returning the final response along with the server that sent it
+func resolveRecursive(question *Question, edns *OPT) (*Query, string, error) {
+	r := &recursion{class: question.Class, edns: edns, queries: maxResolveQueries}
+	return r.resolve(question.Name, question.Type, 0)
+}
+
+// resolve looks the name up, restarting at the target of every CNAME leaving the zone that answered
+func (r *recursion) resolve(name string, qtype uint16, depth int) (*Query, string, error) {
+	var chain []*Answer
+	for i := 0; ; i++ {
+		resp, server, zone, err := r.iterate(name, qtype, depth)
+		if err != nil {
+			return nil, "", err
+		}
+
+		answers, target, complete := followChain(resp.Answer, name, qtype, zone)
+		chain = append(chain, answers...)
+		resp.Answer = chain
+
+		if complete || resp.RCode() != 0 {
+			return resp, server, nil
+		}
+		if i == maxCNAMEChain {
+			return nil, "", errors.New("CNAME chain too long")
+		}
+		name = target
+	}
+}
+
+// iterate follows the referrals down from the closest known delegation to the zone holding the name.
+// With QNAME minimisation only one label more than the current zone is revealed at each step (RFC 9156).
+func (r *recursion) iterate(name string, qtype uint16, depth int) (*Query, string, string, error) {
+	nameLabels := len(splitDomainName(name))
+
+	zone, servers := closestDelegation(name)
+	if qtype == uint16(cache.RecordTypeDS) && nameLabels > 0 && strings.EqualFold(zone, name) {
+		// DS records live on the parent side of the zone cut (RFC 4035 3.1.4.1)
+		zone, servers = closestDelegation(lastLabels(name, nameLabels-1))
+	}
+
+	extra := 0 // labels past the zone cut known not to be a delegation
+	for referrals := 0; referrals < maxReferrals; {
+		qname, qt := name, qtype
+		if labels := len(splitDomainName(zone)) + 1 + extra; labels < nameLabels && extra < maxMinimiseCount {
+			// A rather than NS, as some servers don't answer NS queries below a zone cut properly (RFC 9156 3)
+			qname, qt = lastLabels(name, labels), uint16(cache.RecordTypeA)
+		}
+
+		resp, server, err := r.ask(servers, zone, qname, qt)
+		if err != nil {
+			return nil, "", "", err
+		}
+
+		if cut, nsRecords := referral(resp, zone, qname); cut != "" {
+			if servers, err = r.delegate(resp, zone, cut, nsRecords, depth); err != nil {
+				return nil, "", "", err
+			}
+			zone, extra = cut, 0
+			referrals++
+			continue
+		}
+
+		if qname != name {
+			if resp.RCode() == 3 {
+				// nothing exists below a name that doesn't exist (RFC 8020)
+				return resp, server, zone, nil
+			}
+			// no zone cut at this name, revealing one more label to the same servers
+			extra++
+			continue
+		}
+		return resp, server, zone, nil
+	}
+	return nil, "", "", errors.New("too many referrals")
+}
+
+// ask sends the question to the servers of the zone until one of them answers for it
+func (r *recursion) ask(servers []string, zone string, name string, qtype uint16) (*Query, string, error) {
+	lastErr := errNoAuthority
+	for _, server := range orderServers(servers) {
+		if r.queries == 0 {
+			return nil, "", errResolveBudget
+		}
+		r.queries--
+
+		resp, err := queryAuthority(server, name, qtype, r.class, r.edns)
+		if err == nil {
+			err = checkAuthority(resp, zone, name)
+			if err != nil {
+				// lame delegation, the server was delegated the zone but doesn't serve it
+				log.Printf("Lame server %s for %s: %s\n", server, fqdnOrRoot(zone), err)
+			}
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return resp, server, nil
+	}
+	return nil, "", lastErr
+}
+
+// delegate picks up the addresses of the nameservers a referral points to, from the glue if
+// it can be trusted and by resolving their names otherwise. The delegation is cached on the way.
+func (r *recursion) delegate(resp *Query, zone string, cut string, nsRecords []*Answer, depth int) ([]string, error) {
+	cacheInfrastructure(cut, uint16(cache.RecordTypeNS), nsRecords)
+
+	nameservers := make(map[string]bool, len(nsRecords))
+	var names []string
+	for _, ns := range nsRecords {
+		rdata, err := ns.RData()
+		if err != nil {
+			continue
+		}
+		target := strings.ToLower(rdata.(*cache.NSRecord).NameServer)
+		nameservers[target] = true
+		names = append(names, target)
+	}
+
+	// glue is only trusted for names within the zone of the server that sent it
+	glue := make(map[string][]*Answer)
+	var addresses []string
+	for _, rr := range resp.Additional {
+		owner := strings.ToLower(rr.Name)
+		if !nameservers[owner] || !isSubdomain(owner, zone) {
+			continue
+		}
+		if ip := recordAddress(rr); ip != "" {
+			key := fmt.Sprintf("%s %d", owner, rr.Type)
+			glue[key] = append(glue[key], rr)
+			addresses = append(addresses, ip)
+		}
+	}
+	for _, records := range glue {
+		cacheInfrastructure(records[0].Name, records[0].Type, records)
+	}
+	if len(addresses) > 0 {
+		return addresses, nil
+	}
+
+	if depth < maxNSLookupDepth {
+		for _, ns := range names {
+			if isSubdomain(ns, cut) {
+				// can't be reached without glue
+				continue
+			}
+			if addresses = r.nameserverAddresses(ns, depth+1); len(addresses) > 0 {
+				return addresses, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no address found for any nameserver of %s", fqdnOrRoot(cut))
+}
+
+// nameserverAddresses returns the IPv4 addresses of the nameserver, resolving them if they are not cached
+func (r *recursion) nameserverAddresses(ns string, depth int) []string {
+	if addresses := cachedAddresses(ns); len(addresses) > 0 {
+		return addresses
+	}
+
+	resp, _, err := r.resolve(ns, uint16(cache.RecordTypeA), depth)
+	if err != nil || resp.RCode() != 0 {
+		return nil
+	}
+	cacheInfrastructure(ns, uint16(cache.RecordTypeA), resp.Answer)
+
+	var addresses []string
+	for _, rr := range resp.Answer {
+		if ip := recordAddress(rr); ip != "" {
+			addresses = append(addresses, ip)
+		}
+	}
+	return addresses
+}
+
+// queryAuthority sends a non recursive query to the server
+func queryAuthority(server string, name string, qtype uint16, class uint16, edns *OPT) (*Query, error) {
+	sent := name
+	if config.Global.Use0x20 {
+		sent = randomizeCase(name)
+	}
+
+	query, err := (&Query{
+		Header:    &Header{ID: newQueryID()}, // RD left unset
+		Questions: []*Question{{Name: sent, Type: qtype, Class: class}},
+		Edns:      edns,
+	}).Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	authority := &plainUpstream{addr: net.JoinHostPort(server, authorityPort), timeout: authorityTimeout}
+	buf, err := authority.exchange(query, int(edns.UDPSize), config.Global.Use0x20)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := DecodeDNSQuery(buf)
+	if err != nil {
+		return nil, err
+	}
+	restoreCase(resp, sent, name)
+	return resp, nil
+}
+
+// checkAuthority makes sure the server answered for the zone it was asked about,
+// either authoritatively or with a referral further down
+func checkAuthority(resp *Query, zone string, name string) error {
+	if rcode := resp.RCode(); rcode != 0 && rcode != 3 {
+		return fmt.Errorf("answered with rcode %d", rcode)
+	}
+	if resp.Header.FLAGS&(1<<10) != 0 { // AA
+		return nil
+	}
+	if cut, _ := referral(resp, zone, name); cut != "" {
+		return nil
+	}
+	return errors.New("not authoritative for the zone")
+}
+
+// referral returns the zone cut and its NS records if the response delegates the name
+// to a zone below the one asked, referrals upwards or sideways are ignored
+func referral(resp *Query, zone string, name string) (string, []*Answer) {
+	if resp.RCode() != 0 || len(resp.Answer) > 0 || resp.Header.FLAGS&(1<<10) != 0 {
+		return "", nil
+	}
+
+	var cut string
+	var nsRecords []*Answer
+	for _, rr := range resp.Authority {
+		if cache.RecordType(rr.Type) != cache.RecordTypeNS {
+			continue
+		}
+		owner := strings.ToLower(rr.Name)
+		if owner == zone || !isSubdomain(owner, zone) || !isSubdomain(name, owner) {
+			continue
+		}
+		if cut != "" && owner != cut {
+			continue
+		}
+		cut = owner
+		nsRecords = append(nsRecords, rr)
+	}
+	return cut, nsRecords
+}
+
+// followChain picks the records answering the question out of the answer section, following
+// CNAMEs as long as they stay within the zone. It returns the name the chain ended at, and
+// whether that is the final answer, which it isn't when the chain leads out of the zone.
+func followChain(answers []*Answer, name string, qtype uint16, zone string) ([]*Answer, string, bool) {
+	var chain []*Answer
+	current := name
+	for i := 0; i <= maxCNAMEChain; i++ {
+		var cname *Answer
+		var matched []*Answer
+		for _, rr := range answers {
+			if !strings.EqualFold(rr.Name, current) {
+				continue
+			}
+			if rr.Type == qtype || qtype == 255 { // ANY
+				matched = append(matched, rr)
+			} else if cache.RecordType(rr.Type) == cache.RecordTypeCNAME {
+				cname = rr
+			}
+		}
+		if len(matched) > 0 {
+			return append(chain, matched...), current, true
+		}
+		if cname == nil {
+			// NODATA, or NXDOMAIN, for the name the chain ended at
+			return chain, current, true
+		}
+
+		rdata, err := cname.RData()
+		if err != nil {
+			return chain, current, true
+		}
+		chain = append(chain, cname)
+		current = strings.ToLower(rdata.(*cache.CNAMERecord).Target)
+		if !isSubdomain(current, zone) {
+			// data for names outside the zone can't be trusted from this server
+			break
+		}
+	}
+	return chain, current, false
+}
+
+// closestDelegation finds the deepest zone enclosing the name whose nameservers are cached,
+// starting at the root servers when there is none
+func closestDelegation(name string) (string, []string) {
+	labels := splitDomainName(strings.ToLower(name))
+	for i := range labels {
+		zone := strings.Join(labels[i:], ".")
+		record, found := infraCache.Get(zone, uint16(cache.RecordTypeNS))
+		if !found || record.Negative {
+			continue
+		}
+
+		var addresses []string
+		for _, rr := range record.Answers {
+			if rr.Type != cache.RecordTypeNS || !strings.EqualFold(rr.Name, zone) {
+				continue
+			}
+			if ns, err := cache.ParseRData(rr.Type, rr.Data); err == nil {
+				addresses = append(addresses, cachedAddresses(ns.(*cache.NSRecord).NameServer)...)
+			}
+		}
+		if len(addresses) > 0 {
+			return zone, addresses
+		}
+	}
+	return "", rootServers
+}
+
+// cacheInfrastructure stores records the resolver needs to find its way, see infraCache
+func cacheInfrastructure(name string, rrtype uint16, records []*Answer) {
+	if record := answerRecord(rrtype, records, false); record != nil {
+		infraCache.Set(strings.ToLower(name), record)
+	}
+}
+
+func cachedAddresses(name string) []string {
+	var addresses []string
+	for _, recordType := range []cache.RecordType{cache.RecordTypeA, cache.RecordTypeAAAA} {
+		record, found := infraCache.Get(strings.ToLower(name), uint16(recordType))
+		if !found || record.Negative {
+			continue
+		}
+		for _, rr := range record.Answers {
+			if rr.Type == recordType {
+				addresses = append(addresses, net.IP(rr.Data).String())
+			}
+		}
+	}
+	return addresses
+}
+
+// recordAddress returns the address held by an A or AAAA record, empty for any other record
+func recordAddress(rr *Answer) string {
+	switch {
+	case cache.RecordType(rr.Type) == cache.RecordTypeA && len(rr.Data) == net.IPv4len,
+		cache.RecordType(rr.Type) == cache.RecordTypeAAAA && len(rr.Data) == net.IPv6len:
+		return net.IP(rr.Data).String()
+	}
+	return ""
+}
+
+// orderServers shuffles the servers to spread the load, trying IPv4 first as IPv6 may well not be routed
+func orderServers(servers []string) []string {
+	ordered := append([]string(nil), servers...)
+	rand.Shuffle(len(ordered), func(i, j int) {
+		ordered[i], ordered[j] = ordered[j], ordered[i]
+	})
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return strings.Contains(ordered[j], ":") && !strings.Contains(ordered[i], ":")
+	})
+	return ordered[:min(len(ordered), maxServersPerStep)]
+}
+
+// isSubdomain reports whether the name is the zone itself or below it, the root being ""
+func isSubdomain(name string, zone string) bool {
+	name, zone = strings.ToLower(name), strings.ToLower(zone)
+	if zone == "" || name == zone {
+		return true
+	}
+	if !strings.HasSuffix(name, "."+zone) {
+		return false
+	}
+	// comparing labels, a dot escaped in a label of the name doesn't start the zone
+	nameLabels, zoneLabels := splitDomainName(name), splitDomainName(zone)
+	return len(nameLabels) > len(zoneLabels) &&
+		strings.Join(nameLabels[len(nameLabels)-len(zoneLabels):], ".") == zone
+}
+
+// lastLabels returns the name made of the last count labels of the name
+func lastLabels(name string, count int) string {
+	labels := splitDomainName(name)
+	return strings.Join(labels[len(labels)-count:], ".")
+}
+
+func fqdnOrRoot(zone string) string {
+	return strings.TrimSuffix(zone, ".") + "."
+}
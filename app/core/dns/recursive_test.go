@@ -0,0 +1,331 @@
+package dns
+
+import (
+	"net"
+	"omamori/app/core/config"
+	"omamori/app/core/internal/cache"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeAuthority is an authoritative server on port 53 of a loopback address,
+// keeping a log of the questions it was asked
+type fakeAuthority struct {
+	ip    string
+	mutex sync.Mutex
+	asked []string // "name TYPE"
+}
+
+func startAuthority(t *testing.T, ip string, handle func(q *Question) *Query) *fakeAuthority {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(ip), Port: 53})
+	if err != nil {
+		t.Skipf("can't bind %s:53 for a fake authoritative server: %v", ip, err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	a := &fakeAuthority{ip: ip}
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, client, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			query, err := DecodeDNSQuery(buf[:n])
+			if err != nil || query.Question() == nil {
+				continue
+			}
+			question := query.Question()
+			a.mutex.Lock()
+			a.asked = append(a.asked, strings.ToLower(question.Name)+" "+cache.RecordType(question.Type).String())
+			a.mutex.Unlock()
+
+			resp := handle(question)
+			resp.Header.ID = query.Header.ID
+			resp.Header.FLAGS |= 1 << 15
+			resp.Questions = query.Questions
+			if msg, err := resp.Encode(); err == nil {
+				_, _ = conn.WriteToUDP(msg, client)
+			}
+		}
+	}()
+	return a
+}
+
+func (a *fakeAuthority) questions() []string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return append([]string(nil), a.asked...)
+}
+
+func (a *fakeAuthority) wasAsked(question string) bool {
+	for _, asked := range a.questions() {
+		if asked == question {
+			return true
+		}
+	}
+	return false
+}
+
+func testRR(t *testing.T, name string, rdata cache.RData) *Answer {
+	t.Helper()
+	rr, err := newAnswer(&Question{Name: name, Class: 1}, 300, rdata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+// delegation refers the zone to the nameservers, with glue for the ones given an address
+func delegation(t *testing.T, zone string, glue map[string]string, nameservers ...string) *Query {
+	resp := &Query{Header: &Header{}}
+	for _, ns := range nameservers {
+		resp.Authority = append(resp.Authority, testRR(t, zone, &cache.NSRecord{NameServer: ns}))
+		if ip, found := glue[ns]; found {
+			resp.Additional = append(resp.Additional, testRR(t, ns, &cache.ARecord{IPAddress: ip}))
+		}
+	}
+	return resp
+}
+
+func authoritative(answers ...*Answer) *Query {
+	return &Query{Header: &Header{FLAGS: 1 << 10}, Answer: answers}
+}
+
+// negative is an authoritative NXDOMAIN (rcode 3) or NODATA (rcode 0) with the SOA of the zone
+func negative(t *testing.T, zone string, rcode uint16) *Query {
+	soa := testRR(t, zone, &cache.SOARecord{MName: "ns." + zone, RName: "hostmaster." + zone, Minimum: 60})
+	return &Query{Header: &Header{FLAGS: 1<<10 | rcode}, Authority: []*Answer{soa}}
+}
+
+// testHierarchy is a root, the com and net TLDs and a few zones below them, all on loopback:
+//
+//	127.0.0.2  root, delegating com and net to 127.0.0.3
+//	127.0.0.3  com and net, delegating example.com to a lame 127.0.0.6 and to 127.0.0.4,
+//	           other.net to ns.example.com without glue, and lame.com to 127.0.0.6 and 127.0.0.7
+//	127.0.0.4  example.com, with www as a CNAME into other.net
+//	127.0.0.5  other.net
+//	127.0.0.6  delegated example.com and lame.com but refusing every query
+//	127.0.0.7  delegated lame.com but referring back up to com
+type testHierarchy struct {
+	root, tld, example, other, lame, upward *fakeAuthority
+}
+
+func startHierarchy(t *testing.T) *testHierarchy {
+	setupLookup(t)
+	config.Global.Recursive = true
+
+	savedRoots, savedInfra := rootServers, infraCache
+	t.Cleanup(func() {
+		infraCache.Close()
+		rootServers, infraCache = savedRoots, savedInfra
+	})
+	infraCache = cache.DNSCache(infraCacheEntries)
+	rootServers = []string{"127.0.0.2"}
+
+	// answers cached by an earlier run would keep the servers from being asked
+	for _, name := range []string{"www.example.com", "deep.a.b.example.com", "missing.a.example.com",
+		"ns.example.com", "ns2.example.com", "example.com", "web.other.net", "com",
+		"alias.example.com", "www.lame.com"} {
+		for _, rtype := range []cache.RecordType{cache.RecordTypeA, cache.RecordTypeNS, cache.RecordTypeNXDomain} {
+			cache.DnsCache.Remove(name, uint16(rtype))
+		}
+	}
+
+	h := &testHierarchy{}
+	h.root = startAuthority(t, "127.0.0.2", func(q *Question) *Query {
+		name := strings.ToLower(q.Name)
+		for _, tld := range []string{"com", "net"} {
+			if isSubdomain(name, tld) {
+				return delegation(t, tld, map[string]string{"a.gtld-servers.net": "127.0.0.3"}, "a.gtld-servers.net")
+			}
+		}
+		return negative(t, "", 3)
+	})
+	h.tld = startAuthority(t, "127.0.0.3", func(q *Question) *Query {
+		name := strings.ToLower(q.Name)
+		switch {
+		case isSubdomain(name, "example.com"):
+			resp := delegation(t, "example.com",
+				map[string]string{"ns1.example.com": "127.0.0.6", "ns2.example.com": "127.0.0.4"},
+				"ns1.example.com", "ns2.example.com")
+			// glue for a name outside com, which the com servers have no say over
+			resp.Additional = append(resp.Additional, testRR(t, "a.gtld-servers.net", &cache.ARecord{IPAddress: "192.0.2.66"}))
+			return resp
+		case isSubdomain(name, "other.net"):
+			return delegation(t, "other.net", nil, "ns.example.com")
+		case isSubdomain(name, "lame.com"):
+			return delegation(t, "lame.com",
+				map[string]string{"ns1.lame.com": "127.0.0.6", "ns2.lame.com": "127.0.0.7"},
+				"ns1.lame.com", "ns2.lame.com")
+		case name == "a.gtld-servers.net":
+			return authoritative(testRR(t, name, &cache.ARecord{IPAddress: "127.0.0.3"}))
+		case isSubdomain(name, "com"):
+			return negative(t, "com", 3)
+		}
+		return negative(t, "net", 3)
+	})
+	h.example = startAuthority(t, "127.0.0.4", func(q *Question) *Query {
+		name := strings.ToLower(q.Name)
+		switch {
+		case name == "www.example.com" && q.Type == uint16(cache.RecordTypeA):
+			// along with an address for the target, which isn't this server's to give
+			return authoritative(
+				testRR(t, name, &cache.CNAMERecord{Target: "web.other.net"}),
+				testRR(t, "web.other.net", &cache.ARecord{IPAddress: "192.0.2.66"}))
+		case name == "alias.example.com" && q.Type == uint16(cache.RecordTypeA):
+			return authoritative(
+				testRR(t, name, &cache.CNAMERecord{Target: "deep.a.b.example.com"}),
+				testRR(t, "deep.a.b.example.com", &cache.ARecord{IPAddress: "192.0.2.10"}))
+		case name == "deep.a.b.example.com" && q.Type == uint16(cache.RecordTypeA):
+			return authoritative(testRR(t, name, &cache.ARecord{IPAddress: "192.0.2.10"}))
+		case name == "ns.example.com" && q.Type == uint16(cache.RecordTypeA):
+			return authoritative(testRR(t, name, &cache.ARecord{IPAddress: "127.0.0.5"}))
+		case name == "ns2.example.com" && q.Type == uint16(cache.RecordTypeA):
+			// the address the zone itself has for its nameserver, the glue has another one
+			return authoritative(testRR(t, name, &cache.ARecord{IPAddress: "192.0.2.53"}))
+		case name == "example.com" && q.Type == uint16(cache.RecordTypeNS):
+			return authoritative(testRR(t, name, &cache.NSRecord{NameServer: "ns2.example.com"}))
+		case name == "example.com", isSubdomain("deep.a.b.example.com", name), name == "ns.example.com",
+			name == "www.example.com", name == "ns1.example.com", name == "ns2.example.com":
+			return negative(t, "example.com", 0)
+		}
+		return negative(t, "example.com", 3)
+	})
+	h.other = startAuthority(t, "127.0.0.5", func(q *Question) *Query {
+		name := strings.ToLower(q.Name)
+		if name == "web.other.net" && q.Type == uint16(cache.RecordTypeA) {
+			return authoritative(testRR(t, name, &cache.ARecord{IPAddress: "192.0.2.80"}))
+		}
+		return negative(t, "other.net", 3)
+	})
+	h.lame = startAuthority(t, "127.0.0.6", func(q *Question) *Query {
+		return &Query{Header: &Header{FLAGS: 5}} // REFUSED
+	})
+	h.upward = startAuthority(t, "127.0.0.7", func(q *Question) *Query {
+		return delegation(t, "com", map[string]string{"a.gtld-servers.net": "127.0.0.3"}, "a.gtld-servers.net")
+	})
+	return h
+}
+
+func TestRecursiveKeepsDelegationsOutOfTheAnswerCache(t *testing.T) {
+	startHierarchy(t)
+
+	if resp := lookup(t, "deep.a.b.example.com", 1); resp.RCode() != 0 || len(resp.Answer) != 1 {
+		t.Fatalf("deep.a.b.example.com: rcode %d, answers %s", resp.RCode(), describeAnswers(resp.Answer))
+	}
+
+	// the referrals are kept for the resolver, but not where answers are served from (RFC 2181 5.4.1)
+	for _, rr := range []struct {
+		name  string
+		rtype cache.RecordType
+	}{
+		{"example.com", cache.RecordTypeNS},
+		{"ns2.example.com", cache.RecordTypeA},
+		{"com", cache.RecordTypeNS},
+	} {
+		if _, found := infraCache.Get(rr.name, uint16(rr.rtype)); !found {
+			t.Errorf("%s %s missing from the infrastructure cache", rr.name, rr.rtype)
+		}
+		if _, found := cache.DnsCache.Get(rr.name, uint16(rr.rtype)); found {
+			t.Errorf("%s %s from a referral was put in the answer cache", rr.name, rr.rtype)
+		}
+	}
+	if addresses := cachedAddresses("a.gtld-servers.net"); len(addresses) != 1 || addresses[0] != "127.0.0.3" {
+		t.Errorf("a.gtld-servers.net cached at %v, glue from the com servers must not replace the root's", addresses)
+	}
+
+	// clients get the zone's own data, rather than the glue
+	resp := lookup(t, "ns2.example.com", 1)
+	if len(resp.Answer) != 1 || !net.IP(resp.Answer[0].Data).Equal(net.IPv4(192, 0, 2, 53)) {
+		t.Errorf("ns2.example.com answered with %s, want the authoritative 192.0.2.53", describeAnswers(resp.Answer))
+	}
+}
+
+func TestRecursiveMinimisesQueryNames(t *testing.T) {
+	h := startHierarchy(t)
+
+	resp := lookup(t, "deep.a.b.example.com", 1)
+	if resp.RCode() != 0 || len(resp.Answer) != 1 || !net.IP(resp.Answer[0].Data).Equal(net.IPv4(192, 0, 2, 10)) {
+		t.Fatalf("deep.a.b.example.com: rcode %d, answers %s", resp.RCode(), describeAnswers(resp.Answer))
+	}
+
+	// every server only learns one label more than the zone it serves (RFC 9156)
+	want := map[*fakeAuthority][]string{
+		h.root:    {"com A"},
+		h.tld:     {"example.com A"},
+		h.example: {"b.example.com A", "a.b.example.com A", "deep.a.b.example.com A"},
+	}
+	for server, questions := range want {
+		if got := server.questions(); strings.Join(got, ", ") != strings.Join(questions, ", ") {
+			t.Errorf("%s was asked %v, want %v", server.ip, got, questions)
+		}
+	}
+}
+
+func TestRecursiveStopsBelowNXDomain(t *testing.T) {
+	h := startHierarchy(t)
+
+	if resp := lookup(t, "missing.a.example.com", 1); resp.RCode() != 3 {
+		t.Fatalf("missing.a.example.com: rcode %d, want NXDOMAIN", resp.RCode())
+	}
+	// nothing exists below a name that doesn't exist (RFC 8020)
+	if h.example.wasAsked("missing.a.example.com A") {
+		t.Error("the full name was sent after its parent turned out not to exist")
+	}
+}
+
+func TestRecursiveSkipsLameServers(t *testing.T) {
+	h := startHierarchy(t)
+
+	// the servers are tried in random order, the refusing one has to be stepped over whenever it comes first
+	r := &recursion{class: 1, edns: &OPT{UDPSize: MaxUDPSize}, queries: maxResolveQueries}
+	for i := 0; i < 8; i++ {
+		resp, server, err := r.ask([]string{"127.0.0.6", "127.0.0.4"}, "example.com", "deep.a.b.example.com", 1)
+		if err != nil || server != "127.0.0.4" || len(resp.Answer) != 1 {
+			t.Fatalf("ask: server %q, error %v", server, err)
+		}
+	}
+
+	// a zone with nothing but lame servers, one refusing and one referring back up, can't be resolved
+	if resp := lookup(t, "www.lame.com", 1); resp.RCode() != 2 {
+		t.Errorf("www.lame.com: rcode %d, want SERVFAIL", resp.RCode())
+	}
+	if len(h.lame.questions()) == 0 || len(h.upward.questions()) == 0 {
+		t.Errorf("both lame servers should have been tried, asked %v and %v", h.lame.questions(), h.upward.questions())
+	}
+	if got := h.tld.questions(); len(got) != 1 {
+		t.Errorf("the referral back up to com was followed, com asked %v", got)
+	}
+}
+
+func TestRecursiveFollowsCNAMEs(t *testing.T) {
+	h := startHierarchy(t)
+
+	// the target is in another zone, whose nameserver has no glue and needs resolving too
+	resp := lookup(t, "www.example.com", 1)
+	if resp.RCode() != 0 || len(resp.Answer) != 2 {
+		t.Fatalf("www.example.com: rcode %d, answers %s", resp.RCode(), describeAnswers(resp.Answer))
+	}
+	if resp.Answer[0].Type != uint16(cache.RecordTypeCNAME) || !strings.EqualFold(resp.Answer[1].Name, "web.other.net") {
+		t.Errorf("answers %s, want the CNAME followed by the A record of its target", describeAnswers(resp.Answer))
+	}
+	if !net.IP(resp.Answer[1].Data).Equal(net.IPv4(192, 0, 2, 80)) {
+		t.Errorf("web.other.net answered with %s, the address from example.com is not to be trusted",
+			describeAnswers(resp.Answer[1:]))
+	}
+	if !h.other.wasAsked("web.other.net A") || !h.example.wasAsked("ns.example.com A") {
+		t.Errorf("target not resolved from its own zone, other.net asked %v", h.other.questions())
+	}
+
+	// a chain staying within the zone is taken from the one response
+	resp = lookup(t, "alias.example.com", 1)
+	if len(resp.Answer) != 2 || !net.IP(resp.Answer[1].Data).Equal(net.IPv4(192, 0, 2, 10)) {
+		t.Errorf("alias.example.com answered with %s", describeAnswers(resp.Answer))
+	}
+	if h.example.wasAsked("deep.a.b.example.com A") {
+		t.Error("the target of an in-zone CNAME was asked for again")
+	}
+}
@@ -1,12 +1,14 @@
 package dns
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"omamori/app/core/channels"
 	"omamori/app/core/config"
 	"omamori/app/core/internal/cache"
+	"strings"
 	"time"
 )
 
@@ -20,12 +22,47 @@ func resolveCustomDns(domainName string) (string, bool) {
 	return "", false
 }
 
+// customRecord picks the record to answer with for a custom mapping, nil if the mapping
+// has no data for the question type (NODATA)
+func customRecord(question *Question, customIP string) cache.RData {
+	ip := net.ParseIP(customIP)
+	if ip == nil {
+		return nil
+	}
+
+	switch cache.RecordType(question.Type) {
+	case cache.RecordTypeA:
+		if ip.IsUnspecified() {
+			// blocked sites are answered with the unspecified address of either family
+			return &cache.ARecord{IPAddress: net.IPv4zero.String()}
+		}
+		if ip.To4() != nil {
+			return &cache.ARecord{IPAddress: ip.String()}
+		}
+	case cache.RecordTypeAAAA:
+		if ip.IsUnspecified() {
+			return &cache.AAAARecord{IPAddress: net.IPv6unspecified.String()}
+		}
+		if ip.To4() == nil {
+			return &cache.AAAARecord{IPAddress: ip.String()}
+		}
+	}
+	return nil
+}
+
 func Lookup(dnsQuery *Query) []byte {
 
 	flags := dnsQuery.Header.FLAGS
-	// update header according to answer
-	dnsQuery.Header.QDCOUNT = 1
-	dnsQuery.Header.ARCOUNT = 0
+
+	// AD is only set on answers we validated, and only for clients showing they understand it (RFC 6840 5.7)
+	dnsQuery.Header.FLAGS &^= FlagAD
+	wantsAD := flags&FlagAD != 0 || (dnsQuery.Edns != nil && dnsQuery.Edns.DO())
+	wantsDNSSEC := dnsQuery.Edns != nil && dnsQuery.Edns.DO()
+
+	// response only carries what we put in, dropping anything the client sent along
+	dnsQuery.Answer = nil
+	dnsQuery.Authority = nil
+	dnsQuery.Additional = nil
 
 	// Setting QR (bit 15)
 	dnsQuery.Header.FLAGS = dnsQuery.Header.FLAGS | 1<<15
@@ -33,47 +70,71 @@ func Lookup(dnsQuery *Query) []byte {
 	// Setting RA (bit 7)
 	dnsQuery.Header.FLAGS = dnsQuery.Header.FLAGS | 1<<7
 
-	encodedName, err := encodeDomainName(dnsQuery.Questions.Name)
+	// responding with our own OPT record only if the client sent one (RFC 6891 7)
+	clientEdns := dnsQuery.Edns
+	if clientEdns != nil {
+		dnsQuery.Edns = &OPT{
+			UDPSize: MaxUDPSize,
+			Flags:   clientEdns.Flags & EdnsFlagDO, // DO bit is copied to the response (RFC 3225 3)
+		}
 
-	if err != nil {
-		log.Printf("Error encoding domain name %s: %s\n", dnsQuery.Questions.Name, err)
-		return nil
+		if clientEdns.Version > 0 {
+			dnsQuery.setRCode(RCodeBadVers)
+			resp, _ := dnsQuery.Encode()
+			return resp
+		}
+	}
+
+	if len(dnsQuery.Questions) != 1 {
+		// only a single question is supported in practice (RFC 9619)
+		dnsQuery.setRCode(1) // FORMERR
+		resp, _ := dnsQuery.Encode()
+		return resp
 	}
+	question := dnsQuery.Question()
+
+	if customIP, resolved := resolveCustomDns(question.Name); resolved {
+		dnsQuery.setRCode(0)
+		if rdata := customRecord(question, customIP); rdata != nil {
+			answer, err := newAnswer(question, 600, rdata)
+			if err != nil {
+				log.Printf("Error building custom record for %s: %s\n", question.Name, err)
+				return nil
+			}
+			dnsQuery.Answer = []*Answer{answer}
+		}
 
-	if customIP, resolved := resolveCustomDns(dnsQuery.Questions.Name); resolved {
 		channels.LogEventChannel <- channels.Event{Type: channels.Log,
-			Payload: fmt.Sprintf("Custom DNS lookup enabled for %s: %s\n", dnsQuery.Questions.Name, customIP)}
-
-		dnsQuery.Answer = []*Answer{{
-			encodedName,
-			dnsQuery.Questions.Type,
-			dnsQuery.Questions.Class,
-			600,
-			1 << 2,
-			net.ParseIP(customIP).To4(),
-		}}
-		dnsQuery.Header.ANCOUNT = 1
+			Payload: fmt.Sprintf("Custom DNS lookup enabled for %s: %s\n", question.Name, describeAnswers(dnsQuery.Answer))}
+
+		resp, _ := dnsQuery.Encode()
+		return resp
+	}
+
+	if cachedNegativeAnswer(dnsQuery, question) {
+		channels.LogEventChannel <- channels.Event{
+			Type:    channels.Log,
+			Payload: fmt.Sprintf("Negative cache hit for %s\n", question.Name),
+		}
 		resp, _ := dnsQuery.Encode()
 		return resp
 	}
 
-	cachedRecord, found := cache.DnsCache.Get(dnsQuery.Questions.Name, dnsQuery.Questions.Type)
+	cachedRecord, found := cache.DnsCache.Get(question.Name, question.Type)
 	if found {
-		// update answer
-		cachedAnswer := &Answer{
-			encodedName,
-			dnsQuery.Questions.Type,
-			dnsQuery.Questions.Class,
-			uint32(time.Until(cachedRecord.ExpiresAt).Seconds()),
-			uint16(len(cachedRecord.Data)),
-			cachedRecord.Data,
-		}
-
-		dnsQuery.Answer = []*Answer{cachedAnswer}
-		dnsQuery.Header.ANCOUNT = 1
+		// replaying the whole RRset, with every TTL counted down since it was cached
+		for _, rr := range cachedRecord.Answers {
+			dnsQuery.Answer = append(dnsQuery.Answer, fromCacheRR(rr, cachedRecord.RemainingTTL(rr.TTL)))
+		}
+		if !wantsDNSSEC {
+			dnsQuery.Answer = withoutDNSSEC(dnsQuery.Answer, question.Type)
+		}
+		if cachedRecord.Secure && wantsAD {
+			dnsQuery.Header.FLAGS |= FlagAD
+		}
 		channels.LogEventChannel <- channels.Event{
 			Type:    channels.Log,
-			Payload: fmt.Sprintf("Cache hit for %s\n", dnsQuery.Questions.Name),
+			Payload: fmt.Sprintf("Cache hit for %s\n", question.Name),
 		}
 		resp, _ := dnsQuery.Encode()
 		return resp
@@ -81,90 +142,242 @@ func Lookup(dnsQuery *Query) []byte {
 
 	// update answer as per upstream
 
-	upstreamQuery, _ := (&Query{
-		Header: &Header{
-			ID:      dnsQuery.Header.ID,
-			FLAGS:   flags,
-			QDCOUNT: 1,
-			ANCOUNT: 0,
-			NSCOUNT: 0,
-			ARCOUNT: 0,
-		},
-		Questions: &Question{
-			Name:  dnsQuery.Questions.Name,
-			Type:  dnsQuery.Questions.Type,
-			Class: dnsQuery.Questions.Class,
-		},
-	}).Encode()
+	upstreamEdns := &OPT{UDPSize: MaxUDPSize}
+	if clientEdns != nil {
+		upstreamEdns.Flags = clientEdns.Flags & EdnsFlagDO
+	}
 
-	var upStreamServers = []string{config.Global.Upstream1, config.Global.Upstream2}
+	upstreamResp, upstream, err := resolveValidated(question, flags, upstreamEdns)
+	if errors.Is(err, errBogus) {
+		channels.LogEventChannel <- channels.Event{
+			Type:    channels.Error,
+			Payload: fmt.Sprintf("Bogus answer for %s via %s: %s\n", question.Name, upstream, err),
+		}
+		dnsQuery.setRCode(2) // SERVFAIL (RFC 4035 5.5)
+		resp, _ := dnsQuery.Encode()
+		return resp
+	}
+	if err != nil {
+		log.Printf("Error while fetching answer for %s [Record %d]: %s\n", question.Name, question.Type, err)
 
-	for _, upstream := range upStreamServers {
+		// an expired answer is better than none while upstream is unreachable
+		if cachedStaleAnswer(dnsQuery, question) {
+			channels.LogEventChannel <- channels.Event{
+				Type:    channels.Log,
+				Payload: fmt.Sprintf("Upstream unreachable, serving stale answer for %s\n", question.Name),
+			}
+			if !wantsDNSSEC {
+				dnsQuery.Answer = withoutDNSSEC(dnsQuery.Answer, question.Type)
+			}
+			go refreshStale(question)
+			resp, _ := dnsQuery.Encode()
+			return resp
+		}
 
-		conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.ParseIP(upstream), Port: 53})
+		dnsQuery.setRCode(2) // SERVFAIL
+		resp, _ := dnsQuery.Encode()
+		return resp
+	}
 
-		if err != nil {
-			log.Printf("Error %s\n", err)
-			continue
-		}
+	// updating RCODE
+	dnsQuery.setRCode(upstreamResp.RCode())
+
+	// forwarding every section as upstream sent it, e.g. NXDOMAIN carries the SOA in authority
+	dnsQuery.Answer = upstreamResp.Answer
+	dnsQuery.Authority = upstreamResp.Authority
+	dnsQuery.Additional = upstreamResp.Additional
+	if !wantsDNSSEC {
+		dnsQuery.Answer = withoutDNSSEC(dnsQuery.Answer, question.Type)
+		dnsQuery.Authority = withoutDNSSEC(dnsQuery.Authority, question.Type)
+		dnsQuery.Additional = withoutDNSSEC(dnsQuery.Additional, question.Type)
+	}
+	if upstreamResp.Header.FLAGS&FlagAD != 0 && wantsAD {
+		dnsQuery.Header.FLAGS |= FlagAD
+	}
+
+	channels.LogEventChannel <- channels.Event{
+		Type:    channels.Log,
+		Payload: fmt.Sprintf("Resolved %s via %s: %s\n", question.Name, upstream, describeAnswers(dnsQuery.Answer)),
+	}
+
+	if flags&FlagCD == 0 || !config.Global.DNSSEC {
+		// answers the client asked not to have checked stay out of the cache
+		go cacheResponse(question, upstreamResp)
+	}
 
-		_, err = conn.Write(upstreamQuery)
+	resp, _ := dnsQuery.Encode()
+	return resp
+}
+
+// resolveUpstream asks the configured upstreams, picked by the configured strategy,
+// and returns the first usable response along with the upstream that sent it
+func resolveUpstream(question *Question, flags uint16, edns *OPT) (*Query, string, error) {
+	upstreams := config.Global.Upstreams
+	if _, forwardUpstreams, found := config.ForwardUpstreams(question.Name); found {
+		// names under a forwarding rule only ever go to the upstreams of that rule
+		upstreams = forwardUpstreams
+	} else if config.Global.Recursive {
+		return resolveRecursive(question, edns)
+	}
+
+	var upStreamServers []upstream
+	for _, cfg := range upstreams {
+		u, err := upstreamFor(cfg, config.Global.Bootstrap)
 		if err != nil {
 			log.Printf("Error %s\n", err)
 			continue
 		}
+		upStreamServers = append(upStreamServers, u)
+	}
 
-		_ = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	// upstreams that are down are skipped until the health checker sees them answer again
+	upStreamServers = availableUpstreams(upStreamServers)
+
+	if config.Global.UpstreamStrategy == config.StrategyRace {
+		return raceUpstreams(upStreamServers, question, flags, edns)
+	}
 
-		buf := make([]byte, 512)
-		n, err := conn.Read(buf)
+	for _, upstream := range orderUpstreams(config.Global.UpstreamStrategy, upStreamServers) {
+		upstreamResp, err := queryUpstream(upstream, question, flags, edns)
 		if err != nil {
-			log.Printf("Error %s\n", err)
+			log.Printf("Error while fetching answer for %s [Record %d] via %s: %s\n", question.Name, question.Type, upstream, err)
 			continue
 		}
+		return upstreamResp, upstream.String(), nil
+	}
 
-		responseCode := uint16(buf[:n][3] & 0x0F) // get the last 4 bits of the 3rd byte
-		// updating RCODE
-		dnsQuery.Header.FLAGS = (dnsQuery.Header.FLAGS & 0xFFF0) | responseCode
+	return nil, "", errNoUpstream
+}
 
-		fmt.Println(responseCode)
+var errNoUpstream = errors.New("no upstream server could answer")
 
-		if responseCode == 2 || responseCode == 5 { // check for the Rcode first, before trying to parse answer
-			// case of server failure & refused
-			log.Printf("Received error response from upstream: %d", responseCode)
-			continue
-		} else if responseCode != 0 {
-			resp, _ := dnsQuery.Encode()
-			dnsQuery.Header.ANCOUNT = 0
-			return resp
-		}
+// resolveValidated resolves the question like resolveUpstream, validating the response with
+// DNSSEC if enabled. Secure responses come back with the AD bit set, bogus ones as errBogus.
+func resolveValidated(question *Question, flags uint16, edns *OPT) (*Query, string, error) {
+	validate := config.Global.DNSSEC && flags&FlagCD == 0
+	if config.Global.DNSSEC {
+		edns.Flags |= EdnsFlagDO
+	}
 
-		responses, err := decodeDnsAnswer(buf[:n])
-		if err != nil {
-			log.Printf("Error while fetching answer for %s [Record %d] via %s: %s\n", dnsQuery.Questions.Name, dnsQuery.Questions.Type, upstream, err)
-			continue
-		}
+	resp, upstream, err := resolveUpstream(question, flags, edns)
+	if err != nil {
+		return nil, upstream, err
+	}
+	resp.Header.FLAGS &^= FlagAD // only our own validation counts
 
-		if len(responses) > 0 {
-			// replacing the defaultAnswer with actual responses
-			dnsQuery.Answer = responses
+	if _, _, forwarded := config.ForwardUpstreams(question.Name); forwarded || !validate {
+		// zones behind forwarding rules are private ones, which can't be validated from the root
+		return resp, upstream, nil
+	}
 
-			// updating header to with actual number of answers
-			dnsQuery.Header.ANCOUNT = uint16(len(responses))
+	switch security, err := newValidator().validate(question, resp); security {
+	case bogus:
+		return nil, upstream, fmt.Errorf("%w: %s", errBogus, err)
+	case secure:
+		resp.Header.FLAGS |= FlagAD
+	}
+	return resp, upstream, nil
+}
 
-			// caching all the responses
-			for _, response := range responses {
-				go cache.DnsCache.Set(dnsQuery.Questions.Name, &cache.Record{
-					Type:      cache.RecordType(response.Type),
-					ExpiresAt: time.Now().Add(time.Duration(response.TTL) * time.Second),
-					Data:      response.Data,
-				})
-			}
-		}
+// queryUpstream sends the question to a single upstream, an answer saying it failed counts as an error
+func queryUpstream(upstream upstream, question *Question, flags uint16, edns *OPT) (*Query, error) {
+	// a fresh random ID, and name case with 0x20, for every query sent
+	name := question.Name
+	if config.Global.Use0x20 {
+		name = randomizeCase(name)
+	}
 
-		break
+	upstreamQuery, err := (&Query{
+		Header: &Header{
+			ID:    newQueryID(),
+			FLAGS: flags,
+		},
+		Questions: []*Question{{
+			Name:  name,
+			Type:  question.Type,
+			Class: question.Class,
+		}},
+		Edns: edns,
+	}).Encode()
+	if err != nil {
+		return nil, err
 	}
 
-	resp, _ := dnsQuery.Encode()
-	return resp
+	start := time.Now()
+	buf, err := upstream.exchange(upstreamQuery, int(edns.UDPSize), config.Global.Use0x20)
+	recordResult(upstream, time.Since(start), err == nil)
+	if err != nil {
+		return nil, err
+	}
+
+	upstreamResp, err := DecodeDNSQuery(buf)
+	if err != nil {
+		return nil, err
+	}
+	restoreCase(upstreamResp, name, question.Name)
+
+	responseCode := upstreamResp.RCode() // RCODE from the header, extended by the OPT record
+
+	if responseCode == 2 || responseCode == 5 { // check for the Rcode first, before using the answer
+		// case of server failure & refused
+		return nil, fmt.Errorf("received error response from upstream: %d", responseCode)
+	}
+
+	return upstreamResp, nil
+}
+
+// cacheResponse caches the answer, or the lack of one for NXDOMAIN and NODATA
+// to spare upstream from repeated queries
+func cacheResponse(question *Question, resp *Query) {
+	cacheNegativeAnswer(question, resp)
+
+	if resp.RCode() == 0 {
+		// caching the complete answer under the question
+		cacheAnswer(question, resp.Answer, resp.Header.FLAGS&FlagAD != 0)
+	}
+}
+
+// cacheAnswer stores the answer RRset, it expires along with its shortest lived record
+func cacheAnswer(question *Question, answers []*Answer, secure bool) {
+	if record := answerRecord(question.Type, answers, secure); record != nil {
+		cache.DnsCache.Set(question.Name, record)
+	}
+}
+
+// answerRecord turns the records into a cache entry, nil if they are not to be cached at all
+func answerRecord(qtype uint16, answers []*Answer, secure bool) *cache.Record {
+	if len(answers) == 0 {
+		return nil
+	}
+
+	record := &cache.Record{
+		Type:      cache.RecordType(qtype),
+		CreatedAt: time.Now(),
+		Secure:    secure,
+	}
+
+	ttl := answers[0].TTL
+	for _, answer := range answers {
+		ttl = min(ttl, answer.TTL)
+		record.Answers = append(record.Answers, toCacheRR(answer))
+	}
+	if ttl == 0 {
+		// zero TTL answers are only meant for the transaction at hand
+		return nil
+	}
+
+	record.ExpiresAt = record.CreatedAt.Add(time.Duration(ttl) * time.Second)
+	return record
+}
+
+// describeAnswers lists the records for the logs, one per line in zone file format
+func describeAnswers(answers []*Answer) string {
+	if len(answers) == 0 {
+		return "no records"
+	}
+	lines := make([]string, 0, len(answers))
+	for _, answer := range answers {
+		lines = append(lines, answer.String())
+	}
+	return strings.Join(lines, "\n")
 }
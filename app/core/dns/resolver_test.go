@@ -0,0 +1,84 @@
+package dns
+
+import (
+	"omamori/app/core/channels"
+	"omamori/app/core/config"
+	"omamori/app/core/internal/cache"
+	"omamori/app/core/internal/radix"
+	"testing"
+	"time"
+)
+
+func TestCacheAnswerReplaysRRset(t *testing.T) {
+	if config.BlockedSites == nil {
+		config.BlockedSites = radix.NewRadixTree()
+	}
+
+	question := &Question{Name: "www.rrset.test", Type: uint16(cache.RecordTypeA), Class: 1}
+	cname, err := newAnswer(question, 3600, &cache.CNAMERecord{Target: "web.rrset.test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	answers := []*Answer{cname}
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2"} {
+		a, err := newAnswer(&Question{Name: "web.rrset.test", Class: 1}, 300, &cache.ARecord{IPAddress: ip})
+		if err != nil {
+			t.Fatal(err)
+		}
+		answers = append(answers, a)
+	}
+	cacheAnswer(question, answers, false)
+
+	record, found := cache.DnsCache.Get(question.Name, question.Type)
+	if !found {
+		t.Fatal("answer not cached")
+	}
+	// the RRset goes along with its shortest lived record
+	if lifetime := record.ExpiresAt.Sub(record.CreatedAt); lifetime != 300*time.Second {
+		t.Errorf("cached for %s, want 5m0s", lifetime)
+	}
+
+	// as if it had been cached 100 seconds ago
+	record.CreatedAt = record.CreatedAt.Add(-100 * time.Second)
+	record.ExpiresAt = record.ExpiresAt.Add(-100 * time.Second)
+
+	query, err := (&Query{Header: &Header{ID: 7, FLAGS: 1 << 8}, Questions: []*Question{question}}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dnsQuery, err := DecodeDNSQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := DecodeDNSQuery(Lookup(dnsQuery))
+	<-channels.LogEventChannel // cache hit is logged
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.Answer) != len(answers) {
+		t.Fatalf("%d answers replayed, want %d", len(resp.Answer), len(answers))
+	}
+	for i, answer := range resp.Answer {
+		want := answers[i].TTL - 100
+		if answer.Name != answers[i].Name || answer.Type != answers[i].Type || string(answer.Data) != string(answers[i].Data) {
+			t.Errorf("answer %d is %s, want %s", i, answer, answers[i])
+		}
+		if answer.TTL != want && answer.TTL+1 != want {
+			t.Errorf("answer %d TTL %d, want %d", i, answer.TTL, want)
+		}
+	}
+}
+
+func TestCacheAnswerZeroTTL(t *testing.T) {
+	question := &Question{Name: "zero.rrset.test", Type: uint16(cache.RecordTypeA), Class: 1}
+	a, err := newAnswer(question, 0, &cache.ARecord{IPAddress: "192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheAnswer(question, []*Answer{a}, false)
+
+	if _, found := cache.DnsCache.Get(question.Name, question.Type); found {
+		t.Error("zero TTL answer cached")
+	}
+}
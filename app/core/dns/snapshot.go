@@ -0,0 +1,36 @@
+package dns
+
+import (
+	"log"
+	"omamori/app/core/config"
+	"omamori/app/core/internal/cache"
+	"os"
+	"path/filepath"
+)
+
+const cacheSnapshotFile = "cache.snapshot"
+
+func cacheSnapshotPath() string {
+	return filepath.Join(config.Global.ConfigDir, cacheSnapshotFile)
+}
+
+// SaveCache writes the cache to the snapshot file in the config dir
+func SaveCache() {
+	if err := cache.DnsCache.SaveSnapshot(cacheSnapshotPath()); err != nil {
+		log.Println("Failed to save cache snapshot:", err)
+	}
+}
+
+// LoadCache warms up the cache from the snapshot file in the config dir, if there is one
+func LoadCache() {
+	loaded, err := cache.DnsCache.LoadSnapshot(cacheSnapshotPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("Failed to load cache snapshot:", err)
+		}
+		return
+	}
+
+	// the UI isn't up yet to read the log channel
+	log.Printf("Loaded %d cache entries from the last run\n", loaded)
+}
@@ -0,0 +1,59 @@
+package dns
+
+import (
+	"omamori/app/core/internal/cache"
+	"sync"
+	"time"
+)
+
+// Serving expired answers while upstream can't be reached (RFC 8767)
+
+const (
+	staleTTL            = 30 // RFC 8767 4, TTL of stale answers
+	staleRefreshBackoff = 30 * time.Second
+)
+
+// names being refreshed in the background, with the time of the last attempt
+var staleRefreshes sync.Map
+
+// cachedStaleAnswer fills in the response from an expired cache entry, if there is one still within the stale window
+func cachedStaleAnswer(dnsQuery *Query, question *Question) bool {
+	record, found := cache.DnsCache.GetStale(question.Name, uint16(cache.RecordTypeNXDomain))
+	if !found {
+		record, found = cache.DnsCache.GetStale(question.Name, question.Type)
+		if !found {
+			return false
+		}
+	}
+
+	dnsQuery.setRCode(record.RCode)
+	dnsQuery.Answer = nil
+	dnsQuery.Authority = nil
+	for _, rr := range record.Answers {
+		dnsQuery.Answer = append(dnsQuery.Answer, fromCacheRR(rr, min(rr.TTL, staleTTL)))
+	}
+	for _, rr := range record.Authority {
+		dnsQuery.Authority = append(dnsQuery.Authority, fromCacheRR(rr, min(rr.TTL, staleTTL)))
+	}
+	return true
+}
+
+// refreshStale tries to replace a stale entry with a fresh one, without hammering an upstream that is down
+func refreshStale(question *Question) {
+	key := cache.NewCacheKey(question.Name, cache.RecordType(question.Type)).String()
+
+	now := time.Now()
+	if last, loaded := staleRefreshes.LoadOrStore(key, now); loaded {
+		if now.Sub(last.(time.Time)) < staleRefreshBackoff {
+			return
+		}
+		staleRefreshes.Store(key, now)
+	}
+
+	resp, _, err := resolveValidated(question, 1<<8, &OPT{UDPSize: MaxUDPSize})
+	if err != nil {
+		return
+	}
+	staleRefreshes.Delete(key)
+	cacheResponse(question, resp)
+}
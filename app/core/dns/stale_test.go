@@ -0,0 +1,49 @@
+package dns
+
+import (
+	"omamori/app/core/internal/cache"
+	"testing"
+	"time"
+)
+
+func TestCachedStaleAnswer(t *testing.T) {
+	cache.DnsCache.SetStaleWindow(24 * time.Hour)
+	defer cache.DnsCache.SetStaleWindow(0)
+
+	question := &Question{Name: "expired.stale.test", Type: uint16(cache.RecordTypeA), Class: 1}
+	answer, err := newAnswer(question, 3600, &cache.ARecord{IPAddress: "192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	short, err := newAnswer(question, 10, &cache.ARecord{IPAddress: "192.0.2.2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	cache.DnsCache.Set(question.Name, &cache.Record{
+		Type:      cache.RecordTypeA,
+		CreatedAt: now.Add(-2 * time.Hour),
+		ExpiresAt: now.Add(-time.Hour),
+		Answers:   []cache.RR{toCacheRR(answer), toCacheRR(short)},
+	})
+
+	resp := &Query{Header: &Header{FLAGS: 1 << 15}, Questions: []*Question{question}}
+	if !cachedStaleAnswer(resp, question) {
+		t.Fatal("no stale answer within the window")
+	}
+	if len(resp.Answer) != 2 || resp.RCode() != 0 {
+		t.Fatalf("RCODE %d with %d answers", resp.RCode(), len(resp.Answer))
+	}
+	// stale answers go out with a short TTL, never above what the record came with
+	for i, want := range []uint32{staleTTL, 10} {
+		if resp.Answer[i].TTL != want {
+			t.Errorf("answer %d TTL %d, want %d", i, resp.Answer[i].TTL, want)
+		}
+	}
+
+	missing := &Question{Name: "missing.stale.test", Type: uint16(cache.RecordTypeA), Class: 1}
+	if cachedStaleAnswer(&Query{Header: &Header{}}, missing) {
+		t.Error("stale answer for a name never cached")
+	}
+}
@@ -0,0 +1,99 @@
+package dns
+
+import (
+	"omamori/app/core/config"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	latencyWeight  = 0.3             // weight of the latest sample in the moving average
+	failureLatency = 2 * time.Second // what a failed query counts as, so broken upstreams sink to the bottom
+)
+
+var (
+	// latency of every upstream, as an exponentially weighted moving average
+	upstreamLatency = make(map[string]time.Duration)
+	latencyMutex    sync.Mutex
+
+	roundRobinNext atomic.Uint32
+)
+
+func recordLatency(u upstream, rtt time.Duration, ok bool) {
+	if !ok {
+		rtt = failureLatency
+	}
+
+	latencyMutex.Lock()
+	defer latencyMutex.Unlock()
+
+	average, measured := upstreamLatency[u.String()]
+	if !measured {
+		upstreamLatency[u.String()] = rtt
+		return
+	}
+	upstreamLatency[u.String()] = time.Duration(latencyWeight*float64(rtt) + (1-latencyWeight)*float64(average))
+}
+
+// orderUpstreams returns the upstreams in the order they should be tried for the strategy,
+// every one of them stays in the list to fall back to
+func orderUpstreams(strategy string, upstreams []upstream) []upstream {
+	if len(upstreams) < 2 {
+		return upstreams
+	}
+
+	ordered := make([]upstream, 0, len(upstreams))
+
+	switch strategy {
+	case config.StrategyRoundRobin:
+		first := int((roundRobinNext.Add(1) - 1) % uint32(len(upstreams)))
+		ordered = append(ordered, upstreams[first:]...)
+		ordered = append(ordered, upstreams[:first]...)
+
+	case config.StrategyLowestLatency:
+		latencyMutex.Lock()
+		latency := make(map[upstream]time.Duration, len(upstreams))
+		for _, u := range upstreams {
+			latency[u] = upstreamLatency[u.String()] // not measured yet counts as fastest, so it gets measured
+		}
+		latencyMutex.Unlock()
+
+		ordered = append(ordered, upstreams...)
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return latency[ordered[i]] < latency[ordered[j]]
+		})
+
+	default: // failover
+		ordered = append(ordered, upstreams...)
+	}
+
+	return ordered
+}
+
+type raceResult struct {
+	resp     *Query
+	upstream upstream
+	err      error
+}
+
+// raceUpstreams asks every upstream at once and takes the first usable answer
+func raceUpstreams(upstreams []upstream, question *Question, flags uint16, edns *OPT) (*Query, string, error) {
+	// buffered, so the slower upstreams don't block once the race is over
+	results := make(chan raceResult, len(upstreams))
+	for _, u := range upstreams {
+		go func(u upstream) {
+			resp, err := queryUpstream(u, question, flags, edns)
+			results <- raceResult{resp, u, err}
+		}(u)
+	}
+
+	for range upstreams {
+		result := <-results
+		if result.err == nil {
+			return result.resp, result.upstream.String(), nil
+		}
+	}
+	return nil, "", errNoUpstream
+}
@@ -0,0 +1,35 @@
+package dns
+
+import (
+	"math"
+	"omamori/app/core/config"
+	"testing"
+)
+
+func TestOrderUpstreamsRoundRobinWraps(t *testing.T) {
+	upstreams := []upstream{
+		&plainUpstream{addr: "192.0.2.1:53"},
+		&plainUpstream{addr: "192.0.2.2:53"},
+		&plainUpstream{addr: "192.0.2.3:53"},
+	}
+
+	// the counter wrapping around must not turn into a negative index on 32-bit platforms
+	roundRobinNext.Store(math.MaxUint32 - 1)
+	t.Cleanup(func() { roundRobinNext.Store(0) })
+
+	want := []int{
+		(math.MaxUint32 - 1) % 3,
+		math.MaxUint32 % 3,
+		0,
+		1,
+	}
+	for i, first := range want {
+		ordered := orderUpstreams(config.StrategyRoundRobin, upstreams)
+		if len(ordered) != len(upstreams) {
+			t.Fatalf("round %d: got %d upstreams, want %d", i, len(ordered), len(upstreams))
+		}
+		if ordered[0] != upstreams[first] {
+			t.Errorf("round %d: first upstream %s, want %s", i, ordered[0], upstreams[first])
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Messages sent over TCP are prefixed with a two byte length field (RFC 1035 4.2.2, RFC 7766 8)
+
+func ReadTCPMessage(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint16(length[:])
+	if size < 12 {
+		return nil, errors.New("malformed DNS message length")
+	}
+
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func WriteTCPMessage(w io.Writer, msg []byte) error {
+	if len(msg) > 0xFFFF {
+		return errors.New("DNS message too long")
+	}
+
+	// writing length and message in one go, so it doesn't get split into multiple segments
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+
+	_, err := w.Write(buf)
+	return err
+}
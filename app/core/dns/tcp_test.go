@@ -0,0 +1,69 @@
+package dns
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestTCPMessageFraming(t *testing.T) {
+	first, second := bytes.Repeat([]byte{1}, 12), bytes.Repeat([]byte{2}, 300)
+
+	var stream bytes.Buffer
+	for _, msg := range [][]byte{first, second} {
+		if err := WriteTCPMessage(&stream, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := stream.Bytes()[:2]; !bytes.Equal(got, []byte{0, 12}) {
+		t.Errorf("length prefix % x, want 00 0c", got)
+	}
+
+	// messages follow each other on the stream, each read takes exactly one
+	for _, want := range [][]byte{first, second} {
+		msg, err := ReadTCPMessage(&stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(msg, want) {
+			t.Errorf("read %d bytes, want %d", len(msg), len(want))
+		}
+	}
+	if _, err := ReadTCPMessage(&stream); err != io.EOF {
+		t.Errorf("read past the last message: %v, want EOF", err)
+	}
+}
+
+func TestReadTCPMessageErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream []byte
+		want   error
+	}{
+		{"half a length", []byte{0}, io.ErrUnexpectedEOF},
+		{"message cut short", append([]byte{0, 20}, make([]byte, 12)...), io.ErrUnexpectedEOF},
+		{"shorter than a header", append([]byte{0, 11}, make([]byte, 11)...), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadTCPMessage(bytes.NewReader(tt.stream))
+			if err == nil {
+				t.Fatal("no error")
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("error %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteTCPMessageTooLong(t *testing.T) {
+	var stream bytes.Buffer
+	if err := WriteTCPMessage(&stream, make([]byte, 0x10000)); err == nil {
+		t.Error("wrote a message longer than the length field allows")
+	}
+	if stream.Len() != 0 {
+		t.Errorf("%d bytes written for a message that was refused", stream.Len())
+	}
+}
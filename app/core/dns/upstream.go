@@ -0,0 +1,269 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"omamori/app/core/config"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	udpUpstreamTimeout = 100 * time.Millisecond
+	tcpUpstreamTimeout = 1 * time.Second
+)
+
+// upstream is a server queries are forwarded to, over whichever transport it speaks
+type upstream interface {
+	// exchange sends the query and returns the reply, only a reply matching the query is returned, see matchesQuery
+	exchange(query []byte, udpSize int, exactCase bool) ([]byte, error)
+
+	String() string
+}
+
+// closingUpstream is an upstream holding connections open, which have to be closed once it is dropped
+type closingUpstream interface {
+	upstream
+	close()
+}
+
+// upstreams are kept around, so transports holding connections can reuse them
+var (
+	upstreams      = make(map[string]upstream)
+	upstreamsMutex sync.Mutex
+)
+
+func upstreamKey(cfg config.UpstreamConfig, bootstrap string) string {
+	return fmt.Sprintf("%+v %s", cfg, bootstrap)
+}
+
+// configuredUpstreams returns the default upstreams followed by those of every forwarding rule
+func configuredUpstreams() []config.UpstreamConfig {
+	configured := config.Global.Upstreams
+	for _, rule := range config.Global.ForwardRules {
+		configured = append(configured[:len(configured):len(configured)], rule.Upstreams...)
+	}
+	return configured
+}
+
+// upstreamFor returns the upstream for an entry of the config
+func upstreamFor(cfg config.UpstreamConfig, bootstrap string) (upstream, error) {
+	upstreamsMutex.Lock()
+	defer upstreamsMutex.Unlock()
+
+	key := upstreamKey(cfg, bootstrap)
+	if u, found := upstreams[key]; found {
+		return u, nil
+	}
+
+	timeout := time.Duration(cfg.Timeout) * time.Millisecond
+
+	var u upstream
+	var err error
+	switch cfg.Transport {
+	case config.TransportUDP, config.TransportTCP:
+		if net.ParseIP(cfg.Address) == nil {
+			return nil, fmt.Errorf("upstream %q is not an IP address", cfg.Address)
+		}
+		u = &plainUpstream{
+			addr:    net.JoinHostPort(cfg.Address, portOrDefault(cfg.Port, 53)),
+			tcp:     cfg.Transport == config.TransportTCP,
+			timeout: timeout,
+		}
+	case config.TransportTLS:
+		address := cfg.Address
+		if !strings.HasPrefix(address, "tls://") {
+			address = "tls://" + net.JoinHostPort(address, portOrDefault(cfg.Port, 853))
+		}
+		u, err = newDotUpstream(address, bootstrap, timeout)
+	case config.TransportHTTPS:
+		address := cfg.Address
+		if !strings.HasPrefix(address, "https://") {
+			address = "https://" + net.JoinHostPort(address, portOrDefault(cfg.Port, 443)) + "/dns-query"
+		}
+		u, err = newDohUpstream(address, bootstrap, timeout)
+	default:
+		return nil, fmt.Errorf("unsupported transport %q", cfg.Transport)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	upstreams[key] = u
+	return u, nil
+}
+
+// PruneUpstreams drops the upstreams the config no longer mentions, closing their connections
+// along with the goroutines reading from them, and forgets their health and latency.
+// Called after the config was updated
+func PruneUpstreams() {
+	inUse := make(map[string]bool)
+	for _, cfg := range configuredUpstreams() {
+		inUse[upstreamKey(cfg, config.Global.Bootstrap)] = true
+	}
+
+	upstreamsMutex.Lock()
+	var dropped []upstream
+	addresses := make(map[string]bool)
+	for key, u := range upstreams {
+		if inUse[key] {
+			addresses[u.String()] = true
+			continue
+		}
+		delete(upstreams, key)
+		dropped = append(dropped, u)
+	}
+	upstreamsMutex.Unlock()
+
+	for _, u := range dropped {
+		if c, ok := u.(closingUpstream); ok {
+			c.close()
+		}
+		if addresses[u.String()] {
+			// the same server is still configured, e.g. with another timeout
+			continue
+		}
+
+		healthMutex.Lock()
+		delete(health, u.String())
+		healthMutex.Unlock()
+
+		latencyMutex.Lock()
+		delete(upstreamLatency, u.String())
+		latencyMutex.Unlock()
+	}
+}
+
+func orDefault(timeout time.Duration, defaultTimeout time.Duration) time.Duration {
+	if timeout == 0 {
+		return defaultTimeout
+	}
+	return timeout
+}
+
+func portOrDefault(port int, defaultPort int) string {
+	if port == 0 {
+		port = defaultPort
+	}
+	return strconv.Itoa(port)
+}
+
+// newBootstrapDialer returns a dialer for connecting to host. The system resolver is most likely us,
+// so a hostname is looked up through the bootstrap server instead.
+func newBootstrapDialer(host string, bootstrap string, timeout time.Duration) (*net.Dialer, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	if net.ParseIP(host) != nil {
+		return dialer, nil
+	}
+
+	if net.ParseIP(bootstrap) == nil {
+		return nil, fmt.Errorf("a bootstrap IP is needed to resolve %s", host)
+	}
+	dialer.Resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			d := net.Dialer{Timeout: timeout}
+			return d.DialContext(ctx, network, net.JoinHostPort(bootstrap, "53"))
+		},
+	}
+	return dialer, nil
+}
+
+// plainUpstream speaks DNS over UDP and TCP, on port 53 unless configured otherwise
+type plainUpstream struct {
+	addr    string
+	tcp     bool          // skipping UDP altogether
+	timeout time.Duration // 0 for the defaults
+}
+
+func (u *plainUpstream) String() string {
+	return u.addr
+}
+
+// exchange sends the query over UDP, retrying over TCP if the reply comes back truncated
+func (u *plainUpstream) exchange(query []byte, udpSize int, exactCase bool) ([]byte, error) {
+	if u.tcp {
+		return exchangeTCP(u.addr, query, exactCase, orDefault(u.timeout, tcpUpstreamTimeout))
+	}
+
+	resp, err := exchangeUDP(u.addr, query, udpSize, exactCase, orDefault(u.timeout, udpUpstreamTimeout))
+	if err != nil {
+		return nil, err
+	}
+
+	if isTruncated(resp) {
+		log.Printf("Truncated response from %s, retrying over TCP\n", u.addr)
+		return exchangeTCP(u.addr, query, exactCase, orDefault(u.timeout, tcpUpstreamTimeout))
+	}
+	return resp, nil
+}
+
+// exchangeUDP reads the reply into a buffer of the payload size advertised in the query,
+// datagrams not matching the query are dropped and the real reply is waited for
+func exchangeUDP(upstream string, query []byte, udpSize int, exactCase bool, timeout time.Duration) ([]byte, error) {
+	conn, err := net.Dial("udp", upstream)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	if _, err = conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+
+	buf := make([]byte, udpSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n < 12 {
+			return nil, errors.New("short DNS response")
+		}
+		if matchesQuery(query, buf[:n], exactCase) {
+			return buf[:n], nil
+		}
+		discardMismatch(upstream)
+	}
+}
+
+func exchangeTCP(upstream string, query []byte, exactCase bool, timeout time.Duration) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", upstream, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	if err = WriteTCPMessage(conn, query); err != nil {
+		return nil, err
+	}
+
+	resp, err := ReadTCPMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+	if !matchesQuery(query, resp, exactCase) {
+		discardMismatch(upstream)
+		return nil, errors.New("response does not match the query")
+	}
+	return resp, nil
+}
+
+// isTruncated checks the TC bit (bit 9) of the header flags
+func isTruncated(msg []byte) bool {
+	return len(msg) >= 12 && binary.BigEndian.Uint16(msg[2:4])&(1<<9) != 0
+}
@@ -0,0 +1,123 @@
+package dns
+
+import (
+	"bytes"
+	"net"
+	"omamori/app/core/config"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// startTruncatingUpstream answers over UDP with TC set and no records, and with the full response over TCP
+func startTruncatingUpstream(t *testing.T, ip string, full []byte) {
+	t.Helper()
+	udpConn, err := net.ListenPacket("udp4", net.JoinHostPort(ip, "53"))
+	if err != nil {
+		t.Skip("can't bind a loopback address on port 53:", err)
+	}
+	tcpListener, err := net.Listen("tcp4", net.JoinHostPort(ip, "53"))
+	if err != nil {
+		_ = udpConn.Close()
+		t.Skip("can't bind a loopback address on port 53:", err)
+	}
+	t.Cleanup(func() {
+		_ = udpConn.Close()
+		_ = tcpListener.Close()
+	})
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := udpConn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = udpConn.WriteTo(Truncate(full, n), addr) // anything longer than the query is cut
+		}
+	}()
+	go func() {
+		for {
+			conn, err := tcpListener.Accept()
+			if err != nil {
+				return
+			}
+			if _, err := ReadTCPMessage(conn); err == nil {
+				_ = WriteTCPMessage(conn, full)
+			}
+			_ = conn.Close()
+		}
+	}()
+}
+
+func TestExchangeRetriesTruncatedOverTCP(t *testing.T) {
+	full := testMessage("example.com", 40)
+	startTruncatingUpstream(t, "127.0.0.21", full)
+
+	resp, err := (&plainUpstream{addr: "127.0.0.21:53"}).exchange(testMessage("example.com", 0), DefaultUDPSize, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(resp, full) {
+		t.Errorf("got %d bytes, want the %d of the full response over TCP", len(resp), len(full))
+	}
+}
+
+func TestPruneUpstreams(t *testing.T) {
+	saved := *config.Global
+	t.Cleanup(func() { *config.Global = saved })
+
+	cert := selfSignedCert(t)
+	host, port, _ := net.SplitHostPort(startDotStandIn(t, cert))
+	dotPort, _ := strconv.Atoi(port)
+
+	removed := config.UpstreamConfig{
+		Address:   "tls://" + net.JoinHostPort(host, port) + "#" + spkiPin(t, cert),
+		Transport: config.TransportTLS,
+	}
+	kept := config.UpstreamConfig{Address: "192.0.2.1", Transport: config.TransportUDP}
+	forwarded := config.UpstreamConfig{Address: host, Transport: config.TransportTLS, Port: dotPort, Timeout: 500}
+
+	config.Global.Upstreams = []config.UpstreamConfig{removed, kept}
+	config.Global.ForwardRules = []config.ForwardRule{{Domain: "corp.internal", Upstreams: []config.UpstreamConfig{forwarded}}}
+
+	u, err := upstreamFor(removed, config.Global.Bootstrap)
+	if err != nil {
+		t.Fatalf("upstreamFor: %v", err)
+	}
+	if _, err := u.exchange(testQuery(t, 1, "example.com", 1), 0, true); err != nil {
+		t.Fatalf("exchange: %v", err)
+	}
+	dot := u.(*dotUpstream)
+	conn := dot.conn
+	for _, cfg := range []config.UpstreamConfig{kept, forwarded} {
+		if _, err := upstreamFor(cfg, config.Global.Bootstrap); err != nil {
+			t.Fatalf("upstreamFor: %v", err)
+		}
+	}
+
+	config.Global.Upstreams = []config.UpstreamConfig{kept}
+	PruneUpstreams()
+
+	upstreamsMutex.Lock()
+	_, removedFound := upstreams[upstreamKey(removed, config.Global.Bootstrap)]
+	_, keptFound := upstreams[upstreamKey(kept, config.Global.Bootstrap)]
+	_, forwardedFound := upstreams[upstreamKey(forwarded, config.Global.Bootstrap)]
+	upstreamsMutex.Unlock()
+
+	if removedFound {
+		t.Error("removed upstream is still cached")
+	}
+	if !keptFound || !forwardedFound {
+		t.Error("configured upstreams were dropped")
+	}
+
+	select {
+	case <-conn.closed:
+	case <-time.After(time.Second):
+		t.Error("connection of the removed upstream was left open")
+	}
+	if _, err := dot.exchange(testQuery(t, 2, "example.com", 1), 0, true); err == nil {
+		t.Error("removed upstream dialed a new connection")
+	}
+}
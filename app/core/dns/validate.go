@@ -0,0 +1,113 @@
+package dns
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"omamori/app/core/channels"
+	"strings"
+	"sync/atomic"
+)
+
+// Guarding against spoofed upstream responses (RFC 5452): every query gets an unpredictable ID,
+// and only a response echoing that ID along with the exact question is accepted
+
+// responses discarded because they didn't match the query they were supposedly answering
+var mismatchedResponses atomic.Uint64
+
+func newQueryID() uint16 {
+	var b [2]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err) // crypto/rand doesn't fail on supported platforms
+	}
+	return binary.BigEndian.Uint16(b[:])
+}
+
+// randomizeCase flips the case of the letters in the name at random, upstream echoes the question
+// as is, which adds a bit of entropy per letter an attacker has to guess (draft-vixie-dnsext-dns0x20)
+func randomizeCase(name string) string {
+	random := make([]byte, len(name))
+	if _, err := rand.Read(random); err != nil {
+		panic(err)
+	}
+
+	b := []byte(name)
+	for i, c := range b {
+		if random[i]&1 == 0 {
+			continue
+		}
+		switch {
+		case 'a' <= c && c <= 'z':
+			b[i] = c - 'a' + 'A'
+		case 'A' <= c && c <= 'Z':
+			b[i] = c - 'A' + 'a'
+		}
+	}
+	return string(b)
+}
+
+// matchesQuery checks the response answers the query: same ID, QR set and the same question.
+// With exactCase the name has to come back byte for byte, as needed for 0x20.
+func matchesQuery(query []byte, resp []byte, exactCase bool) bool {
+	if len(query) < 12 || len(resp) < 12 {
+		return false
+	}
+	if binary.BigEndian.Uint16(query[0:2]) != binary.BigEndian.Uint16(resp[0:2]) {
+		return false
+	}
+	if binary.BigEndian.Uint16(resp[2:4])&(1<<15) == 0 {
+		return false // not a response
+	}
+	if binary.BigEndian.Uint16(resp[4:6]) != 1 {
+		return false
+	}
+
+	sent, _, err := decodeDNSQuestion(query, 12)
+	if err != nil {
+		return false
+	}
+	received, _, err := decodeDNSQuestion(resp, 12)
+	if err != nil {
+		return false
+	}
+
+	if sent.Type != received.Type || sent.Class != received.Class {
+		return false
+	}
+	if exactCase {
+		return sent.Name == received.Name
+	}
+	return strings.EqualFold(sent.Name, received.Name)
+}
+
+// discardMismatch counts the dropped response, logging it only if the UI keeps up,
+// as a flood of spoofed datagrams must not stall the exchange waiting for the real reply
+func discardMismatch(upstream string) {
+	count := mismatchedResponses.Add(1)
+	select {
+	case channels.LogEventChannel <- channels.Event{
+		Type:    channels.Log,
+		Payload: fmt.Sprintf("Discarded a response from %s not matching the query (%d so far)\n", upstream, count),
+	}:
+	default:
+	}
+}
+
+// restoreCase puts back the name as the client asked for it, where upstream echoed the randomized one
+func restoreCase(resp *Query, sent string, name string) {
+	if sent == name {
+		return
+	}
+	for _, q := range resp.Questions {
+		if q.Name == sent {
+			q.Name = name
+		}
+	}
+	for _, section := range [][]*Answer{resp.Answer, resp.Authority, resp.Additional} {
+		for _, rr := range section {
+			if rr.Name == sent {
+				rr.Name = name
+			}
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package dns
+
+import (
+	"omamori/app/core/channels"
+	"strings"
+	"testing"
+	"time"
+)
+
+func encodeTestQuery(t *testing.T, id uint16, flags uint16, questions ...*Question) []byte {
+	t.Helper()
+	msg, err := (&Query{Header: &Header{ID: id, FLAGS: flags}, Questions: questions}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestMatchesQuery(t *testing.T) {
+	question := &Question{Name: "wWw.ExAmple.com", Type: 1, Class: 1}
+	query := encodeTestQuery(t, 0x1234, 1<<8, question)
+
+	folded := &Question{Name: "www.example.com", Type: 1, Class: 1}
+	tests := []struct {
+		name      string
+		resp      []byte
+		exactCase bool
+		want      bool
+	}{
+		{"exact echo", encodeTestQuery(t, 0x1234, 1<<15, question), true, true},
+		{"other ID", encodeTestQuery(t, 0x1235, 1<<15, question), true, false},
+		{"QR not set", encodeTestQuery(t, 0x1234, 0, question), true, false},
+		{"no question", encodeTestQuery(t, 0x1234, 1<<15), true, false},
+		{"two questions", encodeTestQuery(t, 0x1234, 1<<15, question, question), true, false},
+		{"other type", encodeTestQuery(t, 0x1234, 1<<15, &Question{Name: question.Name, Type: 28, Class: 1}), true, false},
+		{"other class", encodeTestQuery(t, 0x1234, 1<<15, &Question{Name: question.Name, Type: 1, Class: 3}), true, false},
+		{"other name", encodeTestQuery(t, 0x1234, 1<<15, &Question{Name: "example.com", Type: 1, Class: 1}), false, false},
+		{"case changed, exact", encodeTestQuery(t, 0x1234, 1<<15, folded), true, false},
+		{"case changed, folded", encodeTestQuery(t, 0x1234, 1<<15, folded), false, true},
+		{"shorter than a header", []byte{0x12, 0x34, 0x80}, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchesQuery(query, tt.resp, tt.exactCase); got != tt.want {
+				t.Errorf("matchesQuery = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRandomizeCase(t *testing.T) {
+	name := "www.example-0x20.com"
+
+	flipped := false
+	for i := 0; i < 20; i++ {
+		randomized := randomizeCase(name)
+		if !strings.EqualFold(randomized, name) {
+			t.Fatalf("randomizeCase(%q) = %q, not the same name", name, randomized)
+		}
+		for j := range name {
+			if (name[j] < 'a' || name[j] > 'z') && randomized[j] != name[j] {
+				t.Fatalf("randomizeCase(%q) = %q, changed a character that isn't a letter", name, randomized)
+			}
+		}
+		flipped = flipped || randomized != name
+	}
+	// 16 letters each flipped by a coin toss, 20 times over
+	if !flipped {
+		t.Error("case never changed")
+	}
+}
+
+func TestRestoreCase(t *testing.T) {
+	sent := "WwW.eXample.COM"
+	resp := &Query{
+		Header:     &Header{},
+		Questions:  []*Question{{Name: sent, Type: 1, Class: 1}},
+		Answer:     []*Answer{{Name: sent, Type: 5}, {Name: "cdn.example.net", Type: 1}},
+		Authority:  []*Answer{{Name: "example.com", Type: 6}},
+		Additional: []*Answer{{Name: sent, Type: 1}},
+	}
+	restoreCase(resp, sent, "www.example.com")
+
+	for _, name := range []string{resp.Questions[0].Name, resp.Answer[0].Name, resp.Additional[0].Name} {
+		if name != "www.example.com" {
+			t.Errorf("name %q left as upstream echoed it", name)
+		}
+	}
+	if resp.Answer[1].Name != "cdn.example.net" || resp.Authority[0].Name != "example.com" {
+		t.Errorf("other names changed: %q, %q", resp.Answer[1].Name, resp.Authority[0].Name)
+	}
+}
+
+func TestDiscardMismatchDoesNotBlock(t *testing.T) {
+	// nobody reads the log channel, as when the UI falls behind
+	for len(channels.LogEventChannel) < cap(channels.LogEventChannel) {
+		channels.LogEventChannel <- channels.Event{Type: channels.Log}
+	}
+	defer func() {
+		for len(channels.LogEventChannel) > 0 {
+			<-channels.LogEventChannel
+		}
+	}()
+
+	before := mismatchedResponses.Load()
+	done := make(chan struct{})
+	go func() {
+		discardMismatch("192.0.2.1")
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("blocked on a full log channel")
+	}
+	if count := mismatchedResponses.Load(); count != before+1 {
+		t.Errorf("counted %d mismatches, want 1", count-before)
+	}
+}
@@ -0,0 +1,569 @@
+package dns
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"omamori/app/core/config"
+	"omamori/app/core/internal/cache"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DNSSEC validation, building the chain of trust from the trust anchors down to the answer (RFC 4035 5)
+
+const (
+	maxTrustTTL        = time.Hour // how long verified keys, or a zone proven unsigned, are remembered
+	maxValidationDepth = 16        // zones walked up while following signers
+	maxTrustedZones    = 4096      // zones remembered, expired ones are swept out first when full
+)
+
+type security int
+
+const (
+	insecure security = iota // no chain of trust, a zone on the way is provably unsigned
+	secure
+	bogus
+)
+
+var errBogus = errors.New("DNSSEC validation failed")
+
+// The root KSKs, as published at https://data.iana.org/root-anchors/root-anchors.xml
+const defaultTrustAnchors = `; DNSSEC trust anchors, as DS records in zone file format
+.	IN	DS	20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D
+.	IN	DS	38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16
+`
+
+// zoneTrust is what validation found out about a zone
+type zoneTrust struct {
+	keys     []*dnskey // verified keys of a signed zone
+	unsigned bool      // provably unsigned delegation, everything below is insecure
+	notZone  bool      // no zone cut at this name, it lies within its parent zone
+	expires  time.Time
+}
+
+var (
+	trustAnchors = make(map[string][]*dsRecord)
+	trustedZones = make(map[string]*zoneTrust)
+	trustMutex   sync.Mutex
+)
+
+// LoadTrustAnchors reads the trust anchor file from the config directory, writing
+// the root anchors to it first if it doesn't exist yet
+func LoadTrustAnchors() error {
+	path := config.Global.TrustAnchorFile
+	if _, err := os.Stat(path); err != nil {
+		if err = os.WriteFile(path, []byte(defaultTrustAnchors), 0600); err != nil {
+			return err
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	anchors := make(map[string][]*dsRecord)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, ";") {
+			continue
+		}
+		owner, ds, err := parseTrustAnchor(line)
+		if err != nil {
+			log.Printf("Ignoring trust anchor on line %d: %s\n", i+1, err)
+			continue
+		}
+		anchors[owner] = append(anchors[owner], ds)
+	}
+	if len(anchors) == 0 {
+		return fmt.Errorf("no trust anchors in %s", path)
+	}
+
+	trustMutex.Lock()
+	trustAnchors = anchors
+	trustedZones = make(map[string]*zoneTrust) // whatever was verified with the old anchors
+	trustMutex.Unlock()
+	return nil
+}
+
+// parseTrustAnchor reads a line like ". IN DS 20326 8 2 E06D...", TTL and class being optional
+func parseTrustAnchor(line string) (string, *dsRecord, error) {
+	fields := strings.Fields(line)
+	for i, field := range fields {
+		if !strings.EqualFold(field, "DS") {
+			continue
+		}
+		if i == 0 || len(fields) < i+5 {
+			break
+		}
+		keyTag, errTag := strconv.ParseUint(fields[i+1], 10, 16)
+		algorithm, errAlg := strconv.ParseUint(fields[i+2], 10, 8)
+		digestType, errDigest := strconv.ParseUint(fields[i+3], 10, 8)
+		digest, errHex := hex.DecodeString(strings.Join(fields[i+4:], ""))
+		if err := errors.Join(errTag, errAlg, errDigest, errHex); err != nil {
+			return "", nil, err
+		}
+		owner := strings.ToLower(strings.TrimSuffix(fields[0], "."))
+		return owner, &dsRecord{
+			keyTag:     uint16(keyTag),
+			algorithm:  uint8(algorithm),
+			digestType: uint8(digestType),
+			digest:     digest,
+		}, nil
+	}
+	return "", nil, errors.New("not a DS record")
+}
+
+func cachedTrust(zone string) *zoneTrust {
+	trustMutex.Lock()
+	defer trustMutex.Unlock()
+	trust, found := trustedZones[zone]
+	if !found {
+		return nil
+	}
+	if time.Now().After(trust.expires) {
+		delete(trustedZones, zone)
+		return nil
+	}
+	return trust
+}
+
+func storeTrust(zone string, trust *zoneTrust, ttl uint32) *zoneTrust {
+	now := time.Now()
+	trust.expires = now.Add(min(time.Duration(ttl)*time.Second, maxTrustTTL))
+	trustMutex.Lock()
+	defer trustMutex.Unlock()
+	if _, found := trustedZones[zone]; !found && len(trustedZones) >= maxTrustedZones {
+		evictTrust(now)
+	}
+	trustedZones[zone] = trust
+	return trust
+}
+
+// evictTrust makes room in the full map of zones, sweeping out the expired ones or,
+// when none are, an arbitrary quarter of them to be verified again when next needed
+func evictTrust(now time.Time) {
+	for zone, trust := range trustedZones {
+		if now.After(trust.expires) {
+			delete(trustedZones, zone)
+		}
+	}
+	for zone := range trustedZones {
+		if len(trustedZones) < maxTrustedZones*3/4 {
+			break
+		}
+		delete(trustedZones, zone)
+	}
+}
+
+func anchorsFor(zone string) []*dsRecord {
+	trustMutex.Lock()
+	defer trustMutex.Unlock()
+	return trustAnchors[zone]
+}
+
+// rrset is the records sharing owner and type, along with the signatures over them
+type rrset struct {
+	records []*Answer
+	sigs    []*rrsig
+}
+
+func (set *rrset) owner() string {
+	return strings.ToLower(set.records[0].Name)
+}
+
+// groupRRsets splits a section into its RRsets, in the order they first appear
+func groupRRsets(section []*Answer) []*rrset {
+	var sets []*rrset
+	byKey := make(map[string]*rrset)
+	key := func(name string, recordType uint16) string {
+		return fmt.Sprintf("%s %d", strings.ToLower(name), recordType)
+	}
+
+	for _, rr := range section {
+		if cache.RecordType(rr.Type) == cache.RecordTypeRRSIG {
+			continue
+		}
+		k := key(rr.Name, rr.Type)
+		if set, found := byKey[k]; found {
+			set.records = append(set.records, rr)
+			continue
+		}
+		set := &rrset{records: []*Answer{rr}}
+		byKey[k] = set
+		sets = append(sets, set)
+	}
+
+	for _, rr := range section {
+		if cache.RecordType(rr.Type) != cache.RecordTypeRRSIG {
+			continue
+		}
+		sig, err := parseRRSIG(rr.Data)
+		if err != nil {
+			continue
+		}
+		if set, found := byKey[key(rr.Name, sig.typeCovered)]; found {
+			set.sigs = append(set.sigs, sig)
+		}
+	}
+	return sets
+}
+
+// validator fetches the keys and delegation records it needs through fetch
+type validator struct {
+	fetch func(name string, qtype uint16) (*Query, error)
+	now   time.Time
+	depth int
+}
+
+func newValidator() *validator {
+	return &validator{fetch: fetchForValidation, now: time.Now()}
+}
+
+// fetchForValidation asks the upstreams, or the authoritative servers when recursive,
+// for the records with their signatures, without having them validated upstream
+func fetchForValidation(name string, qtype uint16) (*Query, error) {
+	question := &Question{Name: name, Type: qtype, Class: 1}
+	resp, _, err := resolveUpstream(question, 1<<8|FlagCD, &OPT{UDPSize: MaxUDPSize, Flags: EdnsFlagDO})
+	return resp, err
+}
+
+// validate checks every RRset of the answer and authority sections, and that negative
+// answers come with a proof of the denial when the zone is signed
+func (v *validator) validate(question *Question, resp *Query) (security, error) {
+	result := secure
+	downgrade := func(s security) {
+		if s == insecure {
+			result = insecure
+		}
+	}
+
+	for _, set := range groupRRsets(resp.Answer) {
+		s, sig, err := v.verifyRRset(set)
+		if s == bogus {
+			return bogus, fmt.Errorf("%s %s: %w", set.owner(), cache.RecordType(set.records[0].Type), err)
+		}
+		if s == secure && sig.labels < uint8(len(splitDomainName(set.owner()))) {
+			// expanded from a wildcard, the name itself must be shown not to exist (RFC 4035 5.3.4)
+			if err := provesWildcardAnswer(resp.Authority, set.owner(), sig.labels); err != nil {
+				return bogus, fmt.Errorf("%s: wildcard answer: %w", set.owner(), err)
+			}
+		}
+		downgrade(s)
+	}
+
+	for _, set := range groupRRsets(resp.Authority) {
+		if cache.RecordType(set.records[0].Type) == cache.RecordTypeNS {
+			continue // delegations are signed in the child zone only
+		}
+		s, _, err := v.verifyRRset(set)
+		if s == bogus {
+			return bogus, fmt.Errorf("%s %s: %w", set.owner(), cache.RecordType(set.records[0].Type), err)
+		}
+		downgrade(s)
+	}
+
+	rcode := resp.RCode()
+	name, found := chainEnd(resp.Answer, question.Name, question.Type)
+	if rcode != 3 && (rcode != 0 || found) {
+		return result, nil
+	}
+
+	// negative answer, which needs to be proven in a signed zone
+	nsecs, nsec3s := denialRecords(resp.Authority)
+	if len(nsecs) == 0 && len(nsec3s) == 0 {
+		s, err := v.unsignedSecurity(name)
+		if s == bogus {
+			return bogus, fmt.Errorf("%s: negative answer without proof: %w", name, err)
+		}
+		return insecure, nil
+	}
+	if result == insecure || insecureNSEC3(nsec3s) {
+		return insecure, nil
+	}
+	if err := provesDenial(resp.Authority, name, question.Type, rcode == 3); err != nil {
+		return bogus, fmt.Errorf("%s: %w", name, err)
+	}
+	return result, nil
+}
+
+// verifyRRset checks the RRset is signed by a verified key of the zone signing it,
+// returning the signature that verified when it is secure
+func (v *validator) verifyRRset(set *rrset) (security, *rrsig, error) {
+	owner := set.owner()
+	if len(set.sigs) == 0 {
+		s, err := v.unsignedSecurity(owner)
+		return s, nil, err
+	}
+
+	var lastErr error = errors.New("no usable signature")
+	for _, sig := range set.sigs {
+		if !isSubdomain(owner, sig.signerName) {
+			lastErr = errors.New("signed by a zone not enclosing it")
+			continue
+		}
+		trust, err := v.zoneKeys(sig.signerName)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if trust.unsigned {
+			return insecure, nil, nil
+		}
+		for _, key := range trust.keys {
+			if err = sig.verify(key, set.records, v.now); err == nil {
+				return secure, sig, nil
+			}
+			lastErr = err
+		}
+	}
+	return bogus, nil, lastErr
+}
+
+// zoneKeys returns the keys of the zone, verified with the DS records from its parent
+// or with a trust anchor for the zone
+func (v *validator) zoneKeys(zone string) (*zoneTrust, error) {
+	if trust := cachedTrust(zone); trust != nil && !trust.notZone {
+		return trust, nil
+	}
+	if v.depth >= maxValidationDepth {
+		return nil, errors.New("chain of trust too long")
+	}
+	v.depth++
+	defer func() { v.depth-- }()
+
+	dsSet := anchorsFor(zone)
+	if len(dsSet) == 0 {
+		if zone == "" {
+			return nil, errors.New("no trust anchor for the root zone")
+		}
+
+		resp, err := v.fetch(zone, uint16(cache.RecordTypeDS))
+		if err != nil {
+			return nil, err
+		}
+
+		var dsRRset *rrset
+		for _, set := range groupRRsets(resp.Answer) {
+			if set.owner() == zone && cache.RecordType(set.records[0].Type) == cache.RecordTypeDS {
+				dsRRset = set
+			}
+		}
+		if dsRRset == nil {
+			// without a DS the zone is only fine being unsigned if the parent proves it
+			s, err := v.validate(&Question{Name: zone, Type: uint16(cache.RecordTypeDS), Class: 1}, resp)
+			if s == bogus {
+				return nil, err
+			}
+			return storeTrust(zone, &zoneTrust{unsigned: true}, minTTL(resp.Authority)), nil
+		}
+
+		s, _, err := v.verifyRRset(dsRRset)
+		switch s {
+		case bogus:
+			return nil, fmt.Errorf("DS of %s: %w", fqdnOrRoot(zone), err)
+		case insecure:
+			return storeTrust(zone, &zoneTrust{unsigned: true}, minTTL(dsRRset.records)), nil
+		}
+		for _, rr := range dsRRset.records {
+			if ds, err := parseDS(rr.Data); err == nil {
+				dsSet = append(dsSet, ds)
+			}
+		}
+	}
+
+	var usable []*dsRecord
+	for _, ds := range dsSet {
+		if supportedAlgorithm(ds.algorithm) && supportedDigest(ds.digestType) {
+			usable = append(usable, ds)
+		}
+	}
+	if len(usable) == 0 {
+		// signed with algorithms we don't know, treated as unsigned (RFC 4035 5.2)
+		return storeTrust(zone, &zoneTrust{unsigned: true}, uint32(maxTrustTTL.Seconds())), nil
+	}
+
+	resp, err := v.fetch(zone, uint16(cache.RecordTypeDNSKEY))
+	if err != nil {
+		return nil, err
+	}
+	for _, set := range groupRRsets(resp.Answer) {
+		if set.owner() != zone || cache.RecordType(set.records[0].Type) != cache.RecordTypeDNSKEY {
+			continue
+		}
+
+		var keys []*dnskey
+		for _, rr := range set.records {
+			if key, err := parseDNSKEY(rr.Data); err == nil && key.flags&dnskeyFlagZone != 0 {
+				keys = append(keys, key)
+			}
+		}
+
+		// the key set is trusted once signed by a key the DS vouches for (RFC 4035 5.2)
+		for _, ds := range usable {
+			for _, key := range keys {
+				if !ds.matches(zone, key) {
+					continue
+				}
+				for _, sig := range set.sigs {
+					if sig.signerName == zone && sig.verify(key, set.records, v.now) == nil {
+						return storeTrust(zone, &zoneTrust{keys: keys}, minTTL(set.records)), nil
+					}
+				}
+			}
+		}
+	}
+	return nil, fmt.Errorf("no DNSKEY of %s validates with its DS", fqdnOrRoot(zone))
+}
+
+// unsignedSecurity tells whether records at the name may come without signatures, which
+// is when a delegation on the way down from the root is provably unsigned
+func (v *validator) unsignedSecurity(name string) (security, error) {
+	labels := splitDomainName(strings.ToLower(name))
+	for i := len(labels) - 1; i >= 0; i-- {
+		ancestor := strings.Join(labels[i:], ".")
+
+		if trust := cachedTrust(ancestor); trust != nil {
+			if trust.unsigned {
+				return insecure, nil
+			}
+			continue
+		}
+
+		resp, err := v.fetch(ancestor, uint16(cache.RecordTypeDS))
+		if err != nil {
+			return bogus, err
+		}
+
+		hasDS := false
+		for _, rr := range resp.Answer {
+			hasDS = hasDS || (strings.EqualFold(rr.Name, ancestor) && cache.RecordType(rr.Type) == cache.RecordTypeDS)
+		}
+		if hasDS {
+			trust, err := v.zoneKeys(ancestor)
+			if err != nil {
+				return bogus, err
+			}
+			if trust.unsigned {
+				return insecure, nil
+			}
+			continue
+		}
+
+		// no DS, either an unsigned delegation or no zone cut at all
+		for _, set := range groupRRsets(resp.Authority) {
+			if t := cache.RecordType(set.records[0].Type); t != cache.RecordTypeNSEC && t != cache.RecordTypeNSEC3 {
+				continue
+			}
+			s, _, err := v.verifyRRset(set)
+			if s == bogus {
+				return bogus, err
+			}
+			if s == insecure {
+				return insecure, nil
+			}
+		}
+
+		nsecs, nsec3s := denialRecords(resp.Authority)
+		var unsigned bool
+		switch {
+		case len(nsecs) > 0:
+			unsigned, err = nsecNoDS(nsecs, ancestor)
+		case insecureNSEC3(nsec3s):
+			return insecure, nil
+		case len(nsec3s) > 0:
+			unsigned, err = nsec3NoDS(nsec3s, ancestor)
+		default:
+			err = errNoDenialProof
+		}
+		if err != nil {
+			return bogus, fmt.Errorf("missing DS of %s: %w", fqdnOrRoot(ancestor), err)
+		}
+		if unsigned {
+			storeTrust(ancestor, &zoneTrust{unsigned: true}, minTTL(resp.Authority))
+			return insecure, nil
+		}
+		storeTrust(ancestor, &zoneTrust{notZone: true}, minTTL(resp.Authority))
+	}
+	return bogus, errors.New("unsigned records in a signed zone")
+}
+
+// provesWildcardAnswer checks the name the wildcard was expanded for doesn't exist itself,
+// the wildcard being at the closest encloser made of the last labels of the name
+func provesWildcardAnswer(authority []*Answer, name string, labels uint8) error {
+	nsecs, nsec3s := denialRecords(authority)
+	for _, n := range nsecs {
+		if n.covers(name) {
+			return nil
+		}
+	}
+	if len(nsec3s) > 0 {
+		nameLabels := splitDomainName(name)
+		nextCloser := strings.Join(nameLabels[len(nameLabels)-int(labels)-1:], ".")
+		for _, n := range nsec3s {
+			if n.covers(nextCloser) {
+				return nil
+			}
+		}
+	}
+	return errNoDenialProof
+}
+
+// chainEnd follows the CNAMEs in the answer from the name, returning where the chain
+// ends and whether there are records of the type there
+func chainEnd(answers []*Answer, name string, qtype uint16) (string, bool) {
+	for i := 0; i <= maxCNAMEChain; i++ {
+		next := ""
+		for _, rr := range answers {
+			if !strings.EqualFold(rr.Name, name) {
+				continue
+			}
+			if rr.Type == qtype || qtype == 255 {
+				return name, true
+			}
+			if cache.RecordType(rr.Type) == cache.RecordTypeCNAME {
+				if rdata, err := rr.RData(); err == nil {
+					next = rdata.(*cache.CNAMERecord).Target
+				}
+			}
+		}
+		if next == "" {
+			break
+		}
+		name = next
+	}
+	return name, false
+}
+
+func minTTL(records []*Answer) uint32 {
+	ttl := uint32(maxTrustTTL.Seconds())
+	for _, rr := range records {
+		ttl = min(ttl, rr.TTL)
+	}
+	return ttl
+}
+
+// isDNSSECRecord tells the records only sent to clients asking for them with the DO bit (RFC 4035 3.2.1)
+func isDNSSECRecord(rr *Answer) bool {
+	switch cache.RecordType(rr.Type) {
+	case cache.RecordTypeRRSIG, cache.RecordTypeNSEC, cache.RecordTypeNSEC3:
+		return true
+	}
+	return false
+}
+
+// withoutDNSSEC drops the signatures and denial records, unless they are what was asked for
+func withoutDNSSEC(section []*Answer, qtype uint16) []*Answer {
+	kept := section[:0:0]
+	for _, rr := range section {
+		if !isDNSSECRecord(rr) || rr.Type == qtype {
+			kept = append(kept, rr)
+		}
+	}
+	return kept
+}
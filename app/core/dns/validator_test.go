@@ -0,0 +1,220 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"omamori/app/core/internal/cache"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signedTree answers the validator's lookups of keys and delegations from a fixed set of responses
+type signedTree struct {
+	responses map[string]*Query
+}
+
+func newSignedTree() *signedTree {
+	return &signedTree{responses: make(map[string]*Query)}
+}
+
+func treeKey(name string, qtype uint16) string {
+	return strings.ToLower(name) + " " + cache.RecordType(qtype).String()
+}
+
+func (tree *signedTree) answer(name string, qtype cache.RecordType, records ...*Answer) {
+	tree.responses[treeKey(name, uint16(qtype))] = &Query{Header: &Header{FLAGS: 1 << 10}, Answer: records}
+}
+
+func (tree *signedTree) negative(name string, qtype cache.RecordType, rcode uint16, authority ...*Answer) {
+	tree.responses[treeKey(name, uint16(qtype))] = &Query{Header: &Header{FLAGS: 1<<10 | rcode}, Authority: authority}
+}
+
+// delegate publishes the keys of the child zone, with the DS vouching for them signed by the parent
+func (tree *signedTree) delegate(t *testing.T, parent *testKey, child *testKey) {
+	tree.answer(child.zone, cache.RecordTypeDS, parent.sign(t, child.ds())...)
+	tree.answer(child.zone, cache.RecordTypeDNSKEY, child.sign(t, child.dnskey)...)
+}
+
+func (tree *signedTree) fetch(name string, qtype uint16) (*Query, error) {
+	if resp, found := tree.responses[treeKey(name, qtype)]; found {
+		return resp, nil
+	}
+	return nil, errors.New("not in the test tree")
+}
+
+func (tree *signedTree) validator() *validator {
+	return &validator{fetch: tree.fetch, now: time.Now()}
+}
+
+// useTrustAnchor makes the key the only trust anchor, forgetting every verified zone until the test is done
+func useTrustAnchor(t *testing.T, root *testKey) {
+	t.Helper()
+	ds, err := parseDS(root.ds().Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trustMutex.Lock()
+	savedAnchors, savedZones := trustAnchors, trustedZones
+	trustAnchors = map[string][]*dsRecord{root.zone: {ds}}
+	trustedZones = make(map[string]*zoneTrust)
+	trustMutex.Unlock()
+
+	t.Cleanup(func() {
+		trustMutex.Lock()
+		trustAnchors, trustedZones = savedAnchors, savedZones
+		trustMutex.Unlock()
+	})
+}
+
+// newSignedZone signs the zone with a key of the algorithm, delegated to from a root signed the same way
+func newSignedZone(t *testing.T, zone string, algorithm uint8) (*signedTree, *testKey) {
+	t.Helper()
+	root := newTestKey(t, "", algorithm)
+	key := newTestKey(t, zone, algorithm)
+	useTrustAnchor(t, root)
+
+	tree := newSignedTree()
+	tree.answer("", cache.RecordTypeDNSKEY, root.sign(t, root.dnskey)...)
+	tree.delegate(t, root, key)
+	return tree, key
+}
+
+func testNSEC(owner string, next string, types ...cache.RecordType) *Answer {
+	rdata := append(canonicalName(next), testBitmap(types...)...)
+	return &Answer{Name: owner, Type: uint16(cache.RecordTypeNSEC), Class: 1, TTL: testTTL, Data: rdata, Length: uint16(len(rdata))}
+}
+
+// testBitmap encodes the types, all below 256, as the single window of an NSEC type bitmap
+func testBitmap(types ...cache.RecordType) []byte {
+	var blocks [32]byte
+	length := 0
+	for _, recordType := range types {
+		blocks[recordType/8] |= 0x80 >> (recordType % 8)
+		length = max(length, int(recordType/8)+1)
+	}
+	return append([]byte{0, byte(length)}, blocks[:length]...)
+}
+
+func TestValidateChainOfTrust(t *testing.T) {
+	root := newTestKey(t, "", algED25519)
+	com := newTestKey(t, "com", algECDSAP256SHA256)
+	example := newTestKey(t, "example.com", algRSASHA256)
+	useTrustAnchor(t, root)
+
+	tree := newSignedTree()
+	tree.answer("", cache.RecordTypeDNSKEY, root.sign(t, root.dnskey)...)
+	tree.delegate(t, root, com)
+	tree.delegate(t, com, example)
+
+	// a zone whose DS was made from a key it doesn't use
+	mismatched, stranger := newTestKey(t, "mismatched.com", algED25519), newTestKey(t, "mismatched.com", algED25519)
+	tree.answer("mismatched.com", cache.RecordTypeDS, com.sign(t, stranger.ds())...)
+	tree.answer("mismatched.com", cache.RecordTypeDNSKEY, mismatched.sign(t, mismatched.dnskey)...)
+
+	// an unsigned delegation, which com proves has no DS
+	tree.negative("insecure.com", cache.RecordTypeDS, 0, append(com.sign(t, testSOA(t, "com")),
+		com.sign(t, testNSEC("insecure.com", "mismatched.com", cache.RecordTypeNS, cache.RecordTypeRRSIG, cache.RecordTypeNSEC))...)...)
+
+	// a zone signed with an algorithm we can't verify, which makes it insecure (RFC 4035 5.2)
+	unknownDS := stranger.ds()
+	unknownDS.Name, unknownDS.Data[2] = "private.com", 253
+	tree.answer("private.com", cache.RecordTypeDS, com.sign(t, unknownDS)...)
+
+	// www.example.com has no DS, as there is no zone cut
+	tree.negative("www.example.com", cache.RecordTypeDS, 0, append(example.sign(t, testSOA(t, "example.com")),
+		example.sign(t, testNSEC("www.example.com", "example.com", cache.RecordTypeA, cache.RecordTypeRRSIG, cache.RecordTypeNSEC))...)...)
+
+	now := time.Now()
+	expired := append([]*Answer{testA("www.example.com", 1)},
+		example.signAt(t, now.Add(-48*time.Hour), now.Add(-24*time.Hour), testA("www.example.com", 1)))
+	tampered := example.sign(t, testA("www.example.com", 1))
+	tampered[0] = testA("www.example.com", 66)
+	wrongSigner := mismatched.sign(t, testA("www.example.com", 1))
+
+	tests := []struct {
+		name   string
+		answer []*Answer
+		want   security
+	}{
+		{"signed", example.sign(t, testA("www.example.com", 1)), secure},
+		{"changed after signing", tampered, bogus},
+		{"expired signature", expired, bogus},
+		{"signed by a zone not enclosing it", wrongSigner, bogus},
+		{"signatures stripped", []*Answer{testA("www.example.com", 1)}, bogus},
+		{"DS for another key", mismatched.sign(t, testA("www.mismatched.com", 1)), bogus},
+		{"unsigned delegation", []*Answer{testA("www.insecure.com", 1)}, insecure},
+		{"unknown algorithm", []*Answer{testA("www.private.com", 1)}, insecure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			question := &Question{Name: tt.answer[0].Name, Type: uint16(cache.RecordTypeA), Class: 1}
+			got, err := tree.validator().validate(question, &Query{Header: &Header{}, Answer: tt.answer})
+			if got != tt.want {
+				t.Errorf("security %d, want %d (error %v)", got, tt.want, err)
+			}
+		})
+	}
+}
+
+func TestValidateUntrustedRoot(t *testing.T) {
+	root, impostor := newTestKey(t, "", algED25519), newTestKey(t, "", algED25519)
+	example := newTestKey(t, "example", algED25519)
+	useTrustAnchor(t, root)
+
+	// the whole tree is signed consistently, but not with the key the anchor is for
+	tree := newSignedTree()
+	tree.answer("", cache.RecordTypeDNSKEY, impostor.sign(t, impostor.dnskey)...)
+	tree.delegate(t, impostor, example)
+
+	question := &Question{Name: "www.example", Type: uint16(cache.RecordTypeA), Class: 1}
+	got, _ := tree.validator().validate(question, &Query{Header: &Header{}, Answer: example.sign(t, testA("www.example", 1))})
+	if got != bogus {
+		t.Errorf("security %d, want bogus", got)
+	}
+}
+
+func TestValidateWildcardLabelsOfVerifyingSignature(t *testing.T) {
+	tree, key := newSignedZone(t, "example", algED25519)
+	stranger := newTestKey(t, "example", algED25519)
+
+	// a signature over the name itself that doesn't verify, ahead of the wildcard one that does
+	expanded := expandWildcard(key.sign(t, testA("*.w.example", 1)), "x.w.example")
+	answer := []*Answer{expanded[0], stranger.signAt(t, time.Now().Add(-time.Hour), time.Now().Add(time.Hour), testA("x.w.example", 1)), expanded[1]}
+
+	question := &Question{Name: "x.w.example", Type: uint16(cache.RecordTypeA), Class: 1}
+	got, err := tree.validator().validate(question, &Query{Header: &Header{}, Answer: answer})
+	if got != bogus {
+		t.Errorf("wildcard answer without proof the name doesn't exist: security %d, want bogus (error %v)", got, err)
+	}
+}
+
+func TestTrustedZonesBounded(t *testing.T) {
+	useTrustAnchor(t, newTestKey(t, "", algED25519))
+
+	storeTrust("expired.example", &zoneTrust{unsigned: true}, 0)
+	time.Sleep(time.Millisecond)
+	if cachedTrust("expired.example") != nil {
+		t.Error("expired zone returned")
+	}
+	trustMutex.Lock()
+	_, kept := trustedZones["expired.example"]
+	trustMutex.Unlock()
+	if kept {
+		t.Error("expired zone kept after the lookup")
+	}
+
+	for i := 0; i < maxTrustedZones+100; i++ {
+		storeTrust(fmt.Sprintf("zone%d.example", i), &zoneTrust{notZone: true}, testTTL)
+	}
+	trustMutex.Lock()
+	size := len(trustedZones)
+	trustMutex.Unlock()
+	if size > maxTrustedZones {
+		t.Errorf("%d zones remembered, at most %d", size, maxTrustedZones)
+	}
+	if cachedTrust(fmt.Sprintf("zone%d.example", maxTrustedZones+99)) == nil {
+		t.Error("zone stored last was evicted")
+	}
+}
@@ -0,0 +1,54 @@
+package cache
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+const benchmarkKeys = 10000
+
+// benchmarkCache runs Gets and Sets, one Set for every nine Gets, from all
+// goroutines at once over the same keys, all of which fit in the cache
+func benchmarkCache(b *testing.B, c Cache) {
+	defer c.Close()
+
+	domains := make([]string, benchmarkKeys)
+	now := time.Now()
+	for i := range domains {
+		domains[i] = "host" + strconv.Itoa(i) + ".example.com"
+		c.Set(domains[i], benchmarkRecord(domains[i], now))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			domain := domains[(i*7919)%benchmarkKeys] // stepping by a prime spreads the keys
+			if i%10 == 0 {
+				c.Set(domain, benchmarkRecord(domain, now))
+			} else {
+				c.Get(domain, uint16(RecordTypeA))
+			}
+			i++
+		}
+	})
+}
+
+func benchmarkRecord(domain string, now time.Time) *Record {
+	return &Record{
+		Type:      RecordTypeA,
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Hour),
+		Answers:   []RR{{Name: domain, Type: RecordTypeA, Class: 1, TTL: 3600, Data: []byte{192, 0, 2, 1}}},
+	}
+}
+
+func BenchmarkLRU(b *testing.B) {
+	benchmarkCache(b, DNSCache(benchmarkKeys))
+}
+
+func BenchmarkSharded(b *testing.B) {
+	benchmarkCache(b, NewShardedCache(64<<20))
+}
@@ -2,14 +2,15 @@ package cache
 
 import (
 	"fmt"
+	"hash/fnv"
 	"strconv"
 	"strings"
 	"time"
 )
 
-var DnsCache = DNSCache(1000)
+var DnsCache Cache = DNSCache(1000)
 
-func (c *LRUCache) removeEntry(e *entry) {
+func (c *lruList) removeEntry(e *entry) {
 	// updating the next and prev pointers
 	if e.prev != nil {
 		e.prev.next = e.next
@@ -37,14 +38,16 @@ func (c *LRUCache) removeTail() {
 	c.removeEntry(c.tail)
 }
 
-func (c *LRUCache) moveToFront(e *entry) {
+func (c *lruList) moveToFront(e *entry) {
 	if c.head == e {
 		return // entry already at the front
 	}
 
 	c.removeEntry(e) // remove the entry from the current position
+	c.pushFront(e)
+}
 
-	// adding it to the front
+func (c *lruList) pushFront(e *entry) {
 	e.next = c.head
 	e.prev = nil
 	if c.head != nil {
@@ -79,13 +82,46 @@ func (c *LRUCache) removeExpired() {
 	defer c.mutex.Unlock()
 
 	for key, e := range c.items {
-		if now.After(e.record.ExpiresAt) {
+		if c.isPastStale(e.record, now) {
 			delete(c.items, key)
 			c.removeEntry(e)
 		}
 	}
 }
 
+// SetStaleWindow sets how long records are kept past their expiry to be served stale, 0 disables it
+func (s *staleWindow) SetStaleWindow(window time.Duration) {
+	s.window.Store(int64(window))
+}
+
+func (s *staleWindow) isPastStale(record *Record, now time.Time) bool {
+	return now.After(record.ExpiresAt.Add(time.Duration(s.window.Load())))
+}
+
+func shardIndex(key string, shards int) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return int(h.Sum32() % uint32(shards))
+}
+
+// Rough per item overheads of maps, list pointers and slice headers
+const (
+	entryOverhead = 160
+	rrOverhead    = 64
+)
+
+// entrySize estimates how much memory an entry takes
+func entrySize(key string, record *Record) int {
+	size := entryOverhead + 2*len(key) // the key is also kept in the map
+	for _, rr := range record.Answers {
+		size += rrOverhead + len(rr.Name) + len(rr.Data)
+	}
+	for _, rr := range record.Authority {
+		size += rrOverhead + len(rr.Name) + len(rr.Data)
+	}
+	return size
+}
+
 func NormalizeDomain(domain string) string {
 	return strings.ToLower(domain) // TODO!: To add more rigorous normalization
 }
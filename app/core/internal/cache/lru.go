@@ -1,17 +1,48 @@
 package cache
 
 import (
+	"fmt"
 	"time"
 )
 
 type Cache interface {
 	Get(domain string, recordType uint16) (*Record, bool)
 
+	// GetStale returns an expired record still within the stale window (RFC 8767)
+	GetStale(domain string, recordType uint16) (*Record, bool)
+
 	Set(domain string, record *Record)
 
 	Remove(domain string, recordType uint16)
 
 	Close()
+
+	SetStaleWindow(window time.Duration)
+
+	ConfigurePrefetch(prefetcher Prefetcher, window time.Duration, topCount, minHits, threshold int)
+
+	PrefetchStats() (prefetched uint64, hits uint64)
+
+	SaveSnapshot(path string) error
+
+	LoadSnapshot(path string) (int, error)
+}
+
+const (
+	CacheTypeLRU     = "lru"
+	CacheTypeSharded = "sharded"
+)
+
+// NewCache builds the cache of the given type, the LRU cache is bounded by
+// the number of entries while the sharded one is bounded by memory
+func NewCache(cacheType string, entries int, maxBytes int) (Cache, error) {
+	switch cacheType {
+	case CacheTypeLRU:
+		return DNSCache(entries), nil
+	case CacheTypeSharded:
+		return NewShardedCache(maxBytes), nil
+	}
+	return nil, fmt.Errorf("unknown cache type %q", cacheType)
 }
 
 func NewCacheKey(domain string, recordType RecordType) Key {
@@ -27,7 +58,9 @@ func DNSCache(capacity int) *LRUCache {
 		items:     make(map[string]*entry, capacity),
 		cleanUpCh: make(chan struct{}),
 	}
+	cache.prefetchState.init(1, cache.peek)
 	go cache.startCleanUp()
+	go cache.startPrefetch()
 
 	return cache
 }
@@ -35,29 +68,55 @@ func DNSCache(capacity int) *LRUCache {
 func (c *LRUCache) Get(domain string, recordType uint16) (*Record, bool) {
 	key := NewCacheKey(domain, RecordType(recordType)).String()
 	
+	now := time.Now()
 	c.mutex.RLock()
 	e, found := c.items[key]
+	var expired, pastStale bool
+	if found {
+		expired = now.After(e.record.ExpiresAt)
+		pastStale = c.isPastStale(e.record, now)
+	}
 	c.mutex.RUnlock()
 
 	if !found {
 		return nil, false
 	}
 
-	// check if the entry has expired
-	if time.Now().After(e.record.ExpiresAt) {
-		c.Remove(domain, recordType)
+	// check if the entry has expired, it is kept around a while longer to be served stale
+	if expired {
+		if pastStale {
+			c.Remove(domain, recordType)
+		}
 		return nil, false
 	}
 
 	c.mutex.Lock() // acquiring a Write lock for the updates
-	defer c.mutex.Unlock()
-
 	if _, stillExists := c.items[key]; !stillExists {
+		c.mutex.Unlock()
 		return nil, false
 	}
 
 	// move to front
 	c.moveToFront(e)
+	record := e.record
+	c.mutex.Unlock()
+
+	// counting the hit towards the entry's popularity for prefetching
+	c.trackAccess(key, domain, recordType)
+
+	return record, true
+}
+
+func (c *LRUCache) GetStale(domain string, recordType uint16) (*Record, bool) {
+	key := NewCacheKey(domain, RecordType(recordType)).String()
+
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	e, found := c.items[key]
+	if !found || c.isPastStale(e.record, time.Now()) {
+		return nil, false
+	}
 
 	return e.record, true
 }
@@ -117,6 +176,16 @@ func (c *LRUCache) Remove(domain string, recordType uint16) {
 
 func (c *LRUCache) Close() {
 	close(c.cleanUpCh)
+	close(c.stop)
 }
 
-// TODO! making cache persistent
+// peek returns the record under key without moving it to the front
+func (c *LRUCache) peek(key string) *Record {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if e, found := c.items[key]; found {
+		return e.record
+	}
+	return nil
+}
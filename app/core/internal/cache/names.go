@@ -0,0 +1,67 @@
+package cache
+
+import (
+	"bytes"
+	"strings"
+)
+
+// Names are kept in dotted form, a label containing a dot or a backslash has them
+// escaped so that splitting the name at its dots gives back the labels it was made of
+
+// EscapeLabel turns a wire format label into its dotted form, escaping the dots and
+// backslashes it may contain so they don't split it in two (RFC 4343 2.1)
+func EscapeLabel(label []byte) string {
+	if !bytes.ContainsAny(label, `.\`) {
+		return string(label)
+	}
+	var buf strings.Builder
+	for _, c := range label {
+		if c == '.' || c == '\\' {
+			buf.WriteByte('\\')
+		}
+		buf.WriteByte(c)
+	}
+	return buf.String()
+}
+
+// UnescapeLabel turns a label from SplitName back into its wire format bytes
+func UnescapeLabel(label string) string {
+	if !strings.Contains(label, `\`) {
+		return label
+	}
+	var buf strings.Builder
+	for i := 0; i < len(label); i++ {
+		if label[i] == '\\' && i+1 < len(label) {
+			i++
+		}
+		buf.WriteByte(label[i])
+	}
+	return buf.String()
+}
+
+// SplitName splits a dotted name into its labels, still escaped, at the dots that aren't
+func SplitName(name string) []string {
+	if !strings.Contains(name, `\`) {
+		name = strings.TrimSuffix(name, ".")
+		if name == "" {
+			return nil // root
+		}
+		return strings.Split(name, ".")
+	}
+
+	var labels []string
+	start := 0
+	for i := 0; i < len(name); i++ {
+		switch name[i] {
+		case '\\':
+			i++
+		case '.':
+			labels = append(labels, name[start:i])
+			start = i + 1
+		}
+	}
+	if start < len(name) {
+		labels = append(labels, name[start:]) // no trailing dot
+	}
+	return labels
+}
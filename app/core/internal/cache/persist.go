@@ -0,0 +1,168 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Snapshot format: the magic and a version byte, followed by one block per entry made of
+// a 4 byte length, the entry as JSON and a CRC32 of that JSON, all big endian.
+// Entries are written from least to most recently used, so loading them in order rebuilds the LRU list.
+
+const (
+	snapshotMagic        = "OMCACHE"
+	snapshotVersion      = 1
+	maxSnapshotEntrySize = 1 << 20
+)
+
+type snapshotEntry struct {
+	Domain string  `json:"domain"`
+	Record *Record `json:"record"`
+}
+
+// SaveSnapshot writes every entry that can still be served to path
+func (c *LRUCache) SaveSnapshot(path string) error {
+	buf := newSnapshot()
+
+	c.mutex.RLock()
+	err := c.lruList.writeSnapshot(buf, &c.staleWindow, time.Now())
+	c.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	return writeSnapshotFile(path, buf)
+}
+
+// LoadSnapshot adds the entries saved at path to the cache, skipping the ones gone stale since.
+// Corrupt entries are skipped and a truncated snapshot is loaded up to where it ends.
+func (c *LRUCache) LoadSnapshot(path string) (int, error) {
+	return readSnapshotFile(path, &c.staleWindow, c.Set)
+}
+
+func (c *ShardedCache) SaveSnapshot(path string) error {
+	buf := newSnapshot()
+	now := time.Now()
+
+	// every shard is written in LRU order, which is all that matters when loading them back
+	for _, shard := range c.shards {
+		shard.mutex.Lock()
+		err := shard.lruList.writeSnapshot(buf, &c.staleWindow, now)
+		shard.mutex.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	return writeSnapshotFile(path, buf)
+}
+
+func (c *ShardedCache) LoadSnapshot(path string) (int, error) {
+	return readSnapshotFile(path, &c.staleWindow, c.Set)
+}
+
+func newSnapshot() *bytes.Buffer {
+	var buf bytes.Buffer
+	buf.WriteString(snapshotMagic)
+	buf.WriteByte(snapshotVersion)
+	return &buf
+}
+
+// writeSnapshot appends the entries from the least to the most recently used
+func (l *lruList) writeSnapshot(buf *bytes.Buffer, stale *staleWindow, now time.Time) error {
+	for e := l.tail; e != nil; e = e.prev {
+		if stale.isPastStale(e.record, now) {
+			continue
+		}
+
+		// keys are "type:domain"
+		_, domain, _ := strings.Cut(e.key, ":")
+		data, err := json.Marshal(snapshotEntry{Domain: domain, Record: e.record})
+		if err != nil {
+			return err
+		}
+
+		_ = binary.Write(buf, binary.BigEndian, uint32(len(data)))
+		buf.Write(data)
+		_ = binary.Write(buf, binary.BigEndian, crc32.ChecksumIEEE(data))
+	}
+	return nil
+}
+
+func writeSnapshotFile(path string, buf *bytes.Buffer) error {
+	// writing next to the snapshot and swapping it in, so a crash never leaves a half written file behind
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func readSnapshotFile(path string, stale *staleWindow, set func(domain string, record *Record)) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	r := bufio.NewReader(file)
+
+	header := make([]byte, len(snapshotMagic)+1)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return 0, errors.New("not a cache snapshot")
+	}
+	if version := header[len(snapshotMagic)]; version != snapshotVersion {
+		return 0, fmt.Errorf("unsupported cache snapshot version %d", version)
+	}
+
+	now := time.Now()
+	loaded := 0
+
+	for {
+		var length uint32
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			// EOF, or the snapshot was cut short
+			break
+		}
+		if length > maxSnapshotEntrySize {
+			// the length itself is garbage, nothing after it can be trusted
+			break
+		}
+
+		data := make([]byte, length)
+		var checksum uint32
+		if _, err := io.ReadFull(r, data); err != nil {
+			break
+		}
+		if err := binary.Read(r, binary.BigEndian, &checksum); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(data) != checksum {
+			continue
+		}
+
+		var entry snapshotEntry
+		if err := json.Unmarshal(data, &entry); err != nil || entry.Record == nil {
+			continue
+		}
+		if stale.isPastStale(entry.Record, now) {
+			continue
+		}
+
+		set(entry.Domain, entry.Record)
+		loaded++
+	}
+
+	return loaded, nil
+}
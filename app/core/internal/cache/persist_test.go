@@ -0,0 +1,194 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// snapshotCache fills a cache with an entry per domain, the first one being the least recently used
+func snapshotCache(t *testing.T, domains ...string) *LRUCache {
+	t.Helper()
+	c := DNSCache(10)
+	t.Cleanup(c.Close)
+
+	now := time.Now().Truncate(time.Second)
+	for i, domain := range domains {
+		c.Set(domain, &Record{
+			Type:      RecordTypeA,
+			CreatedAt: now,
+			ExpiresAt: now.Add(time.Hour),
+			Answers:   []RR{{Name: domain, Type: RecordTypeA, Class: 1, TTL: 3600, Data: []byte{192, 0, 2, byte(i)}}},
+		})
+	}
+	return c
+}
+
+func saveSnapshot(t *testing.T, c *LRUCache) (string, []byte) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "cache.snapshot")
+	if err := c.SaveSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, data
+}
+
+// lruOrder lists the domains from the least to the most recently used
+func lruOrder(c *LRUCache) []string {
+	var domains []string
+	for e := c.tail; e != nil; e = e.prev {
+		domains = append(domains, e.key)
+	}
+	return domains
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	saved := snapshotCache(t, "a.test", "b.test", "c.test")
+	saved.Set("nx.test", &Record{
+		Type:      RecordTypeNXDomain,
+		CreatedAt: time.Now().Truncate(time.Second),
+		ExpiresAt: time.Now().Add(time.Minute).Truncate(time.Second),
+		Negative:  true,
+		RCode:     3,
+		Authority: []RR{{Name: "test", Type: RecordTypeSOA, Class: 1, TTL: 60, Data: []byte{0, 0}}},
+	})
+	path, _ := saveSnapshot(t, saved)
+
+	loaded := DNSCache(10)
+	defer loaded.Close()
+	n, err := loaded.LoadSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Errorf("loaded %d entries, want 4", n)
+	}
+
+	if got, want := lruOrder(loaded), lruOrder(saved); !reflect.DeepEqual(got, want) {
+		t.Errorf("LRU order %v, want %v", got, want)
+	}
+	for key, e := range saved.items {
+		got, found := loaded.items[key]
+		if !found {
+			t.Errorf("%s missing", key)
+			continue
+		}
+		want := e.record
+		if !got.record.ExpiresAt.Equal(want.ExpiresAt) || !got.record.CreatedAt.Equal(want.CreatedAt) {
+			t.Errorf("%s times %s-%s, want %s-%s", key, got.record.CreatedAt, got.record.ExpiresAt, want.CreatedAt, want.ExpiresAt)
+		}
+		if got.record.Type != want.Type || got.record.Negative != want.Negative || got.record.RCode != want.RCode ||
+			!reflect.DeepEqual(got.record.Answers, want.Answers) || !reflect.DeepEqual(got.record.Authority, want.Authority) {
+			t.Errorf("%s is %+v, want %+v", key, got.record, want)
+		}
+	}
+}
+
+func TestLoadSnapshotHeader(t *testing.T) {
+	_, data := saveSnapshot(t, snapshotCache(t, "a.test"))
+
+	badVersion := bytes.Clone(data)
+	badVersion[len(snapshotMagic)] = snapshotVersion + 1
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"bad magic", append([]byte("NOTCACHE"), data[len(snapshotMagic)+1:]...)},
+		{"unknown version", badVersion},
+		{"shorter than the header", data[:3]},
+		{"empty", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "cache.snapshot")
+			if err := os.WriteFile(path, tt.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			c := DNSCache(10)
+			defer c.Close()
+			if n, err := c.LoadSnapshot(path); err == nil {
+				t.Errorf("loaded %d entries without an error", n)
+			}
+		})
+	}
+}
+
+func TestLoadSnapshotCorrupt(t *testing.T) {
+	_, data := saveSnapshot(t, snapshotCache(t, "a.test", "b.test", "c.test"))
+
+	// offset of the JSON of the second entry
+	first := len(snapshotMagic) + 1
+	second := first + 4 + int(binary.BigEndian.Uint32(data[first:])) + 4
+
+	crcMismatch := bytes.Clone(data)
+	crcMismatch[second+4+2] ^= 0xFF
+
+	tests := []struct {
+		name string
+		data []byte
+		want []string
+	}{
+		{"CRC mismatch", crcMismatch, []string{"1:a.test", "1:c.test"}},
+		{"truncated final entry", data[:len(data)-3], []string{"1:a.test", "1:b.test"}},
+		{"truncated final length", append(bytes.Clone(data), 0, 0), []string{"1:a.test", "1:b.test", "1:c.test"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "cache.snapshot")
+			if err := os.WriteFile(path, tt.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			c := DNSCache(10)
+			defer c.Close()
+			n, err := c.LoadSnapshot(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := lruOrder(c); n != len(tt.want) || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("loaded %d entries %v, want %v", n, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadSnapshotExpired(t *testing.T) {
+	saved := snapshotCache(t, "fresh.test")
+	saved.Set("expired.test", &Record{Type: RecordTypeA, ExpiresAt: time.Now().Add(-time.Minute)})
+	saved.Set("long-gone.test", &Record{Type: RecordTypeA, ExpiresAt: time.Now().Add(-2 * time.Hour)})
+
+	// expired entries are written out as long as they can still be served stale
+	saved.SetStaleWindow(24 * time.Hour)
+	path, _ := saveSnapshot(t, saved)
+
+	tests := []struct {
+		name   string
+		window time.Duration
+		want   []string
+	}{
+		{"without serve-stale", 0, []string{"1:fresh.test"}},
+		{"within the stale window", time.Hour, []string{"1:fresh.test", "1:expired.test"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DNSCache(10)
+			defer c.Close()
+			c.SetStaleWindow(tt.window)
+			n, err := c.LoadSnapshot(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := lruOrder(c); n != len(tt.want) || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("loaded %d entries %v, want %v", n, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package cache
+
+import (
+	"sort"
+	"time"
+)
+
+// Prefetcher refreshes an entry from upstream, reporting whether it succeeded
+type Prefetcher func(domain string, recordType uint16) bool
+
+const prefetchInterval = 2 * time.Second
+
+func (p *prefetchState) init(shards int, peek func(key string) *Record) {
+	p.stop = make(chan struct{})
+	p.peek = peek
+	p.metrics = make([]*metricsShard, shards)
+	for i := range p.metrics {
+		p.metrics[i] = &metricsShard{metrics: make(map[string]*domainMetrics)}
+	}
+	p.settings.Store(&prefetchSettings{})
+}
+
+// ConfigurePrefetch sets which entries get refreshed ahead of expiry: the topCount most accessed
+// over the sliding window, with at least minHits, once less than threshold percent of their TTL is left
+func (p *prefetchState) ConfigurePrefetch(prefetcher Prefetcher, window time.Duration, topCount, minHits, threshold int) {
+	p.settings.Store(&prefetchSettings{
+		prefetcher:    prefetcher,
+		slidingWindow: window,
+		topCount:      topCount,
+		minHits:       minHits,
+		threshold:     threshold,
+	})
+}
+
+// PrefetchStats returns how many entries were prefetched and how many of those served a hit afterwards
+func (p *prefetchState) PrefetchStats() (prefetched uint64, hits uint64) {
+	return p.prefetchCount.Load(), p.prefetchHits.Load()
+}
+
+// roll moves the window along, the sliding count is approximated by weighing the
+// previous window by how much of it still overlaps
+func (m *domainMetrics) roll(now time.Time, window time.Duration) {
+	elapsed := now.Sub(m.windowStart)
+	if elapsed >= 2*window {
+		m.previousCount = 0
+		m.numberOfTimesAccessed = 0
+		m.windowStart = now
+	} else if elapsed >= window {
+		m.previousCount = m.numberOfTimesAccessed
+		m.numberOfTimesAccessed = 0
+		m.windowStart = m.windowStart.Add(window)
+	}
+}
+
+func (m *domainMetrics) rate(now time.Time, window time.Duration) float64 {
+	m.roll(now, window)
+	overlap := 1 - float64(now.Sub(m.windowStart))/float64(window)
+	return float64(m.previousCount)*overlap + float64(m.numberOfTimesAccessed)
+}
+
+// trackAccess counts a hit on the entry
+func (p *prefetchState) trackAccess(key string, domain string, recordType uint16) {
+	settings := p.settings.Load()
+	if settings.topCount == 0 {
+		return
+	}
+
+	shard := p.metrics[shardIndex(key, len(p.metrics))]
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	now := time.Now()
+	m, found := shard.metrics[key]
+	if !found {
+		m = &domainMetrics{domain: domain, recordType: recordType, windowStart: now}
+		shard.metrics[key] = m
+	}
+
+	if m.prefetched {
+		m.prefetched = false
+		p.prefetchHits.Add(1)
+	}
+
+	m.roll(now, settings.slidingWindow)
+	m.numberOfTimesAccessed++
+	m.lastAccessed = now
+}
+
+func (p *prefetchState) startPrefetch() {
+	ticker := time.NewTicker(prefetchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.prefetchPopular()
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// prefetchPopular refreshes the most popular entries that are about to expire
+func (p *prefetchState) prefetchPopular() {
+	settings := p.settings.Load()
+	if settings.topCount == 0 || settings.prefetcher == nil {
+		return
+	}
+
+	now := time.Now()
+
+	type candidate struct {
+		key     string
+		shard   *metricsShard
+		metrics *domainMetrics
+		rate    float64
+	}
+
+	var candidates []candidate
+	for _, shard := range p.metrics {
+		shard.mutex.Lock()
+		for key, m := range shard.metrics {
+			if now.Sub(m.lastAccessed) > 2*settings.slidingWindow {
+				// not popular anymore
+				delete(shard.metrics, key)
+				continue
+			}
+			rate := m.rate(now, settings.slidingWindow)
+			if rate >= float64(settings.minHits) && !m.refreshing {
+				candidates = append(candidates, candidate{key, shard, m, rate})
+			}
+		}
+		shard.mutex.Unlock()
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].rate > candidates[j].rate
+	})
+	if len(candidates) > settings.topCount {
+		candidates = candidates[:settings.topCount]
+	}
+
+	for _, candidate := range candidates {
+		record := p.peek(candidate.key)
+		if record == nil || record.Negative || now.After(record.ExpiresAt) {
+			continue
+		}
+
+		// refreshing once the remaining TTL drops below the threshold, or it would expire before the next round
+		ttl := record.ExpiresAt.Sub(record.CreatedAt)
+		left := record.ExpiresAt.Sub(now)
+		if left > ttl*time.Duration(settings.threshold)/100 && left > 2*prefetchInterval {
+			continue
+		}
+
+		candidate.shard.mutex.Lock()
+		candidate.metrics.refreshing = true
+		candidate.shard.mutex.Unlock()
+
+		go func(shard *metricsShard, m *domainMetrics) {
+			ok := settings.prefetcher(m.domain, m.recordType)
+
+			shard.mutex.Lock()
+			defer shard.mutex.Unlock()
+			m.refreshing = false
+			if ok {
+				m.prefetched = true
+				p.prefetchCount.Add(1)
+			}
+		}(candidate.shard, candidate.metrics)
+	}
+}
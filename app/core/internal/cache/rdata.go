@@ -0,0 +1,384 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// RData is the typed form of a record's RDATA, it can be turned back into
+// wire format and printed in zone file presentation format
+type RData interface {
+	Type() RecordType
+	Marshal() ([]byte, error)
+	String() string
+}
+
+// UnknownRecord keeps the RDATA of types we don't know as is (RFC 3597)
+type UnknownRecord struct {
+	RRType RecordType
+	Data   []byte
+}
+
+var recordTypeNames = map[RecordType]string{
+	RecordTypeA:      "A",
+	RecordTypeAAAA:   "AAAA",
+	RecordTypeCNAME:  "CNAME",
+	RecordTypeMX:     "MX",
+	RecordTypeNS:     "NS",
+	RecordTypePTR:    "PTR",
+	RecordTypeSOA:    "SOA",
+	RecordTypeSRV:    "SRV",
+	RecordTypeDNAME:  "DNAME",
+	RecordTypeTXT:    "TXT",
+	RecordTypeCAA:    "CAA",
+	RecordTypeDS:     "DS",
+	RecordTypeRRSIG:  "RRSIG",
+	RecordTypeNSEC:   "NSEC",
+	RecordTypeDNSKEY: "DNSKEY",
+	RecordTypeNSEC3:  "NSEC3",
+}
+
+func (t RecordType) String() string {
+	if name, found := recordTypeNames[t]; found {
+		return name
+	}
+	return "TYPE" + strconv.Itoa(int(t)) // RFC 3597 5
+}
+
+// ParseRecordType accepts both mnemonics (e.g. AAAA) and the generic TYPEnnn form
+func ParseRecordType(name string) (RecordType, bool) {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	for recordType, mnemonic := range recordTypeNames {
+		if mnemonic == name {
+			return recordType, true
+		}
+	}
+	if value, err := strconv.ParseUint(strings.TrimPrefix(name, "TYPE"), 10, 16); err == nil {
+		return RecordType(value), true
+	}
+	return 0, false
+}
+
+// ParseRData decodes RDATA from wire format, embedded names are expected to be uncompressed
+func ParseRData(recordType RecordType, data []byte) (RData, error) {
+	switch recordType {
+	case RecordTypeA:
+		if len(data) != net.IPv4len {
+			return nil, errors.New("invalid A record")
+		}
+		return &ARecord{IPAddress: net.IP(data).String()}, nil
+
+	case RecordTypeAAAA:
+		if len(data) != net.IPv6len {
+			return nil, errors.New("invalid AAAA record")
+		}
+		return &AAAARecord{IPAddress: net.IP(data).String()}, nil
+
+	case RecordTypeCNAME, RecordTypeNS, RecordTypePTR:
+		name, offset, err := readName(data, 0)
+		if err != nil {
+			return nil, err
+		}
+		if offset != len(data) {
+			return nil, errors.New("trailing record data")
+		}
+		switch recordType {
+		case RecordTypeCNAME:
+			return &CNAMERecord{Target: name}, nil
+		case RecordTypeNS:
+			return &NSRecord{NameServer: name}, nil
+		default:
+			return &PTRRecord{PTRDName: name}, nil
+		}
+
+	case RecordTypeMX:
+		if len(data) < 3 {
+			return nil, errors.New("invalid MX record")
+		}
+		target, offset, err := readName(data, 2)
+		if err != nil {
+			return nil, err
+		}
+		if offset != len(data) {
+			return nil, errors.New("trailing record data")
+		}
+		return &MXRecord{Priority: binary.BigEndian.Uint16(data[0:2]), Target: target}, nil
+
+	case RecordTypeSOA:
+		mName, offset, err := readName(data, 0)
+		if err != nil {
+			return nil, err
+		}
+		rName, offset, err := readName(data, offset)
+		if err != nil {
+			return nil, err
+		}
+		if offset+20 != len(data) {
+			return nil, errors.New("invalid SOA record")
+		}
+		return &SOARecord{
+			MName:        mName,
+			RName:        rName,
+			SerialNumber: binary.BigEndian.Uint32(data[offset : offset+4]),
+			Refresh:      binary.BigEndian.Uint32(data[offset+4 : offset+8]),
+			Retry:        binary.BigEndian.Uint32(data[offset+8 : offset+12]),
+			Expire:       binary.BigEndian.Uint32(data[offset+12 : offset+16]),
+			Minimum:      binary.BigEndian.Uint32(data[offset+16 : offset+20]),
+		}, nil
+
+	case RecordTypeSRV:
+		if len(data) < 7 {
+			return nil, errors.New("invalid SRV record")
+		}
+		target, offset, err := readName(data, 6)
+		if err != nil {
+			return nil, err
+		}
+		if offset != len(data) {
+			return nil, errors.New("trailing record data")
+		}
+		return &SRVRecord{
+			Priority: binary.BigEndian.Uint16(data[0:2]),
+			Weight:   binary.BigEndian.Uint16(data[2:4]),
+			Port:     binary.BigEndian.Uint16(data[4:6]),
+			Target:   target,
+		}, nil
+
+	case RecordTypeTXT:
+		record := &TXTRecord{}
+		for offset := 0; offset < len(data); {
+			length := int(data[offset])
+			offset++
+			if offset+length > len(data) {
+				return nil, errors.New("invalid TXT record")
+			}
+			record.Text = append(record.Text, string(data[offset:offset+length]))
+			offset += length
+		}
+		return record, nil
+
+	case RecordTypeCAA:
+		if len(data) < 2 || 2+int(data[1]) > len(data) {
+			return nil, errors.New("invalid CAA record")
+		}
+		tagEnd := 2 + int(data[1])
+		return &CAARecord{
+			Flag:  data[0],
+			Tag:   string(data[2:tagEnd]),
+			Value: string(data[tagEnd:]),
+		}, nil
+	}
+
+	return &UnknownRecord{RRType: recordType, Data: append([]byte(nil), data...)}, nil
+}
+
+// -- TYPE -- //
+
+func (r *ARecord) Type() RecordType       { return RecordTypeA }
+func (r *AAAARecord) Type() RecordType    { return RecordTypeAAAA }
+func (r *CNAMERecord) Type() RecordType   { return RecordTypeCNAME }
+func (r *MXRecord) Type() RecordType      { return RecordTypeMX }
+func (r *NSRecord) Type() RecordType      { return RecordTypeNS }
+func (r *PTRRecord) Type() RecordType     { return RecordTypePTR }
+func (r *SOARecord) Type() RecordType     { return RecordTypeSOA }
+func (r *TXTRecord) Type() RecordType     { return RecordTypeTXT }
+func (r *CAARecord) Type() RecordType     { return RecordTypeCAA }
+func (r *SRVRecord) Type() RecordType     { return RecordTypeSRV }
+func (r *UnknownRecord) Type() RecordType { return r.RRType }
+
+// -- MARSHAL -- //
+
+func (r *ARecord) Marshal() ([]byte, error) {
+	ip := net.ParseIP(r.IPAddress).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IPv4 address %q", r.IPAddress)
+	}
+	return ip, nil
+}
+
+func (r *AAAARecord) Marshal() ([]byte, error) {
+	ip := net.ParseIP(r.IPAddress)
+	if ip == nil || ip.To4() != nil {
+		return nil, fmt.Errorf("invalid IPv6 address %q", r.IPAddress)
+	}
+	return ip.To16(), nil
+}
+
+func (r *CNAMERecord) Marshal() ([]byte, error) {
+	return appendName(nil, r.Target)
+}
+
+func (r *MXRecord) Marshal() ([]byte, error) {
+	return appendName(binary.BigEndian.AppendUint16(nil, r.Priority), r.Target)
+}
+
+func (r *NSRecord) Marshal() ([]byte, error) {
+	return appendName(nil, r.NameServer)
+}
+
+func (r *PTRRecord) Marshal() ([]byte, error) {
+	return appendName(nil, r.PTRDName)
+}
+
+func (r *SOARecord) Marshal() ([]byte, error) {
+	data, err := appendName(nil, r.MName)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = appendName(data, r.RName); err != nil {
+		return nil, err
+	}
+	for _, field := range []uint32{r.SerialNumber, r.Refresh, r.Retry, r.Expire, r.Minimum} {
+		data = binary.BigEndian.AppendUint32(data, field)
+	}
+	return data, nil
+}
+
+func (r *TXTRecord) Marshal() ([]byte, error) {
+	var data []byte
+	for _, text := range r.Text {
+		if len(text) > 255 {
+			return nil, errors.New("TXT string too long")
+		}
+		data = append(data, byte(len(text)))
+		data = append(data, text...)
+	}
+	if len(data) == 0 {
+		// TXT must carry at least one, possibly empty, string
+		data = []byte{0}
+	}
+	return data, nil
+}
+
+func (r *CAARecord) Marshal() ([]byte, error) {
+	if len(r.Tag) == 0 || len(r.Tag) > 255 {
+		return nil, errors.New("invalid CAA tag")
+	}
+	data := []byte{r.Flag, byte(len(r.Tag))}
+	data = append(data, r.Tag...)
+	return append(data, r.Value...), nil
+}
+
+func (r *SRVRecord) Marshal() ([]byte, error) {
+	data := binary.BigEndian.AppendUint16(nil, r.Priority)
+	data = binary.BigEndian.AppendUint16(data, r.Weight)
+	data = binary.BigEndian.AppendUint16(data, r.Port)
+	return appendName(data, r.Target)
+}
+
+func (r *UnknownRecord) Marshal() ([]byte, error) {
+	return append([]byte(nil), r.Data...), nil
+}
+
+// -- PRESENTATION FORMAT -- //
+
+func (r *ARecord) String() string     { return r.IPAddress }
+func (r *AAAARecord) String() string  { return r.IPAddress }
+func (r *CNAMERecord) String() string { return fqdn(r.Target) }
+func (r *NSRecord) String() string    { return fqdn(r.NameServer) }
+func (r *PTRRecord) String() string   { return fqdn(r.PTRDName) }
+
+func (r *MXRecord) String() string {
+	return fmt.Sprintf("%d %s", r.Priority, fqdn(r.Target))
+}
+
+func (r *SOARecord) String() string {
+	return fmt.Sprintf("%s %s %d %d %d %d %d", fqdn(r.MName), fqdn(r.RName),
+		r.SerialNumber, r.Refresh, r.Retry, r.Expire, r.Minimum)
+}
+
+func (r *TXTRecord) String() string {
+	quoted := make([]string, 0, len(r.Text))
+	for _, text := range r.Text {
+		quoted = append(quoted, quoteString(text))
+	}
+	return strings.Join(quoted, " ")
+}
+
+func (r *CAARecord) String() string {
+	return fmt.Sprintf("%d %s %s", r.Flag, r.Tag, quoteString(r.Value))
+}
+
+func (r *SRVRecord) String() string {
+	return fmt.Sprintf("%d %d %d %s", r.Priority, r.Weight, r.Port, fqdn(r.Target))
+}
+
+func (r *UnknownRecord) String() string {
+	if len(r.Data) == 0 {
+		return `\# 0`
+	}
+	return fmt.Sprintf(`\# %d %s`, len(r.Data), hex.EncodeToString(r.Data))
+}
+
+// -- HELPERS -- //
+
+func fqdn(name string) string {
+	return strings.TrimSuffix(name, ".") + "."
+}
+
+// quoteString escapes a character-string for zone files, non printable bytes as \DDD
+func quoteString(text string) string {
+	var buf bytes.Buffer
+	buf.WriteByte('"')
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c == '"' || c == '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case c < 0x20 || c > 0x7E:
+			buf.WriteString(fmt.Sprintf("\\%03d", c))
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
+
+// readName reads an uncompressed name in wire format
+func readName(data []byte, offset int) (string, int, error) {
+	var labels []string
+	for {
+		if offset >= len(data) {
+			return "", 0, errors.New("truncated domain name")
+		}
+		length := int(data[offset])
+		offset++
+		if length == 0 {
+			return strings.Join(labels, "."), offset, nil
+		}
+		if length > 63 {
+			return "", 0, errors.New("compressed or invalid domain name")
+		}
+		if offset+length > len(data) {
+			return "", 0, errors.New("truncated domain name")
+		}
+		labels = append(labels, EscapeLabel(data[offset:offset+length]))
+		offset += length
+	}
+}
+
+func appendName(data []byte, name string) ([]byte, error) {
+	labels := SplitName(name)
+	length := 1
+	for _, label := range labels {
+		label = UnescapeLabel(label)
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("invalid label in %q", name)
+		}
+		length += len(label) + 1
+		data = append(data, byte(len(label)))
+		data = append(data, label...)
+	}
+	if length > 255 {
+		return nil, errors.New("domain name too long")
+	}
+	return append(data, 0), nil
+}
@@ -0,0 +1,95 @@
+package cache
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRDataRoundTrip(t *testing.T) {
+	tests := []struct {
+		rdata RData
+		text  string
+	}{
+		{&ARecord{IPAddress: "192.0.2.1"}, "192.0.2.1"},
+		{&AAAARecord{IPAddress: "2001:db8::1"}, "2001:db8::1"},
+		{&CNAMERecord{Target: "www.example.com"}, "www.example.com."},
+		{&CNAMERecord{Target: `a\.b.example`}, `a\.b.example.`},
+		{&NSRecord{NameServer: "ns1.example.com"}, "ns1.example.com."},
+		{&PTRRecord{PTRDName: "host.example.com"}, "host.example.com."},
+		{&MXRecord{Priority: 10, Target: "mail.example.com"}, "10 mail.example.com."},
+		{&SOARecord{MName: "ns.example.com", RName: "hostmaster.example.com", SerialNumber: 2024010101,
+			Refresh: 7200, Retry: 3600, Expire: 1209600, Minimum: 300},
+			"ns.example.com. hostmaster.example.com. 2024010101 7200 3600 1209600 300"},
+		{&SRVRecord{Priority: 1, Weight: 5, Port: 5060, Target: "sip.example.com"}, "1 5 5060 sip.example.com."},
+		{&TXTRecord{Text: []string{"v=spf1 -all", `say "hi"\`, "tab\there"}}, `"v=spf1 -all" "say \"hi\"\\" "tab\009here"`},
+		{&CAARecord{Flag: 128, Tag: "issue", Value: "ca.example.net"}, `128 issue "ca.example.net"`},
+		{&UnknownRecord{RRType: 65280, Data: []byte{0x0a, 0x0b, 0x0c}}, `\# 3 0a0b0c`},
+		{&UnknownRecord{RRType: 65280}, `\# 0`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.rdata.Type().String(), func(t *testing.T) {
+			if got := tt.rdata.String(); got != tt.text {
+				t.Errorf("String() = %s, want %s", got, tt.text)
+			}
+
+			data, err := tt.rdata.Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed, err := ParseRData(tt.rdata.Type(), data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(parsed, tt.rdata) {
+				t.Errorf("parsed back as %#v, want %#v", parsed, tt.rdata)
+			}
+		})
+	}
+}
+
+func TestParseRDataMalformed(t *testing.T) {
+	tests := []struct {
+		name       string
+		recordType RecordType
+		data       []byte
+	}{
+		{"A of 5 bytes", RecordTypeA, []byte{192, 0, 2, 1, 0}},
+		{"AAAA of 4 bytes", RecordTypeAAAA, []byte{192, 0, 2, 1}},
+		{"name running past the end", RecordTypeCNAME, []byte{7, 'e', 'x'}},
+		{"compressed name", RecordTypeNS, []byte{0xC0, 12}},
+		{"trailing data", RecordTypePTR, []byte{0, 1}},
+		{"MX without a name", RecordTypeMX, []byte{0, 10}},
+		{"SOA without its numbers", RecordTypeSOA, []byte{0, 0, 1, 2, 3}},
+		{"TXT string past the end", RecordTypeTXT, []byte{5, 'a'}},
+		{"CAA tag past the end", RecordTypeCAA, []byte{0, 9, 'i'}},
+	}
+	for _, tt := range tests {
+		if _, err := ParseRData(tt.recordType, tt.data); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
+
+func TestMarshalInvalidNames(t *testing.T) {
+	for _, name := range []string{"www..example", strings.Repeat("a", 64) + ".example", strings.Repeat(strings.Repeat("a", 63)+".", 4)} {
+		if _, err := (&CNAMERecord{Target: name}).Marshal(); err == nil {
+			t.Errorf("marshalled %q", name)
+		}
+	}
+}
+
+func TestRecordTypeNames(t *testing.T) {
+	for name, want := range map[string]RecordType{"AAAA": RecordTypeAAAA, "mx": RecordTypeMX, "TYPE65280": 65280, "99": 99} {
+		if got, ok := ParseRecordType(name); !ok || got != want {
+			t.Errorf("ParseRecordType(%q) = %d, %v, want %d", name, got, ok, want)
+		}
+	}
+	if _, ok := ParseRecordType("BOGUS"); ok {
+		t.Error("parsed an unknown mnemonic")
+	}
+	if got := RecordType(65280).String(); got != "TYPE65280" {
+		t.Errorf("String() = %s, want the generic form", got)
+	}
+}
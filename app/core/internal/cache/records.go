@@ -13,15 +13,48 @@ const (
 	RecordTypePTR      RecordType = 12
 	RecordTypeSOA      RecordType = 6
 	RecordTypeSRV      RecordType = 33
+	RecordTypeDNAME    RecordType = 39
 	RecordTypeTXT      RecordType = 16
 	RecordTypeCAA      RecordType = 257
+	RecordTypeDS       RecordType = 43
+	RecordTypeRRSIG    RecordType = 46
+	RecordTypeNSEC     RecordType = 47
+	RecordTypeDNSKEY   RecordType = 48
+	RecordTypeNSEC3    RecordType = 50
 	RecordTypeNXDomain RecordType = 65535
 )
 
 type Record struct {
 	Type      RecordType
-	ExpiresAt time.Time // CreatedAt + TTL
-	Data      []byte    // record specific data
+	CreatedAt time.Time
+	ExpiresAt time.Time // CreatedAt + TTL, lowest TTL among the records
+	Answers   []RR      // complete answer RRset, along with the CNAME chain leading to it
+
+	// negative answers as per RFC 2308, NXDOMAIN is kept under RecordTypeNXDomain
+	// as it holds for every type, NODATA under the type that was asked for
+	Negative  bool
+	RCode     uint16
+	Authority []RR // SOA of the zone, which is sent along with negative answers
+
+	Secure bool // validated with DNSSEC before it was cached
+}
+
+// RemainingTTL counts a TTL stored at CreatedAt down to now
+func (r *Record) RemainingTTL(ttl uint32) uint32 {
+	elapsed := uint32(time.Since(r.CreatedAt).Seconds())
+	if elapsed >= ttl {
+		return 0
+	}
+	return ttl - elapsed
+}
+
+// RR is a resource record as kept in the cache
+type RR struct {
+	Name  string
+	Type  RecordType
+	Class uint16
+	TTL   uint32
+	Data  []byte
 }
 
 type ARecord struct {
@@ -52,7 +85,7 @@ type PTRRecord struct {
 type SOARecord struct {
 	MName        string
 	RName        string
-	SerialNumber string
+	SerialNumber uint32
 	Refresh      uint32
 	Retry        uint32
 	Expire       uint32
@@ -0,0 +1,28 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRemainingTTL(t *testing.T) {
+	record := &Record{CreatedAt: time.Now().Add(-100 * time.Second)}
+
+	tests := []struct {
+		name string
+		ttl  uint32
+		want uint32
+	}{
+		{"counting down", 300, 200},
+		{"just run out", 100, 0},
+		{"long past", 60, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// a second may tick over between creating the record and counting down
+			if got := record.RemainingTTL(tt.ttl); got != tt.want && got+1 != tt.want {
+				t.Errorf("RemainingTTL(%d) = %d, want %d", tt.ttl, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package cache
+
+import (
+	"time"
+)
+
+const cacheShards = 32
+
+func NewShardedCache(maxBytes int) *ShardedCache {
+	cache := &ShardedCache{
+		shards:    make([]*cacheShard, cacheShards),
+		cleanUpCh: make(chan struct{}),
+	}
+	for i := range cache.shards {
+		cache.shards[i] = &cacheShard{
+			items:    make(map[string]*entry),
+			maxBytes: maxBytes / cacheShards,
+		}
+	}
+	cache.prefetchState.init(cacheShards, cache.peek)
+
+	go cache.startCleanUp()
+	go cache.startPrefetch()
+
+	return cache
+}
+
+func (c *ShardedCache) shard(key string) *cacheShard {
+	return c.shards[shardIndex(key, len(c.shards))]
+}
+
+func (c *ShardedCache) Get(domain string, recordType uint16) (*Record, bool) {
+	key := NewCacheKey(domain, RecordType(recordType)).String()
+	shard := c.shard(key)
+	now := time.Now()
+
+	shard.mutex.Lock()
+	e, found := shard.items[key]
+	if !found {
+		shard.mutex.Unlock()
+		return nil, false
+	}
+
+	// check if the entry has expired, it is kept around a while longer to be served stale
+	if now.After(e.record.ExpiresAt) {
+		if c.isPastStale(e.record, now) {
+			shard.remove(e)
+		}
+		shard.mutex.Unlock()
+		return nil, false
+	}
+
+	shard.moveToFront(e)
+	record := e.record
+	shard.mutex.Unlock()
+
+	// counting the hit towards the entry's popularity for prefetching
+	c.trackAccess(key, domain, recordType)
+
+	return record, true
+}
+
+func (c *ShardedCache) GetStale(domain string, recordType uint16) (*Record, bool) {
+	key := NewCacheKey(domain, RecordType(recordType)).String()
+	shard := c.shard(key)
+
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	e, found := shard.items[key]
+	if !found || c.isPastStale(e.record, time.Now()) {
+		return nil, false
+	}
+
+	return e.record, true
+}
+
+func (c *ShardedCache) Set(domain string, record *Record) {
+	key := NewCacheKey(domain, record.Type).String()
+	shard := c.shard(key)
+	size := entrySize(key, record)
+
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	if size > shard.maxBytes {
+		// would push everything else out
+		if e, found := shard.items[key]; found {
+			shard.remove(e)
+		}
+		return
+	}
+
+	if e, found := shard.items[key]; found {
+		shard.bytes += size - e.size
+		e.record = record
+		e.size = size
+		shard.moveToFront(e)
+	} else {
+		e = &entry{
+			key:    key,
+			record: record,
+			size:   size,
+		}
+		shard.items[key] = e
+		shard.pushFront(e)
+		shard.bytes += size
+	}
+
+	// evicting the least recently used entries until it fits again
+	for shard.bytes > shard.maxBytes && shard.tail != nil {
+		shard.remove(shard.tail)
+	}
+}
+
+func (c *ShardedCache) Remove(domain string, recordType uint16) {
+	key := NewCacheKey(domain, RecordType(recordType)).String()
+	shard := c.shard(key)
+
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	if e, found := shard.items[key]; found {
+		shard.remove(e)
+	}
+}
+
+func (c *ShardedCache) Close() {
+	close(c.cleanUpCh)
+	close(c.stop)
+}
+
+// peek returns the record under key without moving it to the front
+func (c *ShardedCache) peek(key string) *Record {
+	shard := c.shard(key)
+
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	if e, found := shard.items[key]; found {
+		return e.record
+	}
+	return nil
+}
+
+func (s *cacheShard) remove(e *entry) {
+	delete(s.items, e.key)
+	s.removeEntry(e)
+	s.bytes -= e.size
+}
+
+func (c *ShardedCache) startCleanUp() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.removeExpired()
+		case <-c.cleanUpCh:
+			return
+		}
+	}
+}
+
+// removeExpired goes through one shard at a time, so lookups are only ever held up by a single shard
+func (c *ShardedCache) removeExpired() {
+	for _, shard := range c.shards {
+		now := time.Now()
+
+		shard.mutex.Lock()
+		for _, e := range shard.items {
+			if c.isPastStale(e.record, now) {
+				shard.remove(e)
+			}
+		}
+		shard.mutex.Unlock()
+	}
+}
@@ -0,0 +1,67 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestServeStaleWindow(t *testing.T) {
+	c := DNSCache(10)
+	defer c.Close()
+	c.SetStaleWindow(time.Hour)
+
+	now := time.Now()
+	records := []struct {
+		name      string
+		expiresAt time.Time
+		fresh     bool
+		stale     bool
+	}{
+		{"fresh.test", now.Add(time.Minute), true, true},
+		{"expired.test", now.Add(-time.Minute), false, true},
+		{"past-window.test", now.Add(-2 * time.Hour), false, false},
+	}
+	for _, r := range records {
+		c.Set(r.name, &Record{Type: RecordTypeA, CreatedAt: now.Add(-3 * time.Hour), ExpiresAt: r.expiresAt})
+	}
+
+	for _, r := range records {
+		t.Run(r.name, func(t *testing.T) {
+			if _, found := c.GetStale(r.name, uint16(RecordTypeA)); found != r.stale {
+				t.Errorf("GetStale found %v, want %v", found, r.stale)
+			}
+			if _, found := c.Get(r.name, uint16(RecordTypeA)); found != r.fresh {
+				t.Errorf("Get found %v, want %v", found, r.fresh)
+			}
+			// an expired lookup doesn't drop what can still be served stale
+			if _, found := c.GetStale(r.name, uint16(RecordTypeA)); found != r.stale {
+				t.Errorf("GetStale after Get found %v, want %v", found, r.stale)
+			}
+		})
+	}
+}
+
+func TestRemoveExpiredKeepsStale(t *testing.T) {
+	c := DNSCache(10)
+	defer c.Close()
+	c.SetStaleWindow(time.Hour)
+
+	now := time.Now()
+	c.Set("expired.test", &Record{Type: RecordTypeA, ExpiresAt: now.Add(-time.Minute)})
+	c.Set("past-window.test", &Record{Type: RecordTypeA, ExpiresAt: now.Add(-2 * time.Hour)})
+	c.removeExpired()
+
+	if _, found := c.items[NewCacheKey("expired.test", RecordTypeA).String()]; !found {
+		t.Error("entry within the stale window removed")
+	}
+	if _, found := c.items[NewCacheKey("past-window.test", RecordTypeA).String()]; found {
+		t.Error("entry past the stale window kept")
+	}
+
+	// without a window, expired entries go right away
+	c.SetStaleWindow(0)
+	c.removeExpired()
+	if len(c.items) != 0 {
+		t.Errorf("%d entries left without a stale window", len(c.items))
+	}
+}
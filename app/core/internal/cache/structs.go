@@ -2,32 +2,88 @@ package cache
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type entry struct {
 	key    string
 	record *Record // DNS record
+	size   int     // estimated memory used, in bytes
 	prev   *entry
 	next   *entry
 }
 
+// lruList links entries from the most to the least recently used
+type lruList struct {
+	head *entry // most recently used
+	tail *entry // least recently used
+}
+
 type LRUCache struct {
 	capacity  int
 	items     map[string]*entry
-	head      *entry // most recently used
-	tail      *entry // least recently used
 	mutex     sync.RWMutex
 	cleanUpCh chan struct{} // signal to clean up expired entries
+	lruList
+
+	staleWindow   // expired entries are kept this long to be served stale
+	prefetchState // popular entries are refreshed before they expire
+}
+
+// ShardedCache spreads the entries over shards with a lock and an LRU list each,
+// so lookups for different names don't wait on each other
+type ShardedCache struct {
+	shards    []*cacheShard
+	cleanUpCh chan struct{} // signal to clean up expired entries
+
+	staleWindow
+	prefetchState
+}
+
+type cacheShard struct {
+	items    map[string]*entry
+	mutex    sync.Mutex
+	bytes    int // memory used by the entries
+	maxBytes int
+	lruList
+}
+
+type staleWindow struct {
+	window atomic.Int64 // time.Duration
+}
 
-	// prefetch
-	prefetch      chan struct{}
+type prefetchState struct {
+	stop     chan struct{}            // signal to stop prefetching
+	peek     func(key string) *Record // looks up an entry without counting it as used
+	settings atomic.Pointer[prefetchSettings]
+	metrics  []*metricsShard // sharded like the entries, to keep hits from contending
+
+	prefetchCount atomic.Uint64 // entries refreshed ahead of expiry
+	prefetchHits  atomic.Uint64 // refreshed entries that went on to serve a hit
+}
+
+type prefetchSettings struct {
+	prefetcher    Prefetcher
 	slidingWindow time.Duration
 	topCount      int
+	minHits       int
+	threshold     int // percentage of the TTL left
+}
+
+type metricsShard struct {
+	mutex   sync.Mutex
+	metrics map[string]*domainMetrics
 }
 
 type domainMetrics struct {
 	domain                string
-	numberOfTimesAccessed int
+	recordType            uint16
+	numberOfTimesAccessed int // within the current window
 	lastAccessed          time.Time
+
+	windowStart   time.Time
+	previousCount int  // accesses in the window before the current one
+	refreshing    bool // prefetch in flight
+	prefetched    bool // refreshed, waiting for a hit
 }
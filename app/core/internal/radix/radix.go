@@ -170,6 +170,40 @@ func (node *Node) search(word string) *string {
 	return currNode.data
 }
 
+// longestMatch returns the longest key that is a prefix of the word and ends where
+// the word does or right before one of the separators, along with its data
+func (node *Node) longestMatch(word string, separator byte) (string, *string) {
+	var matchedKey string
+	var matchedData *string
+
+	currNode := node
+	consumed := 0
+	for {
+		if currNode.endOfWord && (consumed == len(word) || word[consumed] == separator) {
+			matchedKey, matchedData = word[:consumed], currNode.data
+		}
+		if consumed == len(word) || currNode.children == nil {
+			break
+		}
+
+		remainingWord := word[consumed:]
+		found := false
+		for key, child := range currNode.children {
+			if strings.HasPrefix(remainingWord, key) {
+				consumed += len(key)
+				currNode = child
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			break
+		}
+	}
+	return matchedKey, matchedData
+}
+
 func (node *Node) commonPrefixLength(word1 string, word2 string) int {
 	i := 0
 	for i < min(len(word1), len(word2)) && word1[i] == word2[i] {
@@ -203,6 +237,12 @@ func (tree *Tree) Search(word string) *string {
 	return tree.root.search(word)
 }
 
+// LongestMatch finds the longest key the word starts with, only matching whole
+// separator delimited parts of the word. The key is empty if nothing matched.
+func (tree *Tree) LongestMatch(word string, separator byte) (string, *string) {
+	return tree.root.longestMatch(word, separator)
+}
+
 func (tree *Tree) GetItems() map[string]string {
 	items := make(map[string]string)
 	tree.root.getItems(&items, "")
@@ -0,0 +1,40 @@
+package radix
+
+import "testing"
+
+func TestLongestMatch(t *testing.T) {
+	tree := NewRadixTree()
+	for _, key := range []string{"com.example", "com.example.corp", "arpa.in-addr.10"} {
+		data := key
+		tree.Insert(key, &data)
+	}
+
+	tests := []struct {
+		word string
+		want string
+	}{
+		{"com.example", "com.example"},
+		{"com.example.www", "com.example"},
+		{"com.example.corp.host", "com.example.corp"},
+		{"com.example.corp", "com.example.corp"},
+		// keys only match whole labels
+		{"com.example.corporate", "com.example"},
+		{"com.examples.www", ""},
+		{"com.exam", ""},
+		{"arpa.in-addr.10.1.2.3", "arpa.in-addr.10"},
+		{"arpa.in-addr.100.1", ""},
+		{"org.example", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.word, func(t *testing.T) {
+			key, data := tree.LongestMatch(tt.word, '.')
+			if key != tt.want {
+				t.Errorf("LongestMatch(%q) = %q, want %q", tt.word, key, tt.want)
+			}
+			if tt.want == "" && data != nil || tt.want != "" && (data == nil || *data != tt.want) {
+				t.Errorf("LongestMatch(%q) returned the data of another key", tt.word)
+			}
+		})
+	}
+}
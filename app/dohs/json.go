@@ -0,0 +1,141 @@
+package dohs
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"omamori/app/core/dns"
+	"strings"
+)
+
+// JSON API in the format of Google Public DNS and Cloudflare, for clients that can't build wire format messages
+
+const dnsJsonType = "application/dns-json"
+
+type jsonQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+type jsonRecord struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+type jsonResponse struct {
+	Status     uint16         `json:"Status"`
+	TC         bool           `json:"TC"`
+	RD         bool           `json:"RD"`
+	RA         bool           `json:"RA"`
+	AD         bool           `json:"AD"`
+	CD         bool           `json:"CD"`
+	Question   []jsonQuestion `json:"Question"`
+	Answer     []jsonRecord   `json:"Answer,omitempty"`
+	Authority  []jsonRecord   `json:"Authority,omitempty"`
+	Additional []jsonRecord   `json:"Additional,omitempty"`
+}
+
+// wantsJson tells requests for the JSON API sent to the DoH path, the way Cloudflare takes them
+func wantsJson(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), dnsJsonType)
+}
+
+// resolveHandler answers /resolve?name=example.com&type=AAAA, with optional cd and do flags
+func resolveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeJsonError(w, http.StatusMethodNotAllowed, "Only GET is supported")
+		return
+	}
+
+	params := r.URL.Query()
+	name := strings.TrimSuffix(strings.TrimSpace(params.Get("name")), ".")
+	if name == "" {
+		writeJsonError(w, http.StatusBadRequest, "Invalid name parameter")
+		return
+	}
+	if err := dns.ValidateName(name); err != nil {
+		writeJsonError(w, http.StatusBadRequest, fmt.Sprintf("Invalid name parameter: %v", err))
+		return
+	}
+
+	qtype := uint16(1) // A, when no type is given
+	if typeParam := params.Get("type"); typeParam != "" {
+		var ok bool
+		if qtype, ok = dns.ParseType(typeParam); !ok {
+			writeJsonError(w, http.StatusBadRequest, fmt.Sprintf("Invalid type parameter %q", typeParam))
+			return
+		}
+	}
+
+	query := &dns.Query{
+		Header:    &dns.Header{FLAGS: dns.FlagRD, QDCOUNT: 1},
+		Questions: []*dns.Question{{Name: name, Type: qtype, Class: 1}},
+	}
+	if flagParam(params.Get("cd")) {
+		query.Header.FLAGS |= dns.FlagCD
+	}
+	if flagParam(params.Get("do")) {
+		query.Edns = &dns.OPT{UDPSize: maxMessageSize, Flags: dns.EdnsFlagDO}
+	} else {
+		query.Header.FLAGS |= dns.FlagAD // AD is still reported without the DNSSEC records (RFC 6840 5.7)
+	}
+
+	// same path as wire format queries, blocking and custom mappings included
+	resp, err := dns.DecodeDNSQuery(dns.Lookup(query))
+	if err != nil {
+		writeJsonError(w, http.StatusInternalServerError, "Failed to resolve the name")
+		return
+	}
+
+	flags := resp.Header.FLAGS
+	body := jsonResponse{
+		Status:     resp.RCode(),
+		TC:         flags&dns.FlagTC != 0,
+		RD:         flags&dns.FlagRD != 0,
+		RA:         flags&dns.FlagRA != 0,
+		AD:         flags&dns.FlagAD != 0,
+		CD:         flags&dns.FlagCD != 0,
+		Question:   []jsonQuestion{{Name: name + ".", Type: qtype}},
+		Answer:     jsonRecords(resp.Answer),
+		Authority:  jsonRecords(resp.Authority),
+		Additional: jsonRecords(resp.Additional),
+	}
+
+	if maxAge, ok := resp.MaxAge(); ok {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", maxAge))
+	}
+	contentType := "application/json"
+	if wantsJson(r) {
+		contentType = dnsJsonType
+	}
+	w.Header().Set("Content-Type", contentType)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// jsonRecords renders the records with their data in presentation format, parsed by type
+func jsonRecords(records []*dns.Answer) []jsonRecord {
+	rendered := make([]jsonRecord, 0, len(records))
+	for _, rr := range records {
+		rendered = append(rendered, jsonRecord{
+			Name: strings.TrimSuffix(rr.Name, ".") + ".",
+			Type: rr.Type,
+			TTL:  rr.TTL,
+			Data: rr.DataString(),
+		})
+	}
+	return rendered
+}
+
+// flagParam reads cd and do, which take 1 or true like the public JSON APIs
+func flagParam(value string) bool {
+	return value == "1" || strings.EqualFold(value, "true")
+}
+
+func writeJsonError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
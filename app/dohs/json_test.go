@@ -0,0 +1,37 @@
+package dohs
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestResolveHandlerRejectsInvalidNames(t *testing.T) {
+	label64 := strings.Repeat("a", 64)
+	tests := []struct {
+		name  string
+		query string
+	}{
+		{"missing name", ""},
+		{"label over 63 bytes", label64 + ".example"},
+		{"empty label", "www..example"},
+		{"name over 255 bytes", strings.Repeat(strings.Repeat("a", 63)+".", 4) + "example"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			resolveHandler(recorder, httptest.NewRequest("GET", "/resolve?name="+url.QueryEscape(tt.query), nil))
+
+			if recorder.Code != http.StatusBadRequest {
+				t.Errorf("status %d, want %d", recorder.Code, http.StatusBadRequest)
+			}
+			var body map[string]string
+			if err := json.NewDecoder(recorder.Body).Decode(&body); err != nil || body["error"] == "" {
+				t.Errorf("no error in the body: %v", err)
+			}
+		})
+	}
+}
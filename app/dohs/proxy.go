@@ -0,0 +1,55 @@
+package dohs
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// forwardedFor replaces the remote address of requests relayed by a trusted proxy with
+// the client's own, taken from X-Forwarded-For. Anything else sending it is ignored.
+// The address is only logged, resolving doesn't depend on the client.
+func forwardedFor(next http.Handler, proxies []*net.IPNet) http.Handler {
+	if len(proxies) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if client := forwardedClient(r, proxies); client != nil {
+			r.RemoteAddr = net.JoinHostPort(client.String(), "0")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// forwardedClient walks X-Forwarded-For from the right, the first address that isn't one of
+// the proxies is the client. The ones further left were added by the client itself.
+func forwardedClient(r *http.Request, proxies []*net.IPNet) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil || !trustedProxy(net.ParseIP(host), proxies) {
+		return nil
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			return nil
+		}
+		if !trustedProxy(ip, proxies) {
+			return ip
+		}
+	}
+	return nil
+}
+
+func trustedProxy(ip net.IP, proxies []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range proxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
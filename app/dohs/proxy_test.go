@@ -0,0 +1,68 @@
+package dohs
+
+import (
+	"net"
+	"net/http/httptest"
+	"omamori/app/core/config"
+	"testing"
+)
+
+func TestForwardedClient(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/24")
+	trusted := []*net.IPNet{proxies}
+
+	tests := []struct {
+		name      string
+		peer      string
+		forwarded []string
+		want      string // empty for keeping the peer address
+	}{
+		{"untrusted peer", "192.0.2.1:4000", []string{"198.51.100.7"}, ""},
+		{"trusted proxy", "10.0.0.1:4000", []string{"198.51.100.7"}, "198.51.100.7"},
+		{"chain of trusted proxies", "10.0.0.1:4000", []string{"198.51.100.7, 10.0.0.2", "10.0.0.3"}, "198.51.100.7"},
+		{"spoofed left-most entry", "10.0.0.1:4000", []string{"203.0.113.9, 198.51.100.7"}, "198.51.100.7"},
+		{"unparsable hop", "10.0.0.1:4000", []string{"198.51.100.7, unknown"}, ""},
+		{"only proxies", "10.0.0.1:4000", []string{"10.0.0.2"}, ""},
+		{"no header", "10.0.0.1:4000", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/dns-query", nil)
+			r.RemoteAddr = tt.peer
+			for _, value := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+
+			client := forwardedClient(r, trusted)
+			if tt.want == "" {
+				if client != nil {
+					t.Errorf("client %s, want the peer kept", client)
+				}
+			} else if !client.Equal(net.ParseIP(tt.want)) {
+				t.Errorf("client %v, want %s", client, tt.want)
+			}
+		})
+	}
+}
+
+func TestListenHost(t *testing.T) {
+	saved := *config.Global
+	t.Cleanup(func() { *config.Global = saved })
+
+	tests := []struct {
+		address string
+		plain   bool
+		want    string
+	}{
+		{"", false, ""},
+		{"", true, "127.0.0.1"},
+		{"0.0.0.0", true, "0.0.0.0"},
+		{"192.0.2.1", false, "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		config.Global.DohAddress, config.Global.DohPlainHTTP = tt.address, tt.plain
+		if host := listenHost(); host != tt.want {
+			t.Errorf("address %q with plain HTTP %v listens on %q, want %q", tt.address, tt.plain, host, tt.want)
+		}
+	}
+}
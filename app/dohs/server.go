@@ -4,32 +4,72 @@ package dohs
 
 import (
 	"context"
+	"crypto/tls"
 	b64 "encoding/base64"
 	"errors"
+	"fmt"
 	"io"
 	"log"
+	"mime"
+	"net"
 	"net/http"
+	"omamori/app/core/channels"
 	"omamori/app/core/config"
 	"omamori/app/core/dns"
+	"strconv"
 	"strings"
 	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
-var (
-	publicKEY  = config.Global.CertPath
-	privateKEY = config.Global.KeyPath
+const (
+	dnsMessageType = "application/dns-message"
+	maxMessageSize = 65535 // the largest DNS message, also over DoH (RFC 8484 6)
 )
 
-func RunHttpServer(ctx context.Context) {
+// RunHttpServer serves DOHS until the context is done, the error is for failing to start
+func RunHttpServer(ctx context.Context) error {
 	serv := &http.Server{
-		Addr:    ":443",
-		Handler: http.HandlerFunc(dohsHandler),
+		Handler:           forwardedFor(newMux(), config.TrustedProxyNetworks()),
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+
+	// certificates are read on every start, so changed paths apply without restarting the app
+	if !config.Global.DohPlainHTTP {
+		cert, err := tls.LoadX509KeyPair(config.Global.CertPath, config.Global.KeyPath)
+		if err != nil {
+			return fmt.Errorf("loading the certificate: %w", err)
+		}
+		serv.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+	} else {
+		// the reverse proxy in front does TLS, HTTP/2 still works in cleartext with prior knowledge (RFC 9113 3.3)
+		serv.Handler = h2c.NewHandler(serv.Handler, &http2.Server{})
+	}
+
+	addr := net.JoinHostPort(listenHost(), strconv.Itoa(config.Global.DohPort))
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("binding the listener: %w", err)
 	}
 
 	go func() {
-		log.Println("Starting DOHS server on port 443")
-		if err := serv.ListenAndServeTLS(publicKEY, privateKEY); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			log.Fatalf("DOHS server error: %v", err)
+		var err error
+		if serv.TLSConfig != nil {
+			// HTTP/2 is negotiated over ALPN, the minimum version recommended (RFC 8484 5.2)
+			log.Println("Starting DOHS server on", addr)
+			err = serv.ServeTLS(listener, "", "")
+		} else {
+			log.Println("Starting DOHS server in plain HTTP on", addr)
+			err = serv.Serve(listener)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			reportError(fmt.Sprintf("DOHS server error: %v", err))
 		}
 	}()
 
@@ -44,48 +84,112 @@ func RunHttpServer(ctx context.Context) {
 	if err := serv.Shutdown(shutdownCtx); err != nil {
 		log.Printf("Error shutting down DOHS server: %v", err)
 	}
+	return nil
+}
+
+// listenHost is the configured address, in plain HTTP an empty one means loopback rather than
+// every interface, as cleartext is for a proxy on the same machine and not for the network
+func listenHost() string {
+	if config.Global.DohAddress == "" && config.Global.DohPlainHTTP {
+		return "127.0.0.1"
+	}
+	return config.Global.DohAddress
+}
+
+// newMux answers on the configured path and the JSON API, every other path gets a 404
+func newMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc(config.Global.DohPath, dohsHandler)
+	mux.HandleFunc(config.JsonApiPath, resolveHandler)
+	return mux
+}
+
+// reportError shows the error in the UI, the server failing mustn't take the app down with it
+func reportError(msg string) {
+	log.Println(msg)
+	channels.LogEventChannel <- channels.Event{
+		Type:    channels.Error,
+		Payload: msg,
+	}
 }
 
 func dohsHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("%s", r.Proto)
+	if wantsJson(r) {
+		resolveHandler(w, r)
+		return
+	}
+	if !acceptsDnsMessage(r.Header.Get("Accept")) {
+		writeError(w, http.StatusNotAcceptable, "Responses are only available as application/dns-message")
+		return
+	}
+
 	switch r.Method {
 	case "GET":
 		handleGet(w, r)
 	case "POST":
 		handlePost(w, r)
 	default:
+		w.Header().Set("Allow", "GET, POST")
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
 
+// acceptsDnsMessage checks the Accept header allows for the DNS wire format, which is all we answer in
+func acceptsDnsMessage(accept string) bool {
+	if accept == "" {
+		return true
+	}
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(mediaRange)
+		if err != nil || params["q"] == "0" {
+			continue
+		}
+		switch mediaType {
+		case dnsMessageType, "application/*", "*/*":
+			return true
+		}
+	}
+	return false
+}
+
 func handleGet(w http.ResponseWriter, r *http.Request) {
-	// extract data from url query param ?dns=
-	// decode the base64URL
-	// validate
+	// the query is base64url encoded without padding (RFC 8484 4.1), padding is tolerated nonetheless
+	param := r.URL.Query().Get("dns")
+	if param == "" {
+		writeError(w, http.StatusBadRequest, "Missing dns query parameter")
+		return
+	}
 
-	data, err := b64.URLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	data, err := b64.RawURLEncoding.DecodeString(strings.TrimRight(param, "="))
 	if err != nil {
-		writeError(w, 400, "Content-Type must be application/dns-message")
+		writeError(w, http.StatusBadRequest, "The dns query parameter must be base64url encoded")
 		return
 	}
-	generateDnsResponse(w, data)
-
+	if len(data) > maxMessageSize {
+		writeError(w, http.StatusRequestEntityTooLarge, "DNS message too large")
+		return
+	}
+	generateDnsResponse(w, r, data)
 }
 
 func handlePost(w http.ResponseWriter, r *http.Request) {
-	// check content-type
-	// Read raw body bytes
-	// validate it
-	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/dns-message") {
-		writeError(w, 400, "Content-Type must be application/dns-message")
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != dnsMessageType {
+		writeError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/dns-message")
 		return
 	}
-	data, err := io.ReadAll(r.Body)
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxMessageSize))
 	if err != nil {
-		writeError(w, 400, "Content-Type must be application/dns-message")
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, "DNS message too large")
+			return
+		}
+		writeError(w, http.StatusBadRequest, "Failed to read the request body")
 		return
 	}
-	generateDnsResponse(w, data)
+	generateDnsResponse(w, r, data)
 }
 
 func writeError(w http.ResponseWriter, status int, msg string) {
@@ -93,16 +197,27 @@ func writeError(w http.ResponseWriter, status int, msg string) {
 	_, _ = w.Write([]byte(msg))
 }
 
-func generateDnsResponse(w http.ResponseWriter, data []byte) {
-	log.Println(data)
-
+func generateDnsResponse(w http.ResponseWriter, r *http.Request, data []byte) {
 	dnsQuery, err := dns.DecodeDNSQuery(data)
 	if err != nil {
-		writeError(w, 400, "Content-Type must be application/dns-message")
+		log.Printf("Malformed DOHS query from %s: %v", r.RemoteAddr, err)
+		writeError(w, http.StatusBadRequest, "Malformed DNS message")
 		return
 	}
-	log.Println(dnsQuery)
+
 	dnsResp := dns.Lookup(dnsQuery)
-	w.Header().Set("Content-Type", "application/dns-message")
+	if dnsResp == nil {
+		writeError(w, http.StatusInternalServerError, "Failed to encode the DNS response")
+		return
+	}
+
+	// HTTP caches may keep the response for no longer than its records are valid (RFC 8484 5.1)
+	if resp, err := dns.DecodeDNSQuery(dnsResp); err == nil {
+		if maxAge, ok := resp.MaxAge(); ok {
+			w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", maxAge))
+		}
+	}
+
+	w.Header().Set("Content-Type", dnsMessageType)
 	_, _ = w.Write(dnsResp)
 }
@@ -0,0 +1,217 @@
+package dohs
+
+import (
+	"bytes"
+	b64 "encoding/base64"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"omamori/app/core/channels"
+	"omamori/app/core/config"
+	"omamori/app/core/dns"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const upstreamIP = "127.0.0.23"
+
+// wireName encodes the name uncompressed, as record data holds it
+func wireName(name string) []byte {
+	var b []byte
+	for _, label := range strings.Split(name, ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+func record(name string, qtype uint16, ttl uint32, data []byte) *dns.Answer {
+	return &dns.Answer{Name: name, Type: qtype, Class: 1, TTL: ttl, Data: data, Length: uint16(len(data))}
+}
+
+// soaData builds SOA data with the negative TTL in MINIMUM
+func soaData(zone string, minimum uint32) []byte {
+	data := append(wireName("ns."+zone), wireName("hostmaster."+zone)...)
+	for _, field := range []uint32{1, 3600, 600, 86400, minimum} {
+		data = binary.BigEndian.AppendUint32(data, field)
+	}
+	return data
+}
+
+// startUpstream answers ttl.doh.test with two A records of different TTLs and everything else with NXDOMAIN
+func startUpstream(t *testing.T) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", net.JoinHostPort(upstreamIP, "53"))
+	if err != nil {
+		t.Skip("can't bind a loopback address on port 53:", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	go func() {
+		buf := make([]byte, dns.MaxUDPSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			q, err := dns.DecodeDNSQuery(buf[:n])
+			if err != nil {
+				continue
+			}
+			q.Header.FLAGS |= 1<<15 | 1<<7
+			q.Edns = nil
+			if name := q.Question().Name; name == "ttl.doh.test" {
+				q.Answer = []*dns.Answer{
+					record(name, 1, 300, []byte{192, 0, 2, 1}),
+					record(name, 1, 60, []byte{192, 0, 2, 2}),
+				}
+			} else {
+				q.Header.FLAGS |= 3 // NXDOMAIN
+				q.Authority = []*dns.Answer{record("doh.test", 6, 3600, soaData("doh.test", 120))}
+			}
+			if resp, err := q.Encode(); err == nil {
+				_, _ = conn.WriteTo(resp, addr)
+			}
+		}
+	}()
+}
+
+// setupServer points the resolver at the stand-in upstream, putting the config back once the test is done
+func setupServer(t *testing.T) {
+	t.Helper()
+	saved, savedSites := *config.Global, config.BlockedSites
+	t.Cleanup(func() { *config.Global, config.BlockedSites = saved, savedSites })
+
+	config.Global.DohPath = "/dns-query"
+	config.Global.Upstreams = []config.UpstreamConfig{{Address: upstreamIP, Transport: "udp"}}
+	config.Global.DNSSEC = false
+	config.Global.Use0x20 = false
+
+	// an empty block list, without downloading one
+	config.Global.MapFile = filepath.Join(t.TempDir(), "map.txt")
+	if err := os.WriteFile(config.Global.MapFile, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.LoadBlockedSites(); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	go func() {
+		for {
+			select {
+			case <-channels.LogEventChannel:
+			case <-done:
+				return
+			}
+		}
+	}()
+	startUpstream(t)
+}
+
+func testQuery(t *testing.T, id uint16, name string) []byte {
+	t.Helper()
+	msg, err := (&dns.Query{
+		Header:    &dns.Header{ID: id, FLAGS: 1 << 8},
+		Questions: []*dns.Question{{Name: name, Type: 1, Class: 1}},
+	}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func serve(req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	newMux().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestGetUnpaddedBase64url(t *testing.T) {
+	setupServer(t)
+
+	// the ID makes the encoding start with the two characters base64url has in place of + and /
+	param := b64.RawURLEncoding.EncodeToString(testQuery(t, 0xfbff, "ttl.doh.test"))
+	if !strings.HasPrefix(param, "-_") || strings.Contains(param, "=") {
+		t.Fatalf("test query encodes as %q", param)
+	}
+
+	rec := serve(httptest.NewRequest("GET", "/dns-query?dns="+param, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != dnsMessageType {
+		t.Errorf("Content-Type %q", ct)
+	}
+	resp, err := dns.DecodeDNSQuery(rec.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Header.ID != 0xfbff || len(resp.Answer) != 2 {
+		t.Errorf("ID %#x with %d answers", resp.Header.ID, len(resp.Answer))
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	setupServer(t)
+
+	tests := []struct {
+		name   string
+		qname  string
+		maxAge string
+	}{
+		{"smallest TTL of the answer", "ttl.doh.test", "max-age=60"},
+		{"negative TTL from the SOA of NXDOMAIN", "missing.doh.test", "max-age=120"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/dns-query", bytes.NewReader(testQuery(t, 1, tt.qname)))
+			req.Header.Set("Content-Type", dnsMessageType)
+			rec := serve(req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body)
+			}
+			if cc := rec.Header().Get("Cache-Control"); cc != tt.maxAge {
+				t.Errorf("Cache-Control %q, want %q", cc, tt.maxAge)
+			}
+		})
+	}
+}
+
+func TestRejectedRequests(t *testing.T) {
+	setupServer(t)
+	query := testQuery(t, 1, "ttl.doh.test")
+	param := b64.RawURLEncoding.EncodeToString(query)
+
+	post := func(contentType string, body []byte) *http.Request {
+		req := httptest.NewRequest("POST", "/dns-query", bytes.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		return req
+	}
+	wrongAccept := httptest.NewRequest("GET", "/dns-query?dns="+param, nil)
+	wrongAccept.Header.Set("Accept", "text/html")
+
+	tests := []struct {
+		name   string
+		req    *http.Request
+		status int
+	}{
+		{"Accept without the DNS wire format", wrongAccept, http.StatusNotAcceptable},
+		{"wrong Content-Type", post("text/plain", query), http.StatusUnsupportedMediaType},
+		{"body above 65535 bytes", post(dnsMessageType, make([]byte, maxMessageSize+1)), http.StatusRequestEntityTooLarge},
+		{"path other than the configured one", httptest.NewRequest("GET", "/other?dns="+param, nil), http.StatusNotFound},
+		{"missing dns parameter", httptest.NewRequest("GET", "/dns-query", nil), http.StatusBadRequest},
+		{"standard base64 instead of base64url", httptest.NewRequest("GET", "/dns-query?dns=%2B%2F", nil), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := serve(tt.req); rec.Code != tt.status {
+				t.Errorf("status %d, want %d", rec.Code, tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"omamori/app/core/dns"
+	"time"
+
+	"golang.org/x/net/quic"
+)
+
+// DoQ error codes (RFC 9250 4.3)
+const (
+	doqInternalError = 0x1
+	doqProtocolError = 0x2
+	doqExcessiveLoad = 0x4
+)
+
+const (
+	doqMaxConnections = 256
+	doqMaxStreams     = 32 // queries per connection being resolved at once, enforced by QUIC flow control
+	doqIdleTimeout    = 30 * time.Second
+	doqShutdownWait   = 2 * time.Second
+)
+
+// startDoqServer serves DNS-over-QUIC (RFC 9250) with the same certificate as DOHS and DoT.
+// The error is for failing to start, once up it serves until the context is done.
+func startDoqServer(ctx context.Context, host string, port int) error {
+	endpoint, err := listenDoq(host, port)
+	if err != nil {
+		return err
+	}
+
+	log.Println("🚀 DoQ Server started on port: ", endpoint.LocalAddr().Port())
+	serveDoq(ctx, endpoint)
+	log.Println("Shutting down DoQ server gracefully")
+	return nil
+}
+
+// listenDoq binds the QUIC endpoint, port 0 picks a free one
+func listenDoq(host string, port int) (*quic.Endpoint, error) {
+	tlsConfig, err := serverTLSConfig("doq") // ALPN id of DoQ (RFC 9250 4.1.1)
+	if err != nil {
+		return nil, fmt.Errorf("loading the certificate: %w", err)
+	}
+	tlsConfig.MinVersion = tls.VersionTLS13 // QUIC is built on TLS 1.3 (RFC 9001 4.2)
+
+	endpoint, err := quic.Listen("udp", fmt.Sprintf("%s:%d", host, port), &quic.Config{
+		TLSConfig:            tlsConfig,
+		MaxBidiRemoteStreams: doqMaxStreams,
+		MaxUniRemoteStreams:  -1, // DoQ only uses bidirectional streams
+		MaxIdleTimeout:       doqIdleTimeout,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("binding the listener: %w", err)
+	}
+	return endpoint, nil
+}
+
+// serveDoq accepts connections until the context is done, then closes the endpoint
+func serveDoq(ctx context.Context, endpoint *quic.Endpoint) {
+	go func() {
+		<-ctx.Done()
+		closeCtx, cancel := context.WithTimeout(context.Background(), doqShutdownWait)
+		defer cancel()
+		_ = endpoint.Close(closeCtx)
+	}()
+
+	connSlots := make(chan struct{}, doqMaxConnections)
+
+	for {
+		conn, err := endpoint.Accept(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Println("Failed to accept DoQ connection:", err)
+			}
+			break
+		}
+
+		select {
+		case connSlots <- struct{}{}:
+		default:
+			// connection limit reached, refusing instead of queueing
+			conn.Abort(&quic.ApplicationError{Code: doqExcessiveLoad})
+			continue
+		}
+
+		go func() {
+			defer func() { <-connSlots }()
+			handleDoqConn(ctx, conn)
+		}()
+	}
+}
+
+// handleDoqConn answers every query of the connection on the stream it came on
+func handleDoqConn(ctx context.Context, conn *quic.Conn) {
+	for {
+		stream, err := conn.AcceptStream(ctx)
+		if err != nil {
+			// the client closed the connection, it went idle or we are shutting down
+			conn.Abort(nil)
+			return
+		}
+		go handleDoqStream(ctx, conn, stream)
+	}
+}
+
+// handleDoqStream reads the single query of the stream and writes the response back on
+// it, both length prefixed like over TCP (RFC 9250 4.2)
+func handleDoqStream(ctx context.Context, conn *quic.Conn, stream *quic.Stream) {
+	streamCtx, cancel := context.WithTimeout(ctx, doqIdleTimeout)
+	defer cancel()
+	stream.SetReadContext(streamCtx)
+	stream.SetWriteContext(streamCtx)
+
+	data, err := dns.ReadTCPMessage(stream)
+	if err != nil {
+		stream.Reset(doqProtocolError)
+		stream.CloseRead()
+		return
+	}
+	stream.CloseRead() // the client sends nothing more after its query
+
+	// the message ID is always 0, as the stream already tells queries apart (RFC 9250 4.2.1)
+	if len(data) < 2 || binary.BigEndian.Uint16(data) != 0 {
+		conn.Abort(&quic.ApplicationError{Code: doqProtocolError, Reason: "non-zero message ID"})
+		return
+	}
+
+	// the worker only hands the response over, writing it may wait on the client
+	responses := make(chan []byte, 1)
+	job := dnsJob{
+		data: data,
+		respond: func(resp []byte) {
+			responses <- resp
+		},
+	}
+
+	select {
+	case dnsJobChan <- job:
+	case <-streamCtx.Done():
+		stream.Reset(doqInternalError)
+		return
+	}
+
+	resp := <-responses
+	if resp == nil {
+		stream.Reset(doqInternalError)
+		return
+	}
+	if err := dns.WriteTCPMessage(stream, resp); err != nil {
+		log.Println("Failed to write DoQ response:", err)
+		return
+	}
+	// the end of the stream marks the end of the response
+	_ = stream.Close()
+}
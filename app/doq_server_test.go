@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"io"
+	"omamori/app/core/dns"
+	"testing"
+	"time"
+
+	"golang.org/x/net/quic"
+)
+
+// echoJobs stands in for the worker pool, answering every query with itself flagged as a response
+func echoJobs(ctx context.Context) {
+	for {
+		select {
+		case job := <-dnsJobChan:
+			resp := append([]byte(nil), job.data...)
+			resp[2] |= 0x80
+			job.respond(resp)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func startTestDoqServer(t *testing.T) (*quic.Conn, context.Context) {
+	t.Helper()
+	roots := x509.NewCertPool()
+	roots.AddCert(useTestCertificate(t))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+
+	server, err := listenDoq("127.0.0.1", 0)
+	if err != nil {
+		t.Skip("can't bind a UDP port:", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		serveDoq(ctx, server)
+		close(done)
+	}()
+	go echoJobs(ctx)
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	client, err := quic.Listen("udp", "127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close(context.Background()) })
+
+	conn, err := client.Dial(ctx, "udp", server.LocalAddr().String(), &quic.Config{
+		TLSConfig: &tls.Config{RootCAs: roots, NextProtos: []string{"doq"}, MinVersion: tls.VersionTLS13},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Abort(nil) })
+	return conn, ctx
+}
+
+// doqQuery sends the query on a stream of its own, closing our side once it is written
+func doqQuery(t *testing.T, ctx context.Context, conn *quic.Conn, query []byte) *quic.Stream {
+	t.Helper()
+	stream, err := conn.NewStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.SetReadContext(ctx)
+	stream.SetWriteContext(ctx)
+	if err := dns.WriteTCPMessage(stream, query); err != nil {
+		t.Fatal(err)
+	}
+	stream.CloseWrite()
+	return stream
+}
+
+func testDoqQuery(id uint16, name string) []byte {
+	query := binary.BigEndian.AppendUint16(nil, id)
+	query = append(query, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0) // RD, one question
+	query = append(query, byte(len(name)))
+	query = append(query, name...)
+	return append(query, 0, 0, 1, 0, 1) // A, IN
+}
+
+func TestDoqOneQueryPerStream(t *testing.T) {
+	conn, ctx := startTestDoqServer(t)
+
+	queries := [][]byte{testDoqQuery(0, "first"), testDoqQuery(0, "second")}
+	streams := make([]*quic.Stream, len(queries))
+	for i, query := range queries {
+		streams[i] = doqQuery(t, ctx, conn, query)
+	}
+
+	for i, stream := range streams {
+		resp, err := dns.ReadTCPMessage(stream)
+		if err != nil {
+			t.Fatalf("query %d: %v", i, err)
+		}
+		if string(resp[12:]) != string(queries[i][12:]) || resp[2]&0x80 == 0 {
+			t.Errorf("query %d answered with % x", i, resp)
+		}
+		// the response is followed by the end of the stream
+		if n, err := stream.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+			t.Errorf("query %d: read %d bytes and %v after the response, want the stream closed", i, n, err)
+		}
+	}
+}
+
+func TestDoqNonZeroMessageID(t *testing.T) {
+	conn, ctx := startTestDoqServer(t)
+
+	stream := doqQuery(t, ctx, conn, testDoqQuery(0x1234, "example"))
+	if _, err := dns.ReadTCPMessage(stream); err == nil {
+		t.Fatal("answered a query with a message ID")
+	}
+	err := conn.Wait(ctx)
+	if !errors.Is(err, &quic.ApplicationError{Code: doqProtocolError}) {
+		t.Errorf("connection closed with %v, want DOQ_PROTOCOL_ERROR", err)
+	}
+}
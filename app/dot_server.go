@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"omamori/app/core/config"
+)
+
+// startDotServer serves DNS-over-TLS (RFC 7858) with the same certificate as DOHS,
+// connections are handled like plain TCP ones once the TLS session is up. The error is
+// for failing to start, once up it serves until the context is done.
+func startDotServer(ctx context.Context, host string, port int) error {
+	tlsConfig, err := serverTLSConfig("dot") // ALPN id of DoT (RFC 7858 9)
+	if err != nil {
+		return fmt.Errorf("loading the certificate: %w", err)
+	}
+
+	listener, err := tls.Listen("tcp", fmt.Sprintf("%s:%d", host, port), tlsConfig)
+	if err != nil {
+		return fmt.Errorf("binding the listener: %w", err)
+	}
+
+	// the handshake happens on the first read, so the idle timeout covers it too
+	log.Println("🚀 DoT Server started on port: ", port)
+	serveStream(ctx, listener)
+	log.Println("Shutting down DoT server gracefully")
+	return nil
+}
+
+// serverTLSConfig loads the certificate shared by the encrypted listeners, offering the protocol over ALPN
+func serverTLSConfig(protocol string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(config.Global.CertPath, config.Global.KeyPath)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12, // RFC 8310 9
+		NextProtos:   []string{protocol},
+	}, nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"omamori/app/core/config"
+	"omamori/app/core/dns"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// useTestCertificate points the config at a fresh self-signed certificate for 127.0.0.1
+func useTestCertificate(t *testing.T) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	savedCert, savedKey := config.Global.CertPath, config.Global.KeyPath
+	config.Global.CertPath, config.Global.KeyPath = certPath, keyPath
+	t.Cleanup(func() { config.Global.CertPath, config.Global.KeyPath = savedCert, savedKey })
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// freePort finds a port nothing listens on, for servers that only take a port number
+func freePort(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	_ = listener.Close()
+	return port
+}
+
+func TestDotServer(t *testing.T) {
+	cert := useTestCertificate(t)
+	port := freePort(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		if err := startDotServer(ctx, "127.0.0.1", port); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	var conn *tls.Conn
+	var err error
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		conn, err = tls.Dial("tcp", addr, &tls.Config{RootCAs: roots, NextProtos: []string{"dot"}})
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	if proto := conn.ConnectionState().NegotiatedProtocol; proto != "dot" {
+		t.Errorf("negotiated %q over ALPN, want dot", proto)
+	}
+
+	// two queries pipelined on the connection before either is answered
+	for id := uint16(1); id <= 2; id++ {
+		query, err := (&dns.Query{
+			Header:    &dns.Header{ID: id, FLAGS: 1 << 8},
+			Questions: []*dns.Question{{Name: "example.com", Type: 1, Class: 1}},
+		}).Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := dns.WriteTCPMessage(conn, query); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// standing in for the worker pool, answering the second query first
+	var jobs []dnsJob
+	for len(jobs) < 2 {
+		select {
+		case job := <-dnsJobChan:
+			jobs = append(jobs, job)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d of the 2 queries reached the workers", len(jobs))
+		}
+	}
+	answered := time.Now()
+	for i := len(jobs) - 1; i >= 0; i-- {
+		resp := append([]byte(nil), jobs[i].data...)
+		resp[2] |= 0x80 // QR
+		jobs[i].respond(resp)
+
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		msg, err := dns.ReadTCPMessage(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id := binary.BigEndian.Uint16(msg[0:2]); id != binary.BigEndian.Uint16(jobs[i].data[0:2]) {
+			t.Errorf("got the answer to query %d before the one just resolved", id)
+		}
+	}
+
+	// nothing more is sent, so the server hangs up once the connection has been idle long enough
+	_ = conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout + 5*time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read on the idle connection: %v, want EOF", err)
+	}
+	if idle := time.Since(answered); idle < tcpIdleTimeout-time.Second {
+		t.Errorf("closed after %s idle, want %s", idle, tcpIdleTimeout)
+	}
+}
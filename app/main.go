@@ -25,41 +25,76 @@ func loadConf() {
 		log.Println("Failed to reload upstream conf:", err)
 	}
 
+	dns.ConfigureCache()
+
+	if err := dns.LoadTrustAnchors(); err != nil {
+		log.Println("Failed to load DNSSEC trust anchors:", err)
+	}
 }
 
+const (
+	cacheSnapshotInterval = 5 * time.Minute
+	noOfDnsWorkers        = 500
+)
+
 var dnsJobChan = make(chan dnsJob, 500)
 
 type dnsJob struct {
-	data   []byte
-	conn   *net.UDPConn
-	source *net.UDPAddr
+	data    []byte
+	udp     bool              // responses over udp are limited in size
+	respond func(resp []byte) // called exactly once, with nil if there is nothing to send back
 }
 
+// startDnsWorkerPool starts the workers resolving the queries of every listener, they run
+// for as long as the app does since the DoT and DoQ listeners can be up without the DNS server
 func startDnsWorkerPool(num int) {
 	log.Println("Starting DNS worker pool: ", num)
 	for i := 0; i < num; i++ {
 		go func() {
-			defer func() {
-				if r := recover(); r != nil {
-					log.Println("Recovered from panic: ", r)
-				}
-			}()
-
 			for job := range dnsJobChan {
-				if job.data == nil {
-					// terminate
-					return
-				}
-				handleDNSRequest(job.data, job.conn, job.source)
+				runDnsJob(job)
 			}
 		}()
 	}
 }
 
-func startUdpServer(ctx context.Context, host string, port int) {
+func runDnsJob(job dnsJob) {
+	var resp []byte
+	defer func() {
+		if r := recover(); r != nil {
+			log.Println("Recovered from panic: ", r)
+		}
+		job.respond(resp)
+	}()
+
+	resp = handleDNSRequest(job.data, job.udp)
+}
+
+func startDnsServer(ctx context.Context, host string, port int) {
+
+	go snapshotCache(ctx)
+
+	// both listeners share the same worker pool
+	go startTcpServer(ctx, host, port)
+	startUdpServer(ctx, host, port)
+}
+
+// snapshotCache saves the cache periodically while the server runs, so a crash doesn't lose all of it
+func snapshotCache(ctx context.Context) {
+	ticker := time.NewTicker(cacheSnapshotInterval)
+	defer ticker.Stop()
 
-	noOfDnsWorkers := 500
-	go startDnsWorkerPool(noOfDnsWorkers) // starting workers to handle DNS request
+	for {
+		select {
+		case <-ticker.C:
+			dns.SaveCache()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func startUdpServer(ctx context.Context, host string, port int) {
 
 	udpAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", host, port))
 	if err != nil {
@@ -76,15 +111,12 @@ func startUdpServer(ctx context.Context, host string, port int) {
 	// Log when server starts to confirm it's running
 	log.Println("🚀 DNS Server started on port: ", port)
 
-	buf := make([]byte, 512)
+	buf := make([]byte, dns.MaxUDPSize)
 	for {
 		select {
 		case <-ctx.Done():
 			log.Println("Shutting down UDP server gracefully")
 			_ = udpConn.Close()
-			for i := 0; i < noOfDnsWorkers; i++ {
-				dnsJobChan <- dnsJob{}
-			}
 			return
 		default:
 			_ = udpConn.SetReadDeadline(time.Now().Add(1 * time.Second))
@@ -99,7 +131,15 @@ func startUdpServer(ctx context.Context, host string, port int) {
 			}
 
 			// delegating to the go routine workers to avoid blocking the server
-			dnsJobChan <- dnsJob{data: append([]byte(nil), buf[:size]...), conn: udpConn, source: source}
+			dnsJobChan <- dnsJob{
+				data: append([]byte(nil), buf[:size]...),
+				udp:  true,
+				respond: func(resp []byte) {
+					if resp != nil {
+						writeResp(udpConn, resp, source)
+					}
+				},
+			}
 
 		}
 	}
@@ -114,17 +154,48 @@ func writeResp(udpConn *net.UDPConn, resp []byte, addr *net.UDPAddr) {
 
 }
 
-func handleDNSRequest(receivedData []byte, udpConn *net.UDPConn, source *net.UDPAddr) {
+func handleDNSRequest(receivedData []byte, udp bool) []byte {
 
 	dq, err := dns.DecodeDNSQuery(receivedData)
 	if err != nil {
 		log.Println("Failed to decode DNS query")
 		// don't want to response to malformed packets
-		return
+		return nil
 	}
 
+	maxSize := dq.UDPSize() // Lookup replaces the client's OPT record with ours
 	dnsResponse := dns.Lookup(dq)
-	writeResp(udpConn, dnsResponse, source)
+	if udp {
+		// too big answers are cut down with TC set, so the client can retry over TCP
+		dnsResponse = dns.Truncate(dnsResponse, maxSize)
+	}
+	return dnsResponse
+}
+
+// serverFailure is a server that stopped on its own, as it couldn't bind or load its certificate
+type serverFailure struct {
+	ctx  context.Context
+	stop channels.EventType // the event that would have stopped it
+}
+
+// runServer runs the server until its context is done, reporting back when it fails to start
+func runServer(ctx context.Context, name string, stop channels.EventType, failures chan<- serverFailure, serve func(context.Context) error) {
+	if err := serve(ctx); err != nil {
+		msg := fmt.Sprintf("Failed to start %s server: %v", name, err)
+		log.Println(msg)
+		channels.LogEventChannel <- channels.Event{Type: channels.Error, Payload: msg}
+		failures <- serverFailure{ctx: ctx, stop: stop}
+	}
+}
+
+// clearFailed forgets the cancel func of the server that failed, if it is the one still running
+func clearFailed(current context.Context, cancel *context.CancelFunc, failed context.Context) bool {
+	if *cancel == nil || current != failed {
+		return false
+	}
+	(*cancel)()
+	*cancel = nil
+	return true
 }
 
 func main() {
@@ -140,76 +211,143 @@ func main() {
 	//  Load blocked sites and conf continuously
 	loadConf()
 
+	// starting with the cache from the last run
+	dns.LoadCache()
+
+	// every listener shares the workers and relies on the upstream health, so both run for as long as the app does
+	startDnsWorkerPool(noOfDnsWorkers)
+	go dns.StartHealthChecker(context.Background())
+
 	var dnsCtx context.Context
 	var dnsCancel context.CancelFunc
 
 	var dohCtx context.Context
 	var dohCancel context.CancelFunc
 
+	var dotCtx context.Context
+	var dotCancel context.CancelFunc
+
+	var doqCtx context.Context
+	var doqCancel context.CancelFunc
+
+	failures := make(chan serverFailure)
+
 	go func() {
-		for event := range channels.GlobalEventChannel {
-			switch event.Type {
-			case channels.StartDnsServer:
-				// port argument is there for future extensibility
-				if dnsCancel != nil {
-					continue
+		for {
+			select {
+			case failure := <-failures:
+				// only if it is still the running instance, not one started again since
+				var cleared bool
+				switch failure.stop {
+				case channels.StopDOHServer:
+					cleared = clearFailed(dohCtx, &dohCancel, failure.ctx)
+				case channels.StopDOTServer:
+					cleared = clearFailed(dotCtx, &dotCancel, failure.ctx)
+				case channels.StopDOQServer:
+					cleared = clearFailed(doqCtx, &doqCancel, failure.ctx)
+				}
+				if cleared {
+					// the UI unticks the server, which is stopped already
+					channels.LogEventChannel <- channels.Event{Type: channels.ServerFailed, Payload: failure.stop}
 				}
-				dnsCtx, dnsCancel = context.WithCancel(context.Background())
-				go startUdpServer(dnsCtx, "127.0.0.1", configData.UdpServerPort)
 
-				if err := config.ConfigureSystemDNS(); err != nil {
-					channels.LogEventChannel <- channels.Event{
-						Type:    channels.Error,
-						Payload: fmt.Sprintf("Failed to configure system DNS: %v", err),
+			case event := <-channels.GlobalEventChannel:
+				switch event.Type {
+				case channels.StartDnsServer:
+					// port argument is there for future extensibility
+					if dnsCancel != nil {
+						continue
 					}
-				}
-			case channels.StopDnsServer:
-				if dnsCancel != nil {
-					dnsCancel()
-					dnsCancel = nil
-				}
+					dnsCtx, dnsCancel = context.WithCancel(context.Background())
+					go startDnsServer(dnsCtx, "127.0.0.1", configData.UdpServerPort)
 
-				if err := config.RestoreSystemDNS(); err != nil {
-					channels.LogEventChannel <- channels.Event{
-						Type:    channels.Error,
-						Payload: fmt.Sprintf("Failed to restore system DNS: %v", err),
+					if err := config.ConfigureSystemDNS(); err != nil {
+						channels.LogEventChannel <- channels.Event{
+							Type:    channels.Error,
+							Payload: fmt.Sprintf("Failed to configure system DNS: %v", err),
+						}
 					}
-				}
-			case channels.StartDOHServer:
-				if dohCancel != nil {
-					continue
-				}
-				dohCtx, dohCancel = context.WithCancel(context.Background())
-				go dohs.RunHttpServer(dohCtx)
-			case channels.StopDOHServer:
-				if dohCancel != nil {
-					dohCancel()
-					dohCancel = nil
-				}
-			case channels.UpdateConfig:
-				newConfig, ok := event.Payload.(*config.Config)
-				if ok {
-					err := config.UpdateConfig(newConfig)
+				case channels.StopDnsServer:
+					if dnsCancel != nil {
+						dnsCancel()
+						dnsCancel = nil
+						dns.SaveCache()
+					}
+
+					if err := config.RestoreSystemDNS(); err != nil {
+						channels.LogEventChannel <- channels.Event{
+							Type:    channels.Error,
+							Payload: fmt.Sprintf("Failed to restore system DNS: %v", err),
+						}
+					}
+				case channels.StartDOHServer:
+					if dohCancel != nil {
+						continue
+					}
+					dohCtx, dohCancel = context.WithCancel(context.Background())
+					go runServer(dohCtx, "DOHS", channels.StopDOHServer, failures, dohs.RunHttpServer)
+				case channels.StopDOHServer:
+					if dohCancel != nil {
+						dohCancel()
+						dohCancel = nil
+					}
+				case channels.StartDOTServer:
+					if dotCancel != nil {
+						continue
+					}
+					dotCtx, dotCancel = context.WithCancel(context.Background())
+					go runServer(dotCtx, "DoT", channels.StopDOTServer, failures, func(ctx context.Context) error {
+						return startDotServer(ctx, "", configData.DotServerPort)
+					})
+				case channels.StopDOTServer:
+					if dotCancel != nil {
+						dotCancel()
+						dotCancel = nil
+					}
+				case channels.StartDOQServer:
+					if doqCancel != nil {
+						continue
+					}
+					doqCtx, doqCancel = context.WithCancel(context.Background())
+					go runServer(doqCtx, "DoQ", channels.StopDOQServer, failures, func(ctx context.Context) error {
+						return startDoqServer(ctx, "", configData.DoqServerPort)
+					})
+				case channels.StopDOQServer:
+					if doqCancel != nil {
+						doqCancel()
+						doqCancel = nil
+					}
+				case channels.UpdateConfig:
+					newConfig, ok := event.Payload.(*config.Config)
+					if ok {
+						err := config.UpdateConfig(newConfig)
+						if err != nil {
+							log.Println("Failed to save config:", err)
+							channels.GlobalEventChannel <- channels.Event{
+								Type: channels.Error, Payload: err,
+							}
+						} else {
+							// upstreams that were removed or changed still hold their connections
+							dns.PruneUpstreams()
+						}
+					}
+
+				case channels.UpdateSiteList:
+					payload := event.Payload.(map[string]interface{})
+					err := config.UpdateSiteList(payload["operation"].(string), payload["siteData"].(config.SiteData))
 					if err != nil {
-						log.Println("Failed to save config:", err)
+						log.Println("Failed to update site list:", err)
 						channels.GlobalEventChannel <- channels.Event{
 							Type: channels.Error, Payload: err,
 						}
 					}
 				}
-
-			case channels.UpdateSiteList:
-				payload := event.Payload.(map[string]interface{})
-				err := config.UpdateSiteList(payload["operation"].(string), payload["siteData"].(config.SiteData))
-				if err != nil {
-					log.Println("Failed to update site list:", err)
-					channels.GlobalEventChannel <- channels.Event{
-						Type: channels.Error, Payload: err,
-					}
-				}
 			}
 		}
 	}()
 
 	ui.StartGUI()
+
+	// the window was closed
+	dns.SaveCache()
 }
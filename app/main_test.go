@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"omamori/app/core/channels"
+	"omamori/app/core/config"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerFailingToStartIsCleared(t *testing.T) {
+	savedCert := config.Global.CertPath
+	config.Global.CertPath = filepath.Join(t.TempDir(), "missing.pem")
+	t.Cleanup(func() { config.Global.CertPath = savedCert })
+
+	failures := make(chan serverFailure, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go runServer(ctx, "DoT", channels.StopDOTServer, failures, func(ctx context.Context) error {
+		return startDotServer(ctx, "127.0.0.1", 0)
+	})
+
+	select {
+	case event := <-channels.LogEventChannel:
+		if msg, _ := event.Payload.(string); event.Type != channels.Error || !strings.Contains(msg, "DoT") {
+			t.Errorf("reported %v %v, want the DoT error", event.Type, event.Payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the failure wasn't reported")
+	}
+
+	var failure serverFailure
+	select {
+	case failure = <-failures:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the failure wasn't signalled back")
+	}
+	if failure.stop != channels.StopDOTServer || failure.ctx != ctx {
+		t.Fatalf("signalled %v, want the DoT server", failure.stop)
+	}
+
+	// a server started again since isn't the one that failed
+	restartedCtx, restartedCancel := context.WithCancel(context.Background())
+	defer restartedCancel()
+	current := restartedCancel
+	if clearFailed(restartedCtx, &current, failure.ctx) || current == nil {
+		t.Error("cleared the server started again")
+	}
+
+	current = cancel
+	if !clearFailed(ctx, &current, failure.ctx) || current != nil {
+		t.Error("the failed server wasn't cleared")
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"omamori/app/core/channels"
+	"omamori/app/core/dns"
+	"sync"
+	"time"
+)
+
+const (
+	tcpIdleTimeout    = 10 * time.Second // RFC 7766 6.2.3, close idle connections after a few seconds
+	tcpMaxConnections = 256
+	tcpMaxInFlight    = 32 // pipelined queries per connection that are being resolved at once
+)
+
+func startTcpServer(ctx context.Context, host string, port int) {
+
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", host, port))
+	if err != nil {
+		log.Println("Failed to bind TCP listener:", err)
+		channels.LogEventChannel <- channels.Event{
+			Type:    channels.Error,
+			Payload: fmt.Sprintf("Failed to start DNS TCP listener: %v", err),
+		}
+		return
+	}
+
+	log.Println("🚀 DNS TCP Server started on port: ", port)
+	serveStream(ctx, listener)
+	log.Println("Shutting down TCP server gracefully")
+}
+
+// serveStream accepts connections until the context is cancelled and serves
+// length prefixed DNS messages on each of them
+func serveStream(ctx context.Context, listener net.Listener) {
+	go func() {
+		<-ctx.Done()
+		_ = listener.Close()
+	}()
+
+	connSlots := make(chan struct{}, tcpMaxConnections)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			log.Println("Failed to accept connection:", err)
+			return
+		}
+
+		select {
+		case connSlots <- struct{}{}:
+		default:
+			// connection limit reached, refusing instead of queueing
+			_ = conn.Close()
+			continue
+		}
+
+		go func() {
+			defer func() { <-connSlots }()
+			handleStreamConn(ctx, conn)
+		}()
+	}
+}
+
+func handleStreamConn(ctx context.Context, conn net.Conn) {
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	closed := make(chan struct{})
+	defer close(closed)
+
+	// unblock the read on shutdown
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-closed:
+		}
+	}()
+
+	var (
+		writeMutex sync.Mutex
+		pending    sync.WaitGroup
+		inFlight   = make(chan struct{}, tcpMaxInFlight)
+	)
+
+	// responses are written as soon as they are ready, so they may go out of order (RFC 7766 6.2.1.1)
+	respond := func(resp []byte) {
+		defer pending.Done()
+		defer func() { <-inFlight }()
+
+		if resp == nil {
+			return
+		}
+
+		writeMutex.Lock()
+		defer writeMutex.Unlock()
+
+		_ = conn.SetWriteDeadline(time.Now().Add(tcpIdleTimeout))
+		if err := dns.WriteTCPMessage(conn, resp); err != nil {
+			log.Println("Failed to write TCP response:", err)
+		}
+	}
+
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		data, err := dns.ReadTCPMessage(conn)
+		if err != nil {
+			// EOF, idle timeout or garbage on the wire, either way we are done reading
+			break
+		}
+
+		select {
+		case inFlight <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+
+		pending.Add(1)
+		select {
+		case dnsJobChan <- dnsJob{data: data, respond: respond}:
+		case <-ctx.Done():
+			pending.Done()
+			return
+		}
+	}
+
+	// flush the responses still being resolved before closing the connection
+	drained := make(chan struct{})
+	go func() {
+		pending.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+	}
+}
@@ -6,23 +6,36 @@ import (
 	"fyne.io/fyne/v2/container"
 	"fyne.io/fyne/v2/dialog"
 	"fyne.io/fyne/v2/layout"
+	"fyne.io/fyne/v2/theme"
 	"fyne.io/fyne/v2/widget"
-	"net"
 	"omamori/app/core/channels"
 	"omamori/app/core/config"
+	"strconv"
 )
 
 type ConfigManager struct {
 	app            *OmamoriApp
-	upstream1Entry *widget.Entry
-	upstream2Entry *widget.Entry
+	upstreams      []config.UpstreamConfig
+	upstreamList   *widget.List
+	strategySelect *widget.Select
+	recursive      bool
+	dnssec         bool
 	mapFileEntry   *widget.Entry
 	configChanged  bool
+
+	// Input fields for a new upstream
+	upstreamEntry  *widget.Entry
+	transportEntry *widget.Select
+	portEntry      *widget.Entry
+	timeoutEntry   *widget.Entry
 }
 
 func (o *OmamoriApp) createConfigManager() *ConfigManager {
 	return &ConfigManager{
 		app:           o,
+		upstreams:     append([]config.UpstreamConfig(nil), o.config.Upstreams...),
+		recursive:     o.config.Recursive,
+		dnssec:        o.config.DNSSEC,
 		configChanged: false,
 	}
 }
@@ -36,38 +49,102 @@ func (c *ConfigManager) bindCheck(check *widget.Check, initialValue bool, onTogg
 	return check
 }
 
-func (c *ConfigManager) bindIPEntry(entry *widget.Entry, initial string) *widget.Entry {
-	entry.SetText(initial)
-	entry.OnSubmitted = func(input string) {
-		c.validateIP(entry, input)
+func (c *ConfigManager) setupUpstreamList() {
+	c.upstreamList = widget.NewList(
+		func() int {
+			return len(c.upstreams)
+		},
+		func() fyne.CanvasObject {
+			label := widget.NewLabel("Template Upstream")
+
+			removeBtn := widget.NewButtonWithIcon("", theme.DeleteIcon(), nil)
+			removeBtn.Importance = widget.LowImportance
+
+			return container.NewBorder(nil, nil, nil, removeBtn, label)
+		},
+		func(id widget.ListItemID, obj fyne.CanvasObject) {
+			border, ok := obj.(*fyne.Container)
+			if !ok {
+				return
+			}
+
+			label := border.Objects[0].(*widget.Label)
+			button := border.Objects[1].(*widget.Button)
+
+			if id < len(c.upstreams) {
+				label.SetText(fmt.Sprintf("%d. %s", id+1, c.upstreams[id]))
+				button.OnTapped = func() {
+					c.removeUpstream(id)
+				}
+			}
+		},
+	)
+}
+
+func (c *ConfigManager) addUpstream() {
+	upstream := config.UpstreamConfig{
+		Address:   c.upstreamEntry.Text,
+		Transport: c.transportEntry.Selected,
 	}
 
-	entry.OnChanged = func(input string) {
-		c.configChanged = true
-		entry.SetValidationError(nil)
+	var err error
+	if c.portEntry.Text != "" {
+		if upstream.Port, err = strconv.Atoi(c.portEntry.Text); err != nil {
+			c.showUpstreamError(fmt.Errorf("invalid port %q", c.portEntry.Text))
+			return
+		}
 	}
-	return entry
+	if c.timeoutEntry.Text != "" {
+		if upstream.Timeout, err = strconv.Atoi(c.timeoutEntry.Text); err != nil {
+			c.showUpstreamError(fmt.Errorf("invalid timeout %q", c.timeoutEntry.Text))
+			return
+		}
+	}
+
+	upstream = upstream.Normalize()
+	if err := upstream.Validate(); err != nil {
+		c.showUpstreamError(err)
+		return
+	}
+
+	c.upstreams = append(c.upstreams, upstream)
+	c.upstreamList.Refresh()
+	c.configChanged = true
+
+	c.upstreamEntry.SetText("")
+	c.portEntry.SetText("")
+	c.timeoutEntry.SetText("")
 }
 
-func (c *ConfigManager) validateIP(entry *widget.Entry, input string) {
-	if net.ParseIP(input) == nil && input != "" {
-		entry.SetValidationError(fmt.Errorf("invalid IP address"))
-		channels.LogEventChannel <- channels.Event{
-			Type:    channels.Error,
-			Payload: fmt.Sprintf("Invalid IP address entered: %s", input),
-		}
-		c.configChanged = false
-	} else {
-		entry.SetValidationError(nil)
-		c.configChanged = true
+func (c *ConfigManager) removeUpstream(index int) {
+	if index < 0 || index >= len(c.upstreams) {
+		return
+	}
+	if len(c.upstreams) == 1 {
+		c.showUpstreamError(fmt.Errorf("at least one upstream is needed"))
+		return
+	}
+
+	c.upstreams = append(c.upstreams[:index], c.upstreams[index+1:]...)
+	c.upstreamList.Refresh()
+	c.configChanged = true
+}
+
+func (c *ConfigManager) showUpstreamError(err error) {
+	c.upstreamEntry.SetValidationError(err)
+	channels.LogEventChannel <- channels.Event{
+		Type:    channels.Error,
+		Payload: fmt.Sprintf("Invalid upstream entered: %v", err),
 	}
 }
 
 func (c *ConfigManager) saveConfig() {
 	newConfig := &config.Config{
-		Upstream1: c.upstream1Entry.Text,
-		Upstream2: c.upstream2Entry.Text,
-		MapFile:   c.mapFileEntry.Text,
+		Upstreams:        append([]config.UpstreamConfig(nil), c.upstreams...),
+		UpstreamStrategy: c.strategySelect.Selected,
+		Recursive:        c.recursive,
+		DNSSEC:           c.dnssec,
+		MapFile:          c.mapFileEntry.Text,
 	}
 
 	// TODO: currently for simplicity no option to update file paths
@@ -82,9 +159,49 @@ func (c *ConfigManager) saveConfig() {
 }
 
 func (c *ConfigManager) configurationTab() *container.Scroll {
-	// Upstream DNS entries
-	c.upstream1Entry = c.bindIPEntry(widget.NewEntry(), c.app.config.Upstream1)
-	c.upstream2Entry = c.bindIPEntry(widget.NewEntry(), c.app.config.Upstream2)
+	// Upstream DNS list, tried in order with the failover strategy
+	c.setupUpstreamList()
+
+	c.upstreamEntry = widget.NewEntry()
+	c.upstreamEntry.SetPlaceHolder("IP address, hostname or tls:// / https:// URL")
+	c.upstreamEntry.OnChanged = func(string) {
+		c.upstreamEntry.SetValidationError(nil)
+	}
+
+	c.transportEntry = widget.NewSelect(config.Transports, nil)
+	c.transportEntry.SetSelected(config.TransportUDP)
+
+	c.portEntry = widget.NewEntry()
+	c.portEntry.SetPlaceHolder("Port (default)")
+
+	c.timeoutEntry = widget.NewEntry()
+	c.timeoutEntry.SetPlaceHolder("Timeout ms (default)")
+
+	addUpstreamButton := widget.NewButtonWithIcon("Add", theme.ContentAddIcon(), c.addUpstream)
+
+	c.strategySelect = widget.NewSelect(config.Strategies, func(string) {
+		c.configChanged = true
+	})
+	c.strategySelect.Selected = c.app.config.UpstreamStrategy // without triggering OnChanged
+
+	recursiveCheck := c.bindCheck(
+		widget.NewCheck("Resolve from the root servers instead (recursive)", nil),
+		c.recursive,
+		func(enabled bool) {
+			c.recursive = enabled
+		},
+	)
+
+	dnssecCheck := c.bindCheck(
+		widget.NewCheck("Validate answers with DNSSEC", nil),
+		c.dnssec,
+		func(enabled bool) {
+			c.dnssec = enabled
+		},
+	)
+
+	upstreamScrollContainer := container.NewScroll(c.upstreamList)
+	upstreamScrollContainer.SetMinSize(fyne.NewSize(400, 150))
 
 	// Map file path
 	c.mapFileEntry = widget.NewEntry()
@@ -107,7 +224,7 @@ func (c *ConfigManager) configurationTab() *container.Scroll {
 
 	// DoHS checkbox (tracked separately too)
 	c.app.serverManager.dohsCheck = c.bindCheck(
-		widget.NewCheck("Start DOHS", nil),
+		widget.NewCheck(fmt.Sprintf("Start DOHS (port %d)", c.app.config.DohPort), nil),
 		c.app.serverManager.dohsEnabled,
 		func(enabled bool) {
 			if enabled {
@@ -119,14 +236,46 @@ func (c *ConfigManager) configurationTab() *container.Scroll {
 		},
 	)
 
+	c.app.serverManager.dotCheck = c.bindCheck(
+		widget.NewCheck(fmt.Sprintf("Start DoT (port %d)", c.app.config.DotServerPort), nil),
+		c.app.serverManager.dotEnabled,
+		func(enabled bool) {
+			if enabled {
+				channels.GlobalEventChannel <- channels.Event{Type: channels.StartDOTServer}
+			} else {
+				channels.GlobalEventChannel <- channels.Event{Type: channels.StopDOTServer}
+			}
+			c.app.serverManager.dotEnabled = enabled
+		},
+	)
+
+	c.app.serverManager.doqCheck = c.bindCheck(
+		widget.NewCheck(fmt.Sprintf("Start DoQ (UDP port %d)", c.app.config.DoqServerPort), nil),
+		c.app.serverManager.doqEnabled,
+		func(enabled bool) {
+			if enabled {
+				channels.GlobalEventChannel <- channels.Event{Type: channels.StartDOQServer}
+			} else {
+				channels.GlobalEventChannel <- channels.Event{Type: channels.StopDOQServer}
+			}
+			c.app.serverManager.doqEnabled = enabled
+		},
+	)
+
 	saveButton := widget.NewButton("Save Configuration", c.saveConfig)
 	saveButton.Importance = widget.HighImportance
 
 	form := container.NewVBox(
-		widget.NewCard("Upstream DNS Server", "",
+		widget.NewCard("Upstream DNS Servers", "",
 			container.NewVBox(
-				widget.NewFormItem("Primary Upstream DNS", c.upstream1Entry).Widget,
-				widget.NewFormItem("Secondary Upstream DNS", c.upstream2Entry).Widget,
+				upstreamScrollContainer,
+				container.NewBorder(nil, nil, nil,
+					container.NewHBox(c.transportEntry, c.portEntry, c.timeoutEntry, addUpstreamButton),
+					c.upstreamEntry,
+				),
+				container.NewBorder(nil, nil, widget.NewLabel("Strategy"), nil, c.strategySelect),
+				recursiveCheck,
+				dnssecCheck,
 			),
 		),
 		widget.NewCard("Site Map File", "",
@@ -136,8 +285,8 @@ func (c *ConfigManager) configurationTab() *container.Scroll {
 				).Widget,
 			),
 		),
-		widget.NewCard("DOHS Settings", "",
-			container.NewVBox(c.app.serverManager.dohsCheck),
+		widget.NewCard("DOHS / DoT / DoQ Settings", "",
+			container.NewVBox(c.app.serverManager.dohsCheck, c.app.serverManager.dotCheck, c.app.serverManager.doqCheck),
 		),
 		container.NewHBox(layout.NewSpacer(), saveButton),
 	)
@@ -101,6 +101,19 @@ func StartGUI() {
 		for {
 			select {
 			case data := <-channels.LogEventChannel:
+				if status, ok := data.Payload.(channels.UpstreamHealth); ok {
+					fyne.Do(func() {
+						omamori.serverManager.updateUpstreamHealth(status)
+					})
+					continue
+				}
+				if stop, ok := data.Payload.(channels.EventType); ok && data.Type == channels.ServerFailed {
+					fyne.Do(func() {
+						omamori.serverManager.serverFailed(stop)
+					})
+					continue
+				}
+
 				payload, ok := data.Payload.(string)
 				if !ok {
 					continue
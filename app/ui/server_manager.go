@@ -1,11 +1,13 @@
 package ui
 
 import (
+	"fmt"
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/container"
 	"fyne.io/fyne/v2/widget"
 	"omamori/app/core/channels"
 	"strconv"
+	"time"
 )
 
 type ServerManager struct {
@@ -13,15 +15,84 @@ type ServerManager struct {
 	startStopButton *widget.Button
 	dohsEnabled     bool
 	dohsCheck       *widget.Check
+	dotEnabled      bool
+	dotCheck        *widget.Check
+	doqEnabled      bool
+	doqCheck        *widget.Check
+
+	// latest health of every upstream, in the order they were first reported
+	upstreamHealth map[string]channels.UpstreamHealth
+	upstreamOrder  []string
+	healthList     *widget.List
 }
 
 func (o *OmamoriApp) createServerManager() *ServerManager {
 	return &ServerManager{
-		app:         o,
-		dohsEnabled: false,
+		app:            o,
+		dohsEnabled:    false,
+		upstreamHealth: make(map[string]channels.UpstreamHealth),
+	}
+}
+
+func (s *ServerManager) updateUpstreamHealth(status channels.UpstreamHealth) {
+	if _, found := s.upstreamHealth[status.Upstream]; !found {
+		s.upstreamOrder = append(s.upstreamOrder, status.Upstream)
+	}
+	s.upstreamHealth[status.Upstream] = status
+
+	if s.healthList != nil {
+		s.healthList.Refresh()
 	}
 }
 
+// serverFailed unticks the server that couldn't start, it is stopped already so no event is sent
+func (s *ServerManager) serverFailed(stop channels.EventType) {
+	var check *widget.Check
+	switch stop {
+	case channels.StopDOHServer:
+		s.dohsEnabled, check = false, s.dohsCheck
+	case channels.StopDOTServer:
+		s.dotEnabled, check = false, s.dotCheck
+	case channels.StopDOQServer:
+		s.doqEnabled, check = false, s.doqCheck
+	}
+	if check == nil {
+		return
+	}
+	onChanged := check.OnChanged
+	check.OnChanged = nil
+	check.SetChecked(false)
+	check.OnChanged = onChanged
+}
+
+func (s *ServerManager) setupHealthList() {
+	s.healthList = widget.NewList(
+		func() int {
+			return len(s.upstreamOrder)
+		},
+		func() fyne.CanvasObject {
+			return widget.NewLabel("Template Upstream")
+		},
+		func(id widget.ListItemID, obj fyne.CanvasObject) {
+			label, ok := obj.(*widget.Label)
+			if !ok || id >= len(s.upstreamOrder) {
+				return
+			}
+
+			status := s.upstreamHealth[s.upstreamOrder[id]]
+			if status.Up {
+				label.Importance = widget.SuccessImportance
+				label.SetText(fmt.Sprintf("● %s  up, %.0f%% answered, %d ms",
+					status.Upstream, status.SuccessRate*100, status.Latency.Milliseconds()))
+			} else {
+				label.Importance = widget.DangerImportance
+				label.SetText(fmt.Sprintf("● %s  down, retrying in %s",
+					status.Upstream, time.Until(status.NextProbe).Round(time.Second)))
+			}
+		},
+	)
+}
+
 func (s *ServerManager) toggleServer() {
 	if s.app.serverRunning {
 		s.stopServer()
@@ -65,10 +136,17 @@ func (s *ServerManager) serverControlTab() *fyne.Container {
 		),
 	)
 
+	// Upstream health, as reported by the health checker while the server runs
+	s.setupHealthList()
+	healthScrollContainer := container.NewScroll(s.healthList)
+	healthScrollContainer.SetMinSize(fyne.NewSize(400, 150))
+	upstreamHealthCard := widget.NewCard("Upstream Health", "", healthScrollContainer)
+
 	return container.NewVBox(
 		s.app.statusLabel,
 		container.NewHBox(
 			container.NewVBox(quickActionsCard),
 		),
+		upstreamHealthCard,
 	)
 }
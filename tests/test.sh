@@ -1,2 +1,3 @@
 apt install dnsutils -y
 dig +noedns @127.0.0.1 -p 2053 google.com
+dig +noedns +tcp @127.0.0.1 -p 2053 google.com